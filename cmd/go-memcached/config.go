@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "JSON file of flag values (ie: {\"capacity\": 1048576, \"listen\": [\":11211\"]}), overridden by flags")
+
+// loadConfig sets every flag not provided on the command line from the
+// config file at 'path': a JSON object whose names are the flags' names and
+// values their values. Durations are strings (ie: "30s"), and a repeatable
+// flag (ie: listen) takes an array.
+//
+// Any unknown name or invalid value is an error, so a broken config file
+// stops the server before it binds any port.
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid config (%s): %s", path, err)
+	}
+
+	provided := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		provided[f.Name] = true
+	})
+
+	// sorted, so the first invalid option reported is always the same
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("invalid config (%s): unknown option (%s)", path, name)
+		}
+		values, err := configValues(config[name])
+		if err != nil {
+			return fmt.Errorf("invalid config (%s): option (%s): %s", path, name, err)
+		}
+		if provided[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid config (%s): option (%s): invalid value (%s): %s", path, name, value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues returns the flag value(s) of a config option: the string
+// itself, the text of a number or boolean, or every element of an array.
+func configValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		values := make([]string, 0, len(list))
+		for _, element := range list {
+			value, err := configValue(element)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	value, err := configValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
+}
+
+// configValue returns the flag value of a single JSON value
+func configValue(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	if text == "" || text == "null" || text[0] == '{' || text[0] == '[' {
+		return "", fmt.Errorf("unsupported value (%s)", text)
+	}
+	return text, nil
+}
@@ -2,22 +2,245 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
 
 	"github.com/sfjuggernaut/go-memcached/pkg/cache"
 	"github.com/sfjuggernaut/go-memcached/pkg/server"
 )
 
+// stringList is a flag that can be provided multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var listen stringList
+
+func init() {
+	flag.Var(&listen, "listen", "address to run memcached server on (repeatable, overrides -port)")
+}
+
 var port = flag.Int("port", 11211, "port to run memcached server")
 var adminHttpPort = flag.Int("admin-http-port", 8989, "port to run admin HTTP server")
 var capacity = flag.Uint64("capacity", 1024*1024*64, "maximum number of bytes to store (memory limit of server)")
+var maxHeap = flag.Uint64("max-heap", 0, "maximum number of bytes of Go heap in use, evicting entries past it (0 disables)")
+var maxEntriesPerBucket = flag.Int("max-entries-per-bucket", 0, "maximum number of entries in each bucket regardless of their size (0 is unlimited)")
+var trackAccess = flag.Bool("track-access", false, "record the last access time and access count of each entry (reported by mg's l and a flags)")
+var skipIdenticalSets = flag.Bool("skip-identical-sets", false, "a set of the value and flags already stored only refreshes the expiration time, keeping the cas token")
+var sizeAwareThreshold = flag.Int("size-aware-threshold", 0, "entries of at least this many bytes are stored in the less full of two buckets (0 disables, doubles bucket locking)")
+var softCapacity = flag.Float64("soft-capacity", 0.9, "fraction of capacity past which writes only evict a few entries at a time (capacity is the hard limit)")
+var shedLatency = flag.Duration("shed-latency", 0, "moving average of command latency past which non-critical commands are rejected for a second (0 disables)")
+var criticalCommands = flag.String("critical-commands", "get,gets,mg", "comma separated commands never rejected when shedding load")
+var commandAliases = flag.String("command-aliases", "", "comma separated alias=command pairs of nonstandard verbs to accept (ie: put=set,fetch=get)")
 var numWorkers = flag.Int("num-workers", 8, "number of workers to process incoming connections")
 var maxNumConnections = flag.Int("max-num-connections", 1024, "maximum number of simultaneous connections")
+var listenBacklog = flag.Int("listen-backlog", 0, "length of the queue of connections waiting to be accepted per listener, capped by the kernel (0 is the OS default, Linux/BSD only)")
+var maxConnectionsPerIP = flag.Int("max-connections-per-ip", 0, "maximum number of simultaneous connections from a single client IP (0 is unlimited)")
+var maxKeysPerGet = flag.Int("max-keys-per-get", 1024, "maximum number of keys in a single get or gets (0 is unlimited)")
+var maxConnLifetime = flag.Duration("max-conn-lifetime", 0, "close connections older than this between commands, forcing clients to reconnect (0 is unlimited)")
+var idleTimeout = flag.Duration("idle-timeout", 0, "close connections that haven't sent anything for this long (0 is never)")
+var idleTimeoutJitter = flag.Float64("idle-timeout-jitter", 0.1, "fraction of idle-timeout each connection's timeout is randomly moved by")
+var idleBufferRelease = flag.Duration("idle-buffer-release", 0, "release the buffers of connections that haven't sent a command for this long (0 is never)")
+var dataBlockTimeout = flag.Duration("data-block-timeout", 0, "close connections whose data block hasn't arrived this long after its command line (0 is unlimited)")
+var parallelGetThreshold = flag.Int("parallel-get-threshold", 0, "number of keys from which a get looks up its keys concurrently (0 disables)")
+var parallelGetWorkers = flag.Int("parallel-get-workers", 4, "number of goroutines a get over parallel-get-threshold is split across")
+var readBufferSize = flag.Int("read-buffer-size", 4096, "size in bytes of each connection's read buffer")
+var writeBufferSize = flag.Int("write-buffer-size", 4096, "size in bytes of each connection's write buffer (larger takes fewer syscalls for large gets)")
 var numBuckets = flag.Int("num-buckets", 16, "number of buckets in the hash table of the cache")
+var sharedAdminPort = flag.Bool("shared-admin-port", false, "serve the admin HTTP interface on the memcache port (detected per connection)")
+var disableEasterEgg = flag.Bool("disable-easter-egg", false, "treat the hireeric? command as unsupported")
+var enableWatch = flag.Bool("enable-watch", false, "stream the key of every command and eviction via the admin /watch endpoint (debugging only, exposes key names)")
+var trackClients = flag.Bool("track-clients", false, "count the operations of every client IP, reported via the admin /clients endpoint")
+var enableStatsSizes = flag.Bool("enable-stats-sizes", false, "report a histogram of entry sizes via stats sizes (expensive, walks the entire cache)")
+var readOnly = flag.Bool("read-only", false, "reject every mutating command, serving reads only (ie: for a read replica)")
+var dedupeGetKeys = flag.Bool("dedupe-get-keys", false, "return a key repeated within a get or gets only once (memcached returns every occurrence)")
+var idempotentDelete = flag.Bool("idempotent-delete", false, "reply DELETED instead of NOT_FOUND when deleting a missing key")
+var reusePort = flag.Bool("reuse-port", false, "bind listeners with SO_REUSEPORT to allow handing off the port to a new instance (Linux/BSD only)")
+var slowStart = flag.Duration("slow-start", 0, "duration after startup over which the number of workers handling connections ramps up to num-workers")
+var warmup = flag.Duration("warmup", 0, "duration after startup during which eviction removes expired entries first")
+var staleGrace = flag.Duration("stale-grace", 0, "duration after expiring during which an entry is still served as stale by mg")
+var checksums = flag.Bool("checksums", false, "store and verify a checksum of each value (debugging aid)")
+var evictionPolicy = flag.String("eviction-policy", "lru", "how entries are evicted when the cache is full: lru, clock (approximate lru, gets don't lock buckets exclusively), or random (no recency tracking)")
+var evictionScope = flag.String("eviction-scope", "allkeys", "entries evicted when the cache is full: allkeys, or volatile (prefer entries with an expiration time)")
+var chunkSize = flag.Int("chunk-size", 0, "store values larger than this many bytes as chunks of this size (0 disables)")
+var statsLog = flag.String("stats-log", "stats.log", "file the stats are appended to as JSON lines every stats-log-interval")
+var statsLogInterval = flag.Duration("stats-log-interval", 0, "interval between two snapshots of the stats appended to stats-log (0 disables)")
+var quiet = flag.Bool("quiet", false, "discard the server's log output, errors and admin actions included")
+var connHistory = flag.Int("conn-history", 0, "number of commands (without values) each connection keeps, logged when it fails (0 disables)")
+var commandLog = flag.String("command-log", "", "append every mutating command to this file for replaying (lossy on crash)")
+var accessLog = flag.String("access-log", "", "append an audit line (client, command, keys, result) of every mutating command to this file")
+
+// replay sends the commands of a command log to a running server:
+//
+//	go-memcached replay [-addr localhost:11211] <file>
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:11211", "address of the memcached server to replay the command log against")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay [-addr address] <file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	failed, err := server.Replay(file, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("replay: done, (%d) commands failed\n", failed)
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
 	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	cache := cache.NewLRU(*capacity, uint32(*numBuckets))
+	if *checksums {
+		cache.EnableChecksums()
+	}
+	if *warmup > 0 {
+		cache.SetWarmup(*warmup)
+	}
+	if *staleGrace > 0 {
+		cache.SetStaleGrace(*staleGrace)
+	}
+	cache.SetSoftCapacity(*softCapacity)
+	if *skipIdenticalSets {
+		cache.SkipIdenticalSets()
+	}
+	if *trackAccess {
+		cache.EnableAccessTracking()
+	}
+	if *sizeAwareThreshold > 0 {
+		cache.SetSizeAwarePlacement(*sizeAwareThreshold)
+	}
+	if *maxEntriesPerBucket > 0 {
+		cache.SetMaxEntriesPerBucket(*maxEntriesPerBucket)
+	}
+	switch *evictionPolicy {
+	case "lru":
+	case "clock":
+		cache.EnableClockEviction()
+	case "random":
+		cache.EnableRandomEviction()
+	default:
+		log.Fatalf("unknown eviction policy (%s)", *evictionPolicy)
+	}
+	switch *evictionScope {
+	case "allkeys":
+	case "volatile":
+		cache.SetVolatileEviction(true)
+	default:
+		log.Fatalf("unknown eviction scope (%s)", *evictionScope)
+	}
+	if *chunkSize > 0 {
+		cache.SetChunkSize(*chunkSize)
+	}
+	var commands *server.CommandLog
+	if *commandLog != "" {
+		l, err := server.NewCommandLog(*commandLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		commands = l
+	}
+	var access *server.AccessLog
+	if *accessLog != "" {
+		f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		access = server.NewAccessLog(f)
+		// flushed before the file is closed
+		defer access.Close()
+	}
+	var stats *os.File
+	if *statsLogInterval > 0 {
+		f, err := os.OpenFile(*statsLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		stats = f
+	}
 	server := server.New(*port, *adminHttpPort, *numWorkers, *maxNumConnections, cache)
-	server.Start()
+	server.ListenAddresses = listen
+	server.SharedAdminPort = *sharedAdminPort
+	server.DisableEasterEgg = *disableEasterEgg
+	server.EnableStatsSizes = *enableStatsSizes
+	server.EnableWatch = *enableWatch
+	server.TrackClients = *trackClients
+	server.IdempotentDelete = *idempotentDelete
+	server.DedupeGetKeys = *dedupeGetKeys
+	server.ReadOnly = *readOnly
+	server.ReusePort = *reusePort
+	server.ListenBacklog = *listenBacklog
+	server.MaxConnectionsPerIP = *maxConnectionsPerIP
+	server.MaxKeysPerGet = *maxKeysPerGet
+	server.ParallelGetThreshold = *parallelGetThreshold
+	server.ParallelGetWorkers = *parallelGetWorkers
+	server.SlowStart = *slowStart
+	server.MaxConnLifetime = *maxConnLifetime
+	server.IdleTimeout = *idleTimeout
+	server.IdleTimeoutJitter = *idleTimeoutJitter
+	server.DataBlockTimeout = *dataBlockTimeout
+	server.IdleBufferRelease = *idleBufferRelease
+	server.MaxHeap = *maxHeap
+	server.ShedLatency = *shedLatency
+	server.CriticalCommands = strings.Split(*criticalCommands, ",")
+	if *commandAliases != "" {
+		server.CommandAliases = make(map[string]string)
+		for _, pair := range strings.Split(*commandAliases, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid command alias (%s), expected alias=command\n", pair)
+			}
+			server.CommandAliases[parts[0]] = parts[1]
+		}
+	}
+	server.ReadBufferSize = *readBufferSize
+	server.WriteBufferSize = *writeBufferSize
+	server.ConnHistory = *connHistory
+	server.CommandLog = commands
+	server.AccessLog = access
+	if stats != nil {
+		server.StatsLog = stats
+		server.StatsLogInterval = *statsLogInterval
+	}
+	if *quiet {
+		server.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	// the server has logged why it couldn't start
+	if err := server.Start(); err != nil {
+		os.Exit(1)
+	}
 }
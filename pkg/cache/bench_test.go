@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Benchmarks for the LRU under concurrent load, to quantify bucket lock
+// contention across bucket counts and key distributions. Run with:
+//
+//	go test -run xxx -bench . ./pkg/cache/
+//	go test -race -run xxx -bench . -benchtime 1000x ./pkg/cache/
+
+const benchNumKeys = 10000
+
+// keyPicker returns the index of the next key to access
+type keyPicker func() int
+
+// uniform access across all keys
+func newUniformPicker(r *rand.Rand) keyPicker {
+	return func() int {
+		return r.Intn(benchNumKeys)
+	}
+}
+
+// skewed (zipfian) access, a few keys are accessed far more than the rest
+func newZipfPicker(r *rand.Rand) keyPicker {
+	z := rand.NewZipf(r, 1.1, 1, benchNumKeys-1)
+	return func() int {
+		return int(z.Uint64())
+	}
+}
+
+func benchmarkLRU(b *testing.B, lru *LRU, newPicker func(*rand.Rand) keyPicker, readPercent int) {
+	keys := make([]string, benchNumKeys)
+	value := []byte("0123456789012345678901234567890123456789")
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+		lru.Add(keys[i], value, 0, 0)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		pick := newPicker(r)
+		for pb.Next() {
+			key := keys[pick()]
+			if r.Intn(100) < readPercent {
+				lru.Get(key)
+			} else {
+				lru.Add(key, value, 0, 0)
+			}
+		}
+	})
+}
+
+func BenchmarkLRU(b *testing.B) {
+	distributions := []struct {
+		name      string
+		newPicker func(*rand.Rand) keyPicker
+	}{
+		{"uniform", newUniformPicker},
+		{"zipf", newZipfPicker},
+	}
+	workloads := []struct {
+		name        string
+		readPercent int
+	}{
+		{"get", 100},
+		{"set", 0},
+		{"mixed", 90},
+	}
+
+	for _, numBuckets := range []uint32{1, 16, 256} {
+		for _, d := range distributions {
+			for _, w := range workloads {
+				name := fmt.Sprintf("buckets=%d/%s/%s", numBuckets, d.name, w.name)
+				b.Run(name, func(b *testing.B) {
+					benchmarkLRU(b, NewLRU(1024*1024*64, numBuckets), d.newPicker, w.readPercent)
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkLRUClock compares the default policy, whose gets lock their bucket
+// exclusively to reorder the evict list, with the CLOCK policy (see
+// EnableClockEviction), whose gets only lock it for reading, on skewed reads
+// contending for few buckets.
+func BenchmarkLRUClock(b *testing.B) {
+	for _, policy := range []string{"lru", "clock"} {
+		for _, readPercent := range []int{100, 90} {
+			b.Run(fmt.Sprintf("%s/reads=%d", policy, readPercent), func(b *testing.B) {
+				lru := NewLRU(1024*1024*64, 16)
+				if policy == "clock" {
+					lru.EnableClockEviction()
+				}
+				benchmarkLRU(b, lru, newZipfPicker, readPercent)
+			})
+		}
+	}
+}
+
+// BenchmarkLRUSizeAware compares plain and size-aware placement (see
+// SetSizeAwarePlacement) on a bimodal workload: mostly small values and 1 in
+// 20 large ones, with a capacity holding about half of them, reporting the hit
+// rate along with the time per operation.
+func BenchmarkLRUSizeAware(b *testing.B) {
+	for _, threshold := range []int{0, 512} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			benchmarkLRUSizeAware(b, threshold)
+		})
+	}
+}
+
+func benchmarkLRUSizeAware(b *testing.B, threshold int) {
+	small := make([]byte, 40)
+	large := make([]byte, 4000)
+	valueOf := func(i int) []byte {
+		if i%20 == 0 {
+			return large
+		}
+		return small
+	}
+	keys := make([]string, benchNumKeys)
+	var total uint64
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+		total += uint64(len(keys[i]) + len(valueOf(i)))
+	}
+	lru := NewLRU(total/2, 16)
+	lru.SetSizeAwarePlacement(threshold)
+	for i, key := range keys {
+		lru.Add(key, valueOf(i), 0, 0)
+	}
+
+	var hits, misses int64
+	var mu sync.Mutex
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		var h, m int64
+		for pb.Next() {
+			i := r.Intn(benchNumKeys)
+			if _, _, _, err := lru.Get(keys[i]); err == nil {
+				h++
+			} else {
+				m++
+				lru.Add(keys[i], valueOf(i), 0, 0)
+			}
+		}
+		mu.Lock()
+		hits += h
+		misses += m
+		mu.Unlock()
+	})
+	if hits+misses > 0 {
+		b.ReportMetric(100*float64(hits)/float64(hits+misses), "hit%")
+	}
+}
+
+// number of entries the LRU holds while churning through new keys
+const benchChurnEntries = 200000
+
+// BenchmarkLRUChurnGC measures the garbage collector while a full LRU is
+// constantly replacing entries: every operation stores a new key, evicting
+// the oldest entry. Besides the time per operation it reports the number of
+// collections, their mean and longest stop-the-world pauses, and the number
+// of heap objects per stored entry (its key, its value, the entry and its
+// evict list element).
+func BenchmarkLRUChurnGC(b *testing.B) {
+	value := make([]byte, 40)
+	lru := NewLRU(benchChurnEntries*uint64(len("key:0000000")+len(value)), 16)
+	for i := 0; i < benchChurnEntries; i++ {
+		lru.Add(fmt.Sprintf("key:%07d", i), append([]byte(nil), value...), 0, 0)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lru.Add(fmt.Sprintf("key:%07d", benchChurnEntries+i%(4*benchChurnEntries)), append([]byte(nil), value...), 0, 0)
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+
+	var longest uint64
+	gcs := after.NumGC - before.NumGC
+	for i := before.NumGC; i < after.NumGC && i < before.NumGC+uint32(len(after.PauseNs)); i++ {
+		if pause := after.PauseNs[i%uint32(len(after.PauseNs))]; pause > longest {
+			longest = pause
+		}
+	}
+	b.ReportMetric(float64(gcs), "gcs")
+	if gcs > 0 {
+		b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(gcs), "ns/pause")
+	}
+	b.ReportMetric(float64(longest), "max-ns/pause")
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapObjects)/benchChurnEntries, "objects/entry")
+	runtime.KeepAlive(lru)
+}
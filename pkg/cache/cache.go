@@ -5,12 +5,217 @@ import (
 )
 
 var (
-	ErrCacheMiss = errors.New("Cache miss")
+	ErrCacheMiss    = errors.New("Cache miss")
+	ErrCasConflict  = errors.New("Cas conflict")
+	ErrNotANumber   = errors.New("Not a number")
+	ErrOutOfMemory  = errors.New("Out of memory")
+	ErrNoSuchBucket = errors.New("No such bucket")
 )
 
+// NegativeFlag is the client flag bit (the highest bit) reserved to mark an
+// entry as a negative cache marker, ie: the key is known not to exist in the
+// backing store. Such an entry has an empty value and is returned by a get as
+// a normal VALUE, letting clients skip the backend lookup. Clients must not use
+// this bit for their own purposes.
+const NegativeFlag uint32 = 1 << 31
+
+// IsNegative returns true if the flags mark a negative cache entry.
+func IsNegative(flags uint32) bool {
+	return flags&NegativeFlag != 0
+}
+
 // A simple interface to allow for multiple caching strategies.
+//
+// Values are stored as-is and the slice returned from Get must not be
+// modified by the caller. 'expTime' follows memcached semantics: 0 never
+// expires, up to 30 days is a number of seconds from now, and anything
+// larger is an absolute unix time. Add returns the newly assigned cas token,
+// or ErrOutOfMemory if the value can't be stored.
+//
+// Incr adds (or subtracts if 'incr' is false) 'delta' to a decimal value,
+// only if the cas token matches when 'cas' is non-zero.
 type Cache interface {
-	Add(key, value string, flags uint32)
-	Get(key string) (string, uint32, uint64, error)
+	Add(key string, value []byte, flags uint32, expTime int32) (uint64, error)
+	Get(key string) ([]byte, uint32, uint64, error)
 	Delete(key string) error
+	Incr(key string, delta uint64, incr bool, cas uint64) (uint64, uint64, error)
+	Clear()
+}
+
+// Resizer is implemented by caches whose capacity can be changed at runtime.
+type Resizer interface {
+	Resize(newCapacity uint64)
+	Capacity() uint64
+}
+
+// PrefixDeleter is implemented by caches that can remove all entries
+// whose key starts with a given prefix.
+type PrefixDeleter interface {
+	DeletePrefix(prefix string) int
+}
+
+// BucketFlusher is implemented by caches split into buckets that can remove
+// every entry of a single bucket (ie: to tell whether a problem is local to
+// a bucket).
+type BucketFlusher interface {
+	// FlushBucket removes every entry of bucket 'n', returning the number of
+	// entries removed, or ErrNoSuchBucket if there is no bucket 'n'.
+	FlushBucket(n int) (int, error)
+}
+
+// SetOptions are the optional attributes of an entry stored with
+// OptionsAdder.AddWithOptions.
+type SetOptions struct {
+	// tags the entry can be invalidated by (see Tagger)
+	Tags []string
+	// number of seconds the entry is still served as stale once expired
+	// (see StaleGetter) instead of the cache's default, 0 keeps the default
+	Grace int32
+}
+
+// OptionsAdder is implemented by caches that can store entries with
+// SetOptions.
+type OptionsAdder interface {
+	// AddWithOptions is Add, storing the entry with 'opts'.
+	AddWithOptions(key string, value []byte, flags uint32, expTime int32, opts SetOptions) (uint64, error)
+}
+
+// Tagger is implemented by caches that can invalidate every entry carrying
+// a tag at once (ie: everything derived from a product). Entries are tagged
+// with SetOptions.Tags.
+type Tagger interface {
+	// InvalidateTag removes every entry currently tagged with 'tag', entries
+	// stored (with the tag) afterwards are kept.
+	InvalidateTag(tag string)
+}
+
+// Evicter is implemented by caches that can evict entries on demand (ie: to
+// relieve memory pressure not accounted for by their capacity).
+type Evicter interface {
+	// Evict evicts entries until (approximately) 'bytes' bytes have been
+	// freed, returning the number of bytes evicted.
+	Evict(bytes uint64) uint64
+}
+
+// EvictNotifier is implemented by caches that can report every entry they
+// evict. The hook is called with the cache's internal locks held, so it must
+// be quick and must not call back into the cache.
+type EvictNotifier interface {
+	SetEvictHook(hook func(key string))
+}
+
+// SizeHistogrammer is implemented by caches that can report a histogram
+// of their entry sizes. This is expected to be O(n).
+type SizeHistogrammer interface {
+	SizeHistogram() map[uint64]uint64
+}
+
+// Sizer is implemented by caches that can report how full they are: the
+// bytes they store (ByteSize) out of their capacity.
+type Sizer interface {
+	ByteSize() uint64
+	Capacity() uint64
+}
+
+// MemoryBreakdown is the memory taken by a cache's entries, in bytes (see
+// MemoryReporter).
+type MemoryBreakdown struct {
+	Entries  uint64
+	Keys     uint64
+	Values   uint64
+	Tags     uint64
+	Overhead uint64
+}
+
+// MemoryReporter is implemented by caches that can break down the memory
+// their entries take (see LRU.MemoryBreakdown).
+type MemoryReporter interface {
+	MemoryBreakdown() MemoryBreakdown
+}
+
+// BucketDiscrepancy is a bucket whose size accounting has drifted from the
+// entries it holds (see Verifier).
+type BucketDiscrepancy struct {
+	Bucket int
+	// bytes counted against the capacity, and the sum of the entries' sizes
+	Size   uint64
+	Actual uint64
+	// entries in the bucket's map, and on its evict list
+	Entries int
+	Listed  int
+}
+
+// Verifier is implemented by caches that can check their size accounting
+// against the entries they hold (see LRU.Verify). This is expected to be O(n).
+type Verifier interface {
+	Verify() []BucketDiscrepancy
+}
+
+// Ager is implemented by caches that can report how long their oldest entry
+// has been stored, in seconds (see LRU.OldestItemAge).
+type Ager interface {
+	OldestItemAge() int64
+}
+
+// SettingsReporter is implemented by caches that can report their effective
+// configuration (ie: for `stats settings`) as setting name to value.
+type SettingsReporter interface {
+	Settings() map[string]string
+}
+
+// Item is a single entry as returned by the cache.
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	Cas   uint64
+	// set if the item has expired but is still being served as stale
+	Stale bool
+	// set for the first caller to receive a stale item, who is expected to refresh it
+	Win bool
+	// set if the item had already been retrieved before this access
+	Fetched bool
+	// set if the cache tracks accesses (see LRU.EnableAccessTracking), in
+	// which case 'LastAccess' is the unix time (in seconds) the item was last
+	// accessed before this access (or stored, if never accessed) and
+	// 'Accesses' is its number of accesses before this one since it was stored
+	Tracked    bool
+	LastAccess int64
+	Accesses   uint64
+}
+
+// StaleGetter is implemented by caches that can serve expired entries as
+// stale for a grace period while a client refreshes them.
+type StaleGetter interface {
+	GetStale(key string) (Item, error)
+}
+
+// Computer is implemented by caches that can fill a missing entry with a
+// single computation however many callers miss it at once (see
+// LRU.GetOrCompute).
+type Computer interface {
+	GetOrCompute(key string, compute func() (value []byte, flags uint32, expTime int32)) (Item, error)
+}
+
+// DeleteReturner is implemented by caches that can remove an entry and return
+// it in a single operation, so no other client can read or update it in between.
+type DeleteReturner interface {
+	DeleteReturning(key string) (Item, error)
+}
+
+// CasItem is a single key to store with MultiCaser.CasMulti, only if its
+// current cas token matches 'Cas'.
+type CasItem struct {
+	Key     string
+	Value   []byte
+	Flags   uint32
+	ExpTime int32
+	Cas     uint64
+}
+
+// MultiCaser is implemented by caches that can compare-and-swap several
+// keys atomically: either every key matches its cas token and all are
+// stored, or nothing is stored.
+type MultiCaser interface {
+	CasMulti(items []CasItem) ([]uint64, error)
 }
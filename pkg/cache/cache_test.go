@@ -1,15 +1,21 @@
 package cache
 
 import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // An example cache that adheres to the Cache interface.
 // Only caches the last entry set.
 type LastEntryCache struct {
 	key   string
-	value string
+	value []byte
 	flags uint32
 	cas   uint64
 
@@ -20,7 +26,7 @@ func NewLEC() *LastEntryCache {
 	return &LastEntryCache{}
 }
 
-func (l *LastEntryCache) Add(key, value string, flags uint32) {
+func (l *LastEntryCache) Add(key string, value []byte, flags uint32, expTime int32) (uint64, error) {
 	l.Lock()
 	defer l.Unlock()
 
@@ -28,13 +34,14 @@ func (l *LastEntryCache) Add(key, value string, flags uint32) {
 	l.value = value
 	l.flags = flags
 	l.cas += 1
+	return l.cas, nil
 }
-func (l *LastEntryCache) Get(key string) (string, uint32, uint64, error) {
+func (l *LastEntryCache) Get(key string) ([]byte, uint32, uint64, error) {
 	l.RLock()
 	defer l.RUnlock()
 
 	if key != l.key {
-		return "", 0, 0, ErrCacheMiss
+		return nil, 0, 0, ErrCacheMiss
 	}
 	return l.value, l.flags, l.cas, nil
 }
@@ -50,6 +57,39 @@ func (l *LastEntryCache) Delete(key string) error {
 	return nil
 }
 
+func (l *LastEntryCache) Incr(key string, delta uint64, incr bool, cas uint64) (uint64, uint64, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if key != l.key {
+		return 0, 0, ErrCacheMiss
+	}
+	if cas != 0 && cas != l.cas {
+		return 0, 0, ErrCasConflict
+	}
+	value, err := strconv.ParseUint(string(l.value), 10, 64)
+	if err != nil {
+		return 0, 0, ErrNotANumber
+	}
+	if incr {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+	l.value = []byte(strconv.FormatUint(value, 10))
+	l.cas += 1
+	return value, l.cas, nil
+}
+
+func (l *LastEntryCache) Clear() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.key = ""
+}
+
 func TestLCEAdd(t *testing.T) {
 	cache := NewLEC()
 
@@ -60,14 +100,14 @@ func TestLCEAdd(t *testing.T) {
 	// add first entry
 	key1 := "k1"
 	value1 := "wombat"
-	cache.Add(key1, value1, 0)
+	cache.Add(key1, []byte(value1), 0, 0)
 
 	// verify its found
 	data, _, _, err := cache.Get(key1)
 	if err != nil {
 		t.Errorf("GET for key (%s) received unexpected err: %s\n", key1, err)
 	}
-	if data != value1 {
+	if string(data) != value1 {
 		t.Errorf("GET for key (%s) expected value (%s) but received (%s) instead\n", key1, value1, data)
 	}
 
@@ -83,14 +123,14 @@ func TestLCEAdd(t *testing.T) {
 	}
 
 	// add second entry
-	cache.Add(key2, value2, 0)
+	cache.Add(key2, []byte(value2), 0, 0)
 
 	// verify key2 is found with correct data
 	data, _, _, err = cache.Get(key2)
 	if err != nil {
 		t.Errorf("GET for key (%s) received unexpected err: %s\n", key2, err)
 	}
-	if data != value2 {
+	if string(data) != value2 {
 		t.Errorf("GET for key (%s) expected value (%s) but received (%s) instead\n", key2, value2, data)
 	}
 
@@ -113,3 +153,1452 @@ func TestLCEAdd(t *testing.T) {
 		t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", key2, ErrCacheMiss, err)
 	}
 }
+
+func TestLRUChecksums(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	lru.EnableChecksums()
+
+	key := "k1"
+	value := "wombat"
+	lru.Add(key, []byte(value), 0, 0)
+
+	// verify an untouched entry passes its checksum
+	data, _, _, err := lru.Get(key)
+	if err != nil {
+		t.Errorf("GET for key (%s) received unexpected err: %s\n", key, err)
+	}
+	if string(data) != value {
+		t.Errorf("GET for key (%s) expected value (%s) but received (%s) instead\n", key, value, data)
+	}
+
+	// corrupt the stored value behind the cache's back
+	before := StatsCorruptions.Value()
+	lru.buckets[0].elements[key].Value.(*entry).value = []byte("wombaT")
+
+	// verify the corrupted entry is reported as a miss and counted
+	if _, _, _, err := lru.Get(key); err != ErrCacheMiss {
+		t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+	}
+	if after := StatsCorruptions.Value(); after != before+1 {
+		t.Errorf("expected corruptions to be (%d) but received (%d)\n", before+1, after)
+	}
+}
+
+func TestLRUResize(t *testing.T) {
+	// 5 entries of 10 bytes each fit exactly
+	lru := NewLRU(50, 1)
+	value := "123456789"
+	for i := 0; i < 5; i++ {
+		lru.Add(string('0'+rune(i)), []byte(value), 0, 0)
+	}
+
+	// shrink to fit only 2 entries, the 3 least recently used should be evicted
+	lru.Resize(20)
+	if lru.Capacity() != 20 {
+		t.Errorf("expected capacity (%d) but received (%d)\n", 20, lru.Capacity())
+	}
+	for i := 0; i < 5; i++ {
+		key := string('0' + rune(i))
+		_, _, _, err := lru.Get(key)
+		if i < 3 && err != ErrCacheMiss {
+			t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+		}
+		if i >= 3 && err != nil {
+			t.Errorf("GET for key (%s) received unexpected err: %s\n", key, err)
+		}
+	}
+
+	// grow and verify new entries no longer evict
+	lru.Resize(100)
+	for i := 5; i < 8; i++ {
+		lru.Add(string('0'+rune(i)), []byte(value), 0, 0)
+	}
+	for i := 3; i < 8; i++ {
+		key := string('0' + rune(i))
+		if _, _, _, err := lru.Get(key); err != nil {
+			t.Errorf("GET for key (%s) received unexpected err: %s\n", key, err)
+		}
+	}
+}
+
+func TestLRUDeletePrefix(t *testing.T) {
+	lru := NewLRU(1024*1024, 4)
+	keys := []string{"user:1", "user:2", "user:3", "product:1", "users"}
+	for _, k := range keys {
+		lru.Add(k, []byte("wombat"), 0, 0)
+	}
+
+	if count := lru.DeletePrefix("user:"); count != 3 {
+		t.Errorf("DeletePrefix expected to delete (%d) entries but deleted (%d)\n", 3, count)
+	}
+
+	for _, k := range keys {
+		_, _, _, err := lru.Get(k)
+		if strings.HasPrefix(k, "user:") && err != ErrCacheMiss {
+			t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", k, ErrCacheMiss, err)
+		}
+		if !strings.HasPrefix(k, "user:") && err != nil {
+			t.Errorf("GET for key (%s) received unexpected err: %s\n", k, err)
+		}
+	}
+}
+
+func TestLRUExpiration(t *testing.T) {
+	lru := NewLRU(1024, 1)
+
+	// negative expiration time is expired immediately
+	key := "k1"
+	before := StatsExpiredUnfetched.Value()
+	lru.Add(key, []byte("wombat"), 0, -1)
+	if _, _, _, err := lru.Get(key); err != ErrCacheMiss {
+		t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+	}
+	if after := StatsExpiredUnfetched.Value(); after != before+1 {
+		t.Errorf("expected expired_unfetched to be (%d) but received (%d)\n", before+1, after)
+	}
+
+	// absolute expiration time in the past
+	lru.Add(key, []byte("wombat"), 0, int32(time.Now().Unix()-10))
+	if _, _, _, err := lru.Get(key); err != ErrCacheMiss {
+		t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+	}
+
+	// relative and absolute expiration times in the future
+	key2 := "k2"
+	lru.Add(key, []byte("wombat"), 0, 60)
+	lru.Add(key2, []byte("wombat"), 0, int32(time.Now().Unix()+60))
+	for _, k := range []string{key, key2} {
+		if _, _, _, err := lru.Get(k); err != nil {
+			t.Errorf("GET for key (%s) received unexpected err: %s\n", k, err)
+		}
+	}
+}
+
+func TestLRUEvictedUnfetched(t *testing.T) {
+	// room for 2 entries of 10 bytes each
+	lru := NewLRU(20, 1)
+	value := []byte("123456789")
+
+	lru.Add("0", value, 0, 0)
+	lru.Add("1", value, 0, 0)
+	lru.Get("0")
+
+	// evicts "1" which was never fetched
+	before := StatsEvictedUnfetched.Value()
+	lru.Add("2", value, 0, 0)
+	if after := StatsEvictedUnfetched.Value(); after != before+1 {
+		t.Errorf("expected evicted_unfetched to be (%d) but received (%d)\n", before+1, after)
+	}
+
+	// evicts "0" which was fetched
+	lru.Get("2")
+	lru.Add("3", value, 0, 0)
+	if after := StatsEvictedUnfetched.Value(); after != before+1 {
+		t.Errorf("expected evicted_unfetched to be (%d) but received (%d)\n", before+1, after)
+	}
+}
+
+func TestLRUClear(t *testing.T) {
+	lru := NewLRU(1024*1024, 4)
+	keys := []string{"k1", "k2", "k3", "k4", "k5"}
+	for _, k := range keys {
+		lru.Add(k, []byte("wombat"), 0, 0)
+	}
+
+	lru.Clear()
+
+	for _, k := range keys {
+		if _, _, _, err := lru.Get(k); err != ErrCacheMiss {
+			t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", k, ErrCacheMiss, err)
+		}
+	}
+	for i, bucket := range lru.buckets {
+		if bucket.size != 0 || len(bucket.elements) != 0 || bucket.evictList.Len() != 0 {
+			t.Errorf("bucket (%d) expected to be empty but has size (%d) and (%d) elements\n", i, bucket.size, len(bucket.elements))
+		}
+	}
+
+	// verify the cache is still usable after being cleared
+	lru.Add("k1", []byte("zoo"), 0, 0)
+	if _, _, _, err := lru.Get("k1"); err != nil {
+		t.Errorf("GET for key (%s) received unexpected err: %s\n", "k1", err)
+	}
+}
+
+func TestLRUSizeHistogram(t *testing.T) {
+	lru := NewLRU(1024*1024, 4)
+	lru.Add("k1", []byte("wo"), 0, 0)                      // 4 bytes
+	lru.Add("k2", []byte("wombat"), 0, 0)                  // 8 bytes
+	lru.Add("k3", []byte("wombat!"), 0, 0)                 // 9 bytes
+	lru.Add("k4", []byte(strings.Repeat("a", 1022)), 0, 0) // 1024 bytes
+
+	histogram := lru.SizeHistogram()
+	expected := map[uint64]uint64{4: 1, 8: 1, 16: 1, 1024: 1}
+	if len(histogram) != len(expected) {
+		t.Errorf("expected histogram (%v) but received (%v)\n", expected, histogram)
+	}
+	for size, count := range expected {
+		if histogram[size] != count {
+			t.Errorf("expected (%d) entries of size (%d) but received (%d)\n", count, size, histogram[size])
+		}
+	}
+}
+
+func TestLRUWarmup(t *testing.T) {
+	// room for 2 entries of 10 bytes each
+	lru := NewLRU(20, 1)
+	lru.SetWarmup(time.Minute)
+	value := []byte("123456789")
+
+	// "1" is the most recently used but expires right away
+	lru.Add("0", value, 0, 0)
+	lru.Add("1", value, 0, -1)
+
+	// while warming up, the expired entry goes before the least recently used one
+	lru.Add("2", value, 0, 0)
+	for _, k := range []string{"0", "2"} {
+		if _, _, _, err := lru.Get(k); err != nil {
+			t.Errorf("GET for key (%s) received unexpected err: %s\n", k, err)
+		}
+	}
+
+	// still evicts live entries when there is nothing expired
+	lru.Add("3", value, 0, 0)
+	if _, _, _, err := lru.Get("0"); err != ErrCacheMiss {
+		t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", "0", ErrCacheMiss, err)
+	}
+}
+
+func TestLRUIncr(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	key := "counter"
+
+	if _, _, err := lru.Incr(key, 1, true, 0); err != ErrCacheMiss {
+		t.Errorf("INCR for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+	}
+
+	lru.Add(key, []byte("10"), 0, 0)
+	value, cas, err := lru.Incr(key, 5, true, 0)
+	if err != nil || value != 15 {
+		t.Errorf("INCR for key (%s) expected (%d) but received (%d) with err: %v\n", key, 15, value, err)
+	}
+
+	// stale cas token is rejected and leaves the value untouched
+	if _, _, err := lru.Incr(key, 1, true, cas-1); err != ErrCasConflict {
+		t.Errorf("INCR for key (%s) expected (%s) but received (%s)\n", key, ErrCasConflict, err)
+	}
+
+	// matching cas token is accepted, decrement stops at 0
+	value, newCas, err := lru.Incr(key, 100, false, cas)
+	if err != nil || value != 0 {
+		t.Errorf("DECR for key (%s) expected (%d) but received (%d) with err: %v\n", key, 0, value, err)
+	}
+	data, _, getCas, _ := lru.Get(key)
+	if string(data) != "0" || getCas != newCas {
+		t.Errorf("GET for key (%s) expected value (0) and cas (%d) but received (%s) and (%d)\n", key, newCas, data, getCas)
+	}
+
+	lru.Add(key, []byte("wombat"), 0, 0)
+	if _, _, err := lru.Incr(key, 1, true, 0); err != ErrNotANumber {
+		t.Errorf("INCR for key (%s) expected (%s) but received (%s)\n", key, ErrNotANumber, err)
+	}
+}
+
+func TestLRUStaleGrace(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	lru.SetStaleGrace(time.Minute)
+	key := "k1"
+
+	// fresh
+	lru.Add(key, []byte("wombat"), 0, 60)
+	item, err := lru.GetStale(key)
+	if err != nil || item.Stale || item.Win {
+		t.Errorf("GetStale for key (%s) expected fresh item but received (%+v) with err: %v\n", key, item, err)
+	}
+
+	// expired but within grace, only the first caller wins
+	lru.Add(key, []byte("wombat"), 0, -1)
+	item, err = lru.GetStale(key)
+	if err != nil || !item.Stale || !item.Win || string(item.Value) != "wombat" {
+		t.Errorf("GetStale for key (%s) expected stale winning item but received (%+v) with err: %v\n", key, item, err)
+	}
+	item, err = lru.GetStale(key)
+	if err != nil || !item.Stale || item.Win {
+		t.Errorf("GetStale for key (%s) expected stale item but received (%+v) with err: %v\n", key, item, err)
+	}
+	if _, _, _, err := lru.Get(key); err != ErrCacheMiss {
+		t.Errorf("GET for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+	}
+
+	// past the grace period as well
+	lru.Add(key, []byte("wombat"), 0, int32(time.Now().Unix()-120))
+	if _, err := lru.GetStale(key); err != ErrCacheMiss {
+		t.Errorf("GetStale for key (%s) expected (%s) but received (%s)\n", key, ErrCacheMiss, err)
+	}
+}
+
+// newOrderedLRU returns an LRU with a single bucket so every key shares the
+// same evict list, making eviction order deterministic.
+func newOrderedLRU(capacity uint64) *LRU {
+	return NewLRU(capacity, 1)
+}
+
+// evictOrder returns the keys of a single bucket LRU from most to least
+// recently used (ie: the last key is the next to be evicted).
+func evictOrder(lru *LRU) []string {
+	bucket := lru.buckets[0]
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	keys := make([]string, 0, bucket.evictList.Len())
+	for e := bucket.evictList.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*entry).key)
+	}
+	return keys
+}
+
+// checkEvictOrder verifies the evict list of a single bucket LRU
+func checkEvictOrder(t *testing.T, lru *LRU, expected ...string) {
+	order := evictOrder(lru)
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected evict order (%v) but received (%v)\n", expected, order)
+	}
+}
+
+// entryMeta is the metadata of a stored entry, for tests to assert on
+type entryMeta struct {
+	cas       uint64
+	expiresAt int64
+	flags     uint32
+	size      uint64
+}
+
+// inspect returns the metadata of the entry stored for the key, in whichever
+// of its buckets holds it, without checking its expiration or checksum nor
+// touching its recency (unlike Get).
+func inspect(lru *LRU, key string) (entryMeta, bool) {
+	home, alt := lru.candidates(key)
+	for _, i := range []uint32{home, alt} {
+		bucket := lru.buckets[i]
+		bucket.Lock()
+		e, ok := bucket.elements[key]
+		if ok {
+			en := e.Value.(*entry)
+			meta := entryMeta{cas: en.cas, expiresAt: en.expiresAt, flags: en.flags, size: en.size()}
+			bucket.Unlock()
+			return meta, true
+		}
+		bucket.Unlock()
+	}
+	return entryMeta{}, false
+}
+
+func TestLRUEntryGrace(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	now := int32(time.Now().Unix())
+	grace := SetOptions{Grace: 60}
+
+	// fresh
+	lru.AddWithOptions("k1", []byte("wombat"), 0, 60, grace)
+	if item, err := lru.GetStale("k1"); err != nil || item.Stale {
+		t.Errorf("GetStale for key (k1) expected fresh item but received (%+v) with err: %v\n", item, err)
+	}
+
+	// expired but within its own grace, without a default grace
+	lru.AddWithOptions("k1", []byte("wombat"), 0, now-30, grace)
+	if item, err := lru.GetStale("k1"); err != nil || !item.Stale || !item.Win {
+		t.Errorf("GetStale for key (k1) expected stale winning item but received (%+v) with err: %v\n", item, err)
+	}
+	if _, _, _, err := lru.Get("k1"); err != ErrCacheMiss {
+		t.Errorf("GET for key (k1) expected (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+	lru.Add("k2", []byte("wombat"), 0, now-30)
+	if _, err := lru.GetStale("k2"); err != ErrCacheMiss {
+		t.Errorf("GetStale for key (k2) without grace expected (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+
+	// past its grace as well
+	lru.AddWithOptions("k1", []byte("wombat"), 0, now-120, grace)
+	if _, err := lru.GetStale("k1"); err != ErrCacheMiss {
+		t.Errorf("GetStale for key (k1) expected (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+
+	// the entry's grace overrides the default either way
+	lru.SetStaleGrace(10 * time.Second)
+	lru.AddWithOptions("k1", []byte("wombat"), 0, now-30, grace)
+	if item, err := lru.GetStale("k1"); err != nil || !item.Stale {
+		t.Errorf("GetStale for key (k1) expected stale item but received (%+v) with err: %v\n", item, err)
+	}
+	lru.SetStaleGrace(time.Hour)
+	lru.AddWithOptions("k1", []byte("wombat"), 0, now-120, grace)
+	if _, err := lru.GetStale("k1"); err != ErrCacheMiss {
+		t.Errorf("GetStale for key (k1) expected (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+
+	// a set without a grace removes it
+	lru.SetStaleGrace(0)
+	lru.AddWithOptions("k1", []byte("wombat"), 0, now-30, grace)
+	lru.Add("k1", []byte("wombat"), 0, now-30)
+	if _, err := lru.GetStale("k1"); err != ErrCacheMiss {
+		t.Errorf("GetStale for key (k1) expected (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+}
+
+func TestLRUFlushBucket(t *testing.T) {
+	lru := NewLRU(1024*1024, 4)
+	for i := 0; i < 100; i++ {
+		lru.Add("k"+strconv.Itoa(i), []byte("wombat"), 0, 0)
+	}
+	flushed := lru.buckets[2]
+	expected := len(flushed.elements)
+
+	count, err := lru.FlushBucket(2)
+	if err != nil || count != expected {
+		t.Fatalf("expected to flush (%d) entries but flushed (%d): %v\n", expected, count, err)
+	}
+	if len(flushed.elements) != 0 || flushed.evictList.Len() != 0 || flushed.size != 0 {
+		t.Errorf("expected bucket 2 to be empty but has (%d) entries of (%d) bytes\n", len(flushed.elements), flushed.size)
+	}
+	remaining := 0
+	for i := 0; i < 100; i++ {
+		key := "k" + strconv.Itoa(i)
+		_, _, _, err := lru.Get(key)
+		if lru.getBucket(key) == flushed && err != ErrCacheMiss {
+			t.Errorf("expected a miss for (%s) of the flushed bucket but got: %v\n", key, err)
+		}
+		if err == nil {
+			remaining++
+		}
+	}
+	if remaining != 100-expected {
+		t.Errorf("expected the other buckets to keep (%d) entries but got (%d)\n", 100-expected, remaining)
+	}
+
+	for _, n := range []int{-1, 4} {
+		if _, err := lru.FlushBucket(n); err != ErrNoSuchBucket {
+			t.Errorf("expected ErrNoSuchBucket for bucket (%d) but got: %v\n", n, err)
+		}
+	}
+}
+
+func TestLRUTags(t *testing.T) {
+	lru := NewLRU(1024*1024, 1)
+	lru.AddTagged("k1", []byte("wombat"), 0, 0, []string{"product:42"})
+	lru.AddTagged("k2", []byte("1"), 0, 0, []string{"user:7", "product:42"})
+	lru.AddTagged("k3", []byte("wombat"), 0, 0, []string{"user:7"})
+	lru.Add("k4", []byte("wombat"), 0, 0)
+	if _, _, err := lru.Incr("k2", 1, true, 0); err != nil {
+		t.Fatalf("incr of (k2) got unexpected error: %s\n", err)
+	}
+
+	lru.InvalidateTag("product:42")
+	for key, hit := range map[string]bool{"k1": false, "k2": false, "k3": true, "k4": true} {
+		if _, _, _, err := lru.Get(key); (err == nil) != hit {
+			t.Errorf("expected (%s) to be a hit (%t) but got: %v\n", key, hit, err)
+		}
+	}
+	if size := lru.buckets[0].size; size != uint64(2*len("k3wombat")+len("user:7")) {
+		t.Errorf("expected the invalidated entries to be removed but (%d) bytes are stored\n", size)
+	}
+
+	// stored with the tag after the invalidation
+	lru.AddTagged("k1", []byte("wombat"), 0, 0, []string{"product:42"})
+	if _, _, _, err := lru.Get("k1"); err != nil {
+		t.Errorf("expected (k1) stored after the invalidation to be kept but got: %s\n", err)
+	}
+
+	// a set without tags removes them
+	lru.Add("k3", []byte("wombat"), 0, 0)
+	lru.InvalidateTag("user:7")
+	if _, _, _, err := lru.Get("k3"); err != nil {
+		t.Errorf("expected untagged (k3) to be kept but got: %s\n", err)
+	}
+
+	// an identical set of an invalidated entry stores it again
+	lru.SkipIdenticalSets()
+	lru.AddTagged("k5", []byte("wombat"), 0, 0, []string{"user:8"})
+	lru.InvalidateTag("user:8")
+	lru.AddTagged("k5", []byte("wombat"), 0, 0, []string{"user:8"})
+	if _, _, _, err := lru.Get("k5"); err != nil {
+		t.Errorf("expected (k5) set again after the invalidation to be kept but got: %s\n", err)
+	}
+}
+
+func TestLRUSetCasToken(t *testing.T) {
+	lru := NewLRU(1024*1024, 16)
+	if last := lru.CasToken(); last != 0 {
+		t.Errorf("expected no cas token handed out but got (%d)\n", last)
+	}
+	lru.SetCasToken(1000)
+	if cas, _ := lru.Add("k1", []byte("wombat"), 0, 0); cas != 1001 {
+		t.Errorf("expected cas (1001) after setting the counter to 1000 but got (%d)\n", cas)
+	}
+	if _, _, cas, _ := lru.Get("k1"); cas != 1001 {
+		t.Errorf("expected k1 to have cas (1001) but got (%d)\n", cas)
+	}
+	// wombat isn't a number, a failed incr doesn't take a token
+	if _, _, err := lru.Incr("k1", 1, true, 0); err != ErrNotANumber || lru.CasToken() != 1001 {
+		t.Errorf("expected a failed incr to leave the counter at (1001) but got (%d): %v\n", lru.CasToken(), err)
+	}
+
+	// the counter never goes back
+	lru.SetCasToken(10)
+	if cas, _ := lru.Add("k2", []byte("zoo"), 0, 0); cas != 1002 {
+		t.Errorf("expected cas (1002) after trying to move the counter back but got (%d)\n", cas)
+	}
+	if last := lru.CasToken(); last != 1002 {
+		t.Errorf("expected the last cas token to be (1002) but got (%d)\n", last)
+	}
+}
+
+func TestLRUEntryMetadata(t *testing.T) {
+	lru := NewLRU(1024*1024, 16)
+
+	// cas tokens are taken from a single counter, one per write
+	cas, _ := lru.Add("k1", []byte("wombat"), 7, 0)
+	meta, ok := inspect(lru, "k1")
+	if !ok || meta != (entryMeta{cas: cas, flags: 7, size: 8}) {
+		t.Fatalf("expected k1 to have cas (%d), flags 7, size 8 and no expiry but got (%+v) (%v)\n", cas, meta, ok)
+	}
+	lru.Add("k1", []byte("12"), 0, 0)
+	if meta, _ = inspect(lru, "k1"); meta.cas != cas+1 || meta.size != 4 {
+		t.Errorf("expected an update to take cas (%d) and size 4 but got (%+v)\n", cas+1, meta)
+	}
+	lru.Incr("k1", 1, true, 0)
+	if meta, _ = inspect(lru, "k1"); meta.cas != cas+2 {
+		t.Errorf("expected an incr to take cas (%d) but got (%d)\n", cas+2, meta.cas)
+	}
+	lru.Add("k2", []byte("x"), 0, 0)
+	if meta, _ = inspect(lru, "k2"); meta.cas != cas+3 {
+		t.Errorf("expected a set of another key to take cas (%d) but got (%d)\n", cas+3, meta.cas)
+	}
+
+	// expiration times up to 30 days are relative, larger ones absolute
+	before := time.Now().Unix()
+	lru.Add("relative", []byte("x"), 0, 60)
+	after := time.Now().Unix()
+	if meta, _ = inspect(lru, "relative"); meta.expiresAt < before+60 || meta.expiresAt > after+60 {
+		t.Errorf("expected a relative expiry of 60s to expire between (%d) and (%d) but got (%d)\n", before+60, after+60, meta.expiresAt)
+	}
+	lru.Add("month", []byte("x"), 0, maxRelativeExpTime)
+	if meta, _ = inspect(lru, "month"); meta.expiresAt < before+maxRelativeExpTime {
+		t.Errorf("expected an expiry of 30 days to be relative but got (%d)\n", meta.expiresAt)
+	}
+	absolute := int32(before + 3600)
+	lru.Add("absolute", []byte("x"), 0, absolute)
+	if meta, _ = inspect(lru, "absolute"); meta.expiresAt != int64(absolute) {
+		t.Errorf("expected an absolute expiry of (%d) but got (%d)\n", absolute, meta.expiresAt)
+	}
+
+	if _, ok := inspect(lru, "missing"); ok {
+		t.Errorf("expected no metadata for a missing key\n")
+	}
+}
+
+func TestLRUEvictOrder(t *testing.T) {
+	// room for 3 entries of 10 bytes each
+	lru := newOrderedLRU(30)
+	value := []byte("123456789")
+
+	lru.Add("0", value, 0, 0)
+	lru.Add("1", value, 0, 0)
+	lru.Add("2", value, 0, 0)
+	checkEvictOrder(t, lru, "2", "1", "0")
+
+	// get moves to the front
+	lru.Get("0")
+	checkEvictOrder(t, lru, "0", "2", "1")
+
+	// update moves to the front
+	lru.Add("1", value, 0, 0)
+	checkEvictOrder(t, lru, "1", "0", "2")
+
+	// misses and deletes of other keys don't change the order
+	lru.Get("wombat")
+	lru.Delete("wombat")
+	checkEvictOrder(t, lru, "1", "0", "2")
+
+	// insert past capacity evicts from the back
+	lru.Add("3", value, 0, 0)
+	checkEvictOrder(t, lru, "3", "1", "0")
+
+	// delete removes from the middle
+	lru.Delete("1")
+	checkEvictOrder(t, lru, "3", "0")
+
+	// incr counts as an update
+	lru.Add("4", value, 0, 0)
+	lru.Incr("3", 1, true, 0)
+	checkEvictOrder(t, lru, "3", "4", "0")
+}
+
+func TestLRUAddReturnsCas(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	key := "k1"
+
+	cas1, _ := lru.Add(key, []byte("wombat"), 0, 0)
+	cas2, _ := lru.Add(key, []byte("zoo"), 0, 0)
+	if cas2 <= cas1 {
+		t.Errorf("expected cas (%d) to be greater than previous cas (%d)\n", cas2, cas1)
+	}
+	if _, _, cas, _ := lru.Get(key); cas != cas2 {
+		t.Errorf("GET for key (%s) expected cas (%d) but received (%d)\n", key, cas2, cas)
+	}
+}
+
+func TestLRUHashSeed(t *testing.T) {
+	lru1 := NewLRU(1024, 16)
+	lru2 := NewLRU(1024, 16)
+	lru1.SetHashSeed(42)
+	lru2.SetHashSeed(42)
+
+	// same seed always hashes the same way
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		if lru1.hash(keys[i]) != lru2.hash(keys[i]) {
+			t.Errorf("hash for key (%s) expected to match for the same seed\n", keys[i])
+		}
+	}
+
+	// a different seed changes bucket assignment
+	lru2.SetHashSeed(43)
+	same := 0
+	for _, k := range keys {
+		if lru1.getBucket(k) == lru1.buckets[lru2.hash(k)%lru2.numBuckets] {
+			same++
+		}
+	}
+	if same == len(keys) {
+		t.Errorf("expected different seeds to assign some keys to different buckets\n")
+	}
+}
+
+func TestLRUSetNegative(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	key := "k1"
+
+	lru.SetNegative(key, 60)
+	value, flags, _, err := lru.Get(key)
+	if err != nil {
+		t.Errorf("GET for key (%s) received unexpected err: %s\n", key, err)
+	}
+	if !IsNegative(flags) || len(value) != 0 {
+		t.Errorf("GET for key (%s) expected a negative marker but received flags (%d) and value (%s)\n", key, flags, value)
+	}
+
+	// a real value replaces the marker
+	lru.Add(key, []byte("wombat"), 13, 0)
+	if _, flags, _, _ := lru.Get(key); IsNegative(flags) {
+		t.Errorf("GET for key (%s) expected a regular entry but received flags (%d)\n", key, flags)
+	}
+}
+
+func TestLRUChunkedValues(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	lru.EnableChecksums()
+	lru.SetChunkSize(4)
+	key := "k1"
+	value := "wombatwomb"
+
+	lru.Add(key, []byte(value), 0, 0)
+	en := lru.buckets[0].elements[key].Value.(*entry)
+	if len(en.chunks) != 3 || en.value != nil {
+		t.Errorf("ADD for key (%s) expected (3) chunks but received (%d)\n", key, len(en.chunks))
+	}
+	if lru.buckets[0].size != uint64(len(key)+len(value)) {
+		t.Errorf("ADD for key (%s) expected size (%d) but received (%d)\n", key, len(key)+len(value), lru.buckets[0].size)
+	}
+	v, _, _, err := lru.Get(key)
+	if err != nil || string(v) != value {
+		t.Errorf("GET for key (%s) expected (%s) but received (%s) and err (%v)\n", key, value, v, err)
+	}
+
+	// small values are stored as is
+	lru.Add(key, []byte("1"), 0, 0)
+	if _, _, err := lru.Incr(key, 1, true, 0); err != nil {
+		t.Errorf("INCR for key (%s) received unexpected err: %s\n", key, err)
+	}
+	if en.chunks != nil || lru.buckets[0].size != uint64(len(key)+1) {
+		t.Errorf("ADD for key (%s) expected an unchunked value of size (%d) but received (%d) chunks and size (%d)\n", key, len(key)+1, len(en.chunks), lru.buckets[0].size)
+	}
+}
+
+func TestCommandsCas(t *testing.T) {
+	c := NewCommands(NewLRU(1024, 1))
+	key := "k1"
+
+	if _, err := c.Cas(key, []byte("wombat"), 0, 0, 1); err != ErrCacheMiss {
+		t.Errorf("CAS for missing key (%s) expected err (%s) but received (%v)\n", key, ErrCacheMiss, err)
+	}
+	cas, _ := c.Set(key, []byte("wombat"), 3, 0)
+	if _, err := c.Cas(key, []byte("womBat"), 3, 0, cas+1); err != ErrCasConflict {
+		t.Errorf("CAS for key (%s) expected err (%s) but received (%v)\n", key, ErrCasConflict, err)
+	}
+	newCas, err := c.Cas(key, []byte("womBat"), 3, 0, cas)
+	if err != nil {
+		t.Errorf("CAS for key (%s) received unexpected err: %s\n", key, err)
+	}
+	item, err := c.Get(key)
+	if err != nil || string(item.Value) != "womBat" || item.Flags != 3 || item.Cas != newCas {
+		t.Errorf("GET for key (%s) expected (womBat) with cas (%d) but received (%+v) and err (%v)\n", key, newCas, item, err)
+	}
+
+	// caches that can't compare-and-swap fall back to a get and a set
+	c = NewCommands(&LastEntryCache{})
+	cas, _ = c.Set(key, []byte("wombat"), 3, 0)
+	if _, err := c.Cas(key, []byte("womBat"), 3, 0, cas+1); err != ErrCasConflict {
+		t.Errorf("CAS for key (%s) expected err (%s) but received (%v)\n", key, ErrCasConflict, err)
+	}
+	if _, err := c.Cas(key, []byte("womBat"), 3, 0, cas); err != nil {
+		t.Errorf("CAS for key (%s) received unexpected err: %s\n", key, err)
+	}
+}
+
+func TestCommandsCasConcurrent(t *testing.T) {
+	c := NewCommands(NewLRU(1024*1024, 16))
+	key := "k1"
+	cas, _ := c.Set(key, []byte("wombat"), 0, 0)
+
+	// every caller holds the same token, only one can swap it
+	var wg sync.WaitGroup
+	var won, conflicts int64
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.Cas(key, []byte(strconv.Itoa(i)), 0, 0, cas)
+			switch err {
+			case nil:
+				atomic.AddInt64(&won, 1)
+			case ErrCasConflict:
+				atomic.AddInt64(&conflicts, 1)
+			default:
+				t.Errorf("CAS for key (%s) received unexpected err: %s\n", key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if won != 1 || conflicts != 31 {
+		t.Errorf("expected (1) CAS to win and (31) to conflict but received (%d) and (%d)\n", won, conflicts)
+	}
+}
+
+func TestLRUOldestItemAge(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	if age := lru.OldestItemAge(); age != 0 {
+		t.Errorf("OldestItemAge of an empty cache expected (0) but received (%d)\n", age)
+	}
+
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	lru.Add("k2", []byte("wombat"), 0, 0)
+	lru.buckets[0].elements["k1"].Value.(*entry).storedAt -= 100
+	if age := lru.OldestItemAge(); age != 100 {
+		t.Errorf("OldestItemAge expected (100) but received (%d)\n", age)
+	}
+
+	// an entry read is no longer next in line for eviction
+	lru.Get("k1")
+	if age := lru.OldestItemAge(); age != 0 {
+		t.Errorf("OldestItemAge after reading the oldest entry expected (0) but received (%d)\n", age)
+	}
+	// storing it again restarts its age
+	lru.Add("k1", []byte("womBat"), 0, 0)
+	lru.Get("k2")
+	if age := lru.OldestItemAge(); age != 0 {
+		t.Errorf("OldestItemAge after storing the oldest entry again expected (0) but received (%d)\n", age)
+	}
+
+	// even if the value stored is identical (see SkipIdenticalSets)
+	lru.SkipIdenticalSets()
+	lru.buckets[0].elements["k1"].Value.(*entry).storedAt -= 100
+	lru.Add("k1", []byte("womBat"), 0, 0)
+	lru.Get("k2")
+	if age := lru.OldestItemAge(); age != 0 {
+		t.Errorf("OldestItemAge after storing the oldest entry identically expected (0) but received (%d)\n", age)
+	}
+}
+
+func TestLRUByteSize(t *testing.T) {
+	lru := NewLRU(1024, 4)
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	lru.Add("k2", []byte("zoo"), 0, 0)
+	if size := lru.ByteSize(); size != 13 {
+		t.Errorf("ByteSize expected (13) but received (%d)\n", size)
+	}
+	lru.Delete("k1")
+	if size := lru.ByteSize(); size != 5 {
+		t.Errorf("ByteSize after a delete expected (5) but received (%d)\n", size)
+	}
+}
+
+func TestLRUMemoryBreakdown(t *testing.T) {
+	lru := NewLRU(1024, 4)
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	lru.AddTagged("k2", []byte("zoo"), 0, 0, []string{"animals"})
+	breakdown := lru.MemoryBreakdown()
+	expected := MemoryBreakdown{Entries: 2, Keys: 4, Values: 9, Tags: 7, Overhead: 2 * entryOverhead}
+	if breakdown != expected {
+		t.Errorf("MemoryBreakdown expected (%+v) but received (%+v)\n", expected, breakdown)
+	}
+
+	// replacing a value or tags, and deleting, keep every part accurate
+	lru.Add("k1", []byte("wombats"), 0, 0)
+	lru.AddTagged("k2", []byte("zoo"), 0, 0, []string{"zoo"})
+	lru.Delete("k1")
+	expected = MemoryBreakdown{Entries: 1, Keys: 2, Values: 3, Tags: 3, Overhead: entryOverhead}
+	if breakdown = lru.MemoryBreakdown(); breakdown != expected {
+		t.Errorf("MemoryBreakdown after updates expected (%+v) but received (%+v)\n", expected, breakdown)
+	}
+
+	lru.Clear()
+	if breakdown = lru.MemoryBreakdown(); breakdown != (MemoryBreakdown{}) {
+		t.Errorf("MemoryBreakdown after Clear expected nothing but received (%+v)\n", breakdown)
+	}
+}
+
+func TestCommandsGetOrCompute(t *testing.T) {
+	c := NewCommands(NewLRU(1024, 1))
+	var computed int32
+	compute := func() ([]byte, uint32, int32) {
+		atomic.AddInt32(&computed, 1)
+		// long enough for every caller to miss the key meanwhile
+		time.Sleep(50 * time.Millisecond)
+		return []byte("wombat"), 3, 0
+	}
+
+	// only one of the callers missing the key computes it
+	var wg sync.WaitGroup
+	items := make([]Item, 20)
+	errs := make([]error, len(items))
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			items[i], errs[i] = c.GetOrCompute("k1", compute)
+		}(i)
+	}
+	wg.Wait()
+	if computed != 1 {
+		t.Errorf("GetOrCompute expected to compute once but computed (%d) times\n", computed)
+	}
+	for i, item := range items {
+		if errs[i] != nil || string(item.Value) != "wombat" || item.Flags != 3 || item.Cas != items[0].Cas {
+			t.Errorf("GetOrCompute expected (wombat) but received (%+v) and err (%v)\n", item, errs[i])
+		}
+	}
+
+	// a stored key isn't computed again
+	if item, err := c.GetOrCompute("k1", compute); err != nil || string(item.Value) != "wombat" || computed != 1 {
+		t.Errorf("GetOrCompute of a stored key received (%+v) and err (%v) after (%d) computations\n", item, err, computed)
+	}
+
+	// caches without single computations still compute missing keys
+	c = NewCommands(&LastEntryCache{})
+	if item, err := c.GetOrCompute("k2", compute); err != nil || string(item.Value) != "wombat" || computed != 2 {
+		t.Errorf("GetOrCompute without Computer received (%+v) and err (%v) after (%d) computations\n", item, err, computed)
+	}
+	if _, err := c.Get("k2"); err != nil {
+		t.Errorf("GET for computed key (k2) received unexpected err: %s\n", err)
+	}
+}
+
+func TestLRUCasMulti(t *testing.T) {
+	lru := NewLRU(1024, 4)
+	cas1, _ := lru.Add("k1", []byte("wombat"), 0, 0)
+	cas2, _ := lru.Add("k2", []byte("wombat"), 0, 0)
+
+	// a single mismatched token rejects every item
+	_, err := lru.CasMulti([]CasItem{
+		{Key: "k1", Value: []byte("womBat"), Cas: cas1},
+		{Key: "k2", Value: []byte("womBat"), Cas: cas2 + 1},
+	})
+	if err != ErrCasConflict {
+		t.Errorf("CasMulti expected err (%s) but received (%v)\n", ErrCasConflict, err)
+	}
+	if v, _, _, _ := lru.Get("k1"); string(v) != "wombat" {
+		t.Errorf("GET for key (k1) expected (wombat) but received (%s)\n", v)
+	}
+	if _, err := lru.CasMulti([]CasItem{{Key: "k1", Cas: cas1}, {Key: "k3", Cas: 1}}); err != ErrCacheMiss {
+		t.Errorf("CasMulti expected err (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+
+	tokens, err := lru.CasMulti([]CasItem{
+		{Key: "k1", Value: []byte("womBat"), Flags: 1, Cas: cas1},
+		{Key: "k2", Value: []byte("wOmbat"), Flags: 2, Cas: cas2},
+	})
+	if err != nil {
+		t.Errorf("CasMulti received unexpected err: %s\n", err)
+	}
+	for i, expected := range []string{"womBat", "wOmbat"} {
+		key := "k" + strconv.Itoa(i+1)
+		v, flags, cas, _ := lru.Get(key)
+		if string(v) != expected || flags != uint32(i+1) || cas != tokens[i] {
+			t.Errorf("GET for key (%s) expected (%s) with cas (%d) but received (%s) with cas (%d)\n", key, expected, tokens[i], v, cas)
+		}
+	}
+}
+
+func TestLRUCasMultiTagged(t *testing.T) {
+	lru := NewLRU(30, 1)
+	cas, _ := lru.AddTagged("k1", []byte("wombat"), 0, 0, []string{"product:42"})
+
+	// the key and value fit in the capacity, but not with the tags kept
+	value := []byte(strings.Repeat("a", 28))
+	if _, err := lru.CasMulti([]CasItem{{Key: "k1", Value: value, Cas: cas}}); err != ErrOutOfMemory {
+		t.Errorf("CasMulti expected err (%s) but received (%v)\n", ErrOutOfMemory, err)
+	}
+	if v, _, _, err := lru.Get("k1"); err != nil || string(v) != "wombat" {
+		t.Errorf("GET for key (k1) expected (wombat) but received (%s) with err: %v\n", v, err)
+	}
+}
+
+func TestLRUCasMultiConcurrent(t *testing.T) {
+	lru := NewLRU(1024*1024, 16)
+	keys := []string{"k1", "k2", "k3", "k4", "k5"}
+	for _, key := range keys {
+		lru.Add(key, []byte("0"), 0, 0)
+	}
+
+	// opposite key orders must not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(reverse bool) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				items := make([]CasItem, len(keys))
+				for k, key := range keys {
+					if reverse {
+						key = keys[len(keys)-1-k]
+					}
+					_, _, cas, _ := lru.Get(key)
+					items[k] = CasItem{Key: key, Value: []byte("1"), Cas: cas}
+				}
+				lru.CasMulti(items)
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+}
+
+func TestLRURandomEviction(t *testing.T) {
+	// room for 3 entries of 10 bytes each
+	lru := newOrderedLRU(30)
+	lru.EnableRandomEviction()
+	value := []byte("123456789")
+
+	lru.Add("0", value, 0, 0)
+	lru.Add("1", value, 0, 0)
+	lru.Add("2", value, 0, 0)
+
+	// accessing or updating entries doesn't reorder them
+	lru.Get("0")
+	lru.Add("1", value, 0, 0)
+	checkEvictOrder(t, lru, "2", "1", "0")
+
+	// an expired entry is evicted first
+	lru.Add("1", value, 0, -1)
+	lru.Add("3", value, 0, 0)
+	checkEvictOrder(t, lru, "3", "2", "0")
+	if _, _, _, err := lru.Get("1"); err != ErrCacheMiss {
+		t.Errorf("GET for key (1) expected err (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+
+	// otherwise any entry can be evicted
+	lru.Add("4", value, 0, 0)
+	if order := evictOrder(lru); len(order) != 3 || order[0] != "4" {
+		t.Errorf("expected 3 entries with (4) first but received (%v)\n", order)
+	}
+}
+
+func TestLRUClockEviction(t *testing.T) {
+	// room for 3 entries of 10 bytes each
+	lru := newOrderedLRU(30)
+	lru.EnableClockEviction()
+	value := []byte("123456789")
+
+	lru.Add("0", value, 0, 0)
+	lru.Add("1", value, 0, 0)
+	lru.Add("2", value, 0, 0)
+
+	// accessing an entry only marks it, without reordering
+	lru.Get("0")
+	lru.Get("0")
+	checkEvictOrder(t, lru, "2", "1", "0")
+
+	// the oldest entry is referenced, so it gets a second chance
+	lru.Add("3", value, 0, 0)
+	checkEvictOrder(t, lru, "0", "3", "2")
+
+	// with every entry referenced, the sweep clears them all and evicts the
+	// oldest, never the entry just written
+	lru.Get("3")
+	lru.Get("0")
+	lru.Get("2")
+	lru.Add("4", value, 0, 0)
+	checkEvictOrder(t, lru, "4", "0", "3")
+	if settings := lru.Settings(); settings["eviction_policy"] != "clock" {
+		t.Errorf("expected eviction policy (clock) but received (%s)\n", settings["eviction_policy"])
+	}
+
+	// an expired entry is still removed by a get
+	lru.Add("5", value, 0, -1)
+	if _, _, _, err := lru.Get("5"); err != ErrCacheMiss {
+		t.Errorf("GET for key (5) expected err (%s) but received (%v)\n", ErrCacheMiss, err)
+	}
+	checkEvictOrder(t, lru, "4", "0")
+}
+
+func TestLRUClockConcurrentGets(t *testing.T) {
+	lru := NewLRU(1024*1024, 4)
+	lru.EnableClockEviction()
+	lru.SetSizeAwarePlacement(8)
+	for i := 0; i < 100; i++ {
+		lru.Add(strconv.Itoa(i), []byte("wombat"), 0, 0)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := strconv.Itoa((i + j) % 100)
+				if j%10 == 0 {
+					lru.Add(key, []byte("wombat"), 0, 0)
+					continue
+				}
+				if value, _, _, err := lru.Get(key); err != nil || string(value) != "wombat" {
+					t.Errorf("GET for key (%s) expected (wombat) but received (%s) with err: %v\n", key, value, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if discrepancies := lru.Verify(); discrepancies != nil {
+		t.Errorf("expected no discrepancy but received (%v)\n", discrepancies)
+	}
+}
+
+// fifoPolicy evicts entries in the order they were inserted, ignoring accesses
+type fifoPolicy struct {
+	evictList *list.List
+	accesses  int
+}
+
+func (p *fifoPolicy) RecordInsert(e *list.Element) {}
+
+func (p *fifoPolicy) RecordAccess(e *list.Element) { p.accesses++ }
+
+func (p *fifoPolicy) Victim() *list.Element { return p.evictList.Back() }
+
+func TestLRUEvictionPolicy(t *testing.T) {
+	lru := newOrderedLRU(30)
+	var policy *fifoPolicy
+	lru.SetEvictionPolicy(func(evictList *list.List) EvictionPolicy {
+		policy = &fifoPolicy{evictList: evictList}
+		return policy
+	})
+	value := []byte("123456789")
+
+	lru.Add("0", value, 0, 0)
+	lru.Add("1", value, 0, 0)
+	lru.Add("2", value, 0, 0)
+	// accesses don't save the oldest entry from eviction
+	lru.Get("0")
+	lru.Add("3", value, 0, 0)
+	checkEvictOrder(t, lru, "3", "2", "1")
+	if policy.accesses != 1 {
+		t.Errorf("expected (1) access recorded but received (%d)\n", policy.accesses)
+	}
+	if settings := lru.Settings(); settings["eviction_policy"] != "custom" {
+		t.Errorf("expected eviction policy (custom) but received (%s)\n", settings["eviction_policy"])
+	}
+
+	// the policy keeps working after the cache is cleared
+	lru.Clear()
+	for _, key := range []string{"4", "5", "6", "7"} {
+		lru.Add(key, value, 0, 0)
+	}
+	checkEvictOrder(t, lru, "7", "6", "5")
+}
+
+func TestLRUVolatileEviction(t *testing.T) {
+	lru := newOrderedLRU(30)
+	lru.SetVolatileEviction(true)
+	value := []byte("123456789")
+
+	// the least recent entry with an expiration time goes first
+	lru.Add("p", value, 0, 0)
+	lru.Add("0", value, 0, 3600)
+	lru.Add("1", value, 0, 3600)
+	lru.Add("2", value, 0, 3600)
+	checkEvictOrder(t, lru, "2", "1", "p")
+	if settings := lru.Settings(); settings["eviction_scope"] != "volatile" {
+		t.Errorf("expected eviction scope (volatile) but received (%s)\n", settings["eviction_scope"])
+	}
+
+	// without one, entries without an expiration time are evicted anyway,
+	// but never the one just written
+	before := StatsEvictedWithoutTTL.Value()
+	lru.Add("3", value, 0, 0)
+	lru.Add("4", value, 0, 0)
+	lru.Add("5", value, 0, 3600)
+	checkEvictOrder(t, lru, "5", "4", "3")
+	if evicted := StatsEvictedWithoutTTL.Value() - before; evicted != 1 {
+		t.Errorf("expected (1) entry evicted without an expiration time but received (%d)\n", evicted)
+	}
+}
+
+func TestLRUEvictAnomaly(t *testing.T) {
+	lru := NewLRU(30, 1)
+	before := StatsEvictAnomaly.Value()
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	lru.Add("k2", []byte("wombat"), 0, 0)
+	if anomalies := StatsEvictAnomaly.Value() - before; anomalies != 0 {
+		t.Errorf("expected no eviction anomaly but received (%d)\n", anomalies)
+	}
+
+	// a size overcounted relative to the entries stored
+	lru.buckets[0].size += 100
+	lru.Add("k3", []byte("wombat"), 0, 0)
+	if anomalies := StatsEvictAnomaly.Value() - before; anomalies != 1 {
+		t.Errorf("expected (1) eviction anomaly but received (%d)\n", anomalies)
+	}
+}
+
+func TestLRUVerify(t *testing.T) {
+	lru := NewLRU(1024*1024, 4)
+	for i := 0; i < 100; i++ {
+		lru.Add(fmt.Sprintf("k%d", i), []byte("wombat"), 0, 0)
+	}
+	lru.Delete("k1")
+	// an update changing the length of the value
+	lru.Add("n", []byte("9"), 0, 0)
+	lru.Incr("n", 1, true, 0)
+	if discrepancies := lru.Verify(); discrepancies != nil {
+		t.Errorf("expected no discrepancy but received (%v)\n", discrepancies)
+	}
+
+	lru.buckets[2].size += 100
+	discrepancies := lru.Verify()
+	if len(discrepancies) != 1 {
+		t.Fatalf("expected (1) discrepancy but received (%v)\n", discrepancies)
+	}
+	d := discrepancies[0]
+	if d.Bucket != 2 || d.Size != d.Actual+100 || d.Entries != d.Listed {
+		t.Errorf("expected bucket (2) overcounted by (100) bytes but received (%+v)\n", d)
+	}
+}
+
+func TestLRUSkipIdenticalSets(t *testing.T) {
+	lru := newOrderedLRU(1024)
+	lru.SetChunkSize(4)
+	lru.SkipIdenticalSets()
+	key := "k1"
+
+	cas, _ := lru.Add(key, []byte("wombat"), 1, 0)
+	lru.Add("k2", []byte("wombat"), 1, 0)
+
+	// identical: same cas token, but refreshed and with the new expiration time
+	if newCas, _ := lru.Add(key, []byte("wombat"), 1, 60); newCas != cas {
+		t.Errorf("ADD for key (%s) expected unchanged cas (%d) but received (%d)\n", key, cas, newCas)
+	}
+	checkEvictOrder(t, lru, key, "k2")
+	e := lru.buckets[0].elements[key].Value.(*entry)
+	if e.expiresAt == 0 {
+		t.Errorf("ADD for key (%s) expected the expiration time to be refreshed\n", key)
+	}
+
+	// a different value or flags is a regular update
+	for _, test := range []struct {
+		value string
+		flags uint32
+	}{{"wombaz", 1}, {"wombaz", 2}, {"womba", 2}} {
+		newCas, _ := lru.Add(key, []byte(test.value), test.flags, 0)
+		if newCas == cas {
+			t.Errorf("ADD for key (%s) of (%s) with flags (%d) expected a new cas token\n", key, test.value, test.flags)
+		}
+		value, flags, _, _ := lru.Get(key)
+		if string(value) != test.value || flags != test.flags {
+			t.Errorf("GET for key (%s) expected (%s) with flags (%d) but received (%s) with flags (%d)\n", key, test.value, test.flags, value, flags)
+		}
+		cas = newCas
+	}
+}
+
+// fillBimodal stores many small values and a few large ones, without
+// evicting, and returns the size of the fullest bucket over the mean size
+func fillBimodal(lru *LRU) float64 {
+	small := []byte(strings.Repeat("s", 20))
+	large := []byte(strings.Repeat("l", 4000))
+	for i := 0; i < 20000; i++ {
+		value := small
+		if i%20 == 0 {
+			value = large
+		}
+		lru.Add(fmt.Sprintf("k%05d", i), value, 0, 0)
+	}
+	var max, total uint64
+	for _, bucket := range lru.buckets {
+		total += bucket.size
+		if bucket.size > max {
+			max = bucket.size
+		}
+	}
+	return float64(max) / (float64(total) / float64(lru.numBuckets))
+}
+
+func TestLRUSizeAwarePlacement(t *testing.T) {
+	newLRU := func() *LRU {
+		lru := NewLRU(1<<30, 16)
+		lru.SetHashSeed(1)
+		return lru
+	}
+
+	plain := fillBimodal(newLRU())
+	lru := newLRU()
+	lru.SetSizeAwarePlacement(512)
+	spread := fillBimodal(lru)
+	t.Logf("fullest bucket over mean: (%.4f) plain, (%.4f) size-aware\n", plain, spread)
+	if spread >= plain {
+		t.Errorf("expected size-aware placement to be less skewed than (%.4f) but got (%.4f)\n", plain, spread)
+	}
+
+	// every entry is found wherever it was placed
+	for i := 0; i < 20000; i++ {
+		if _, _, _, err := lru.Get(fmt.Sprintf("k%05d", i)); err != nil {
+			t.Fatalf("failed to get (k%05d): %v\n", i, err)
+		}
+	}
+
+	// a large value in its alternate bucket is replaced, not duplicated, by a small one
+	large := []byte(strings.Repeat("l", 4000))
+	moved := ""
+	for i := 0; i < 20000 && moved == ""; i += 20 {
+		key := fmt.Sprintf("k%05d", i)
+		kl := lru.lockKey(key, &lockWaitGet)
+		if kl.bucketOf(key) != kl.home {
+			moved = key
+		}
+		kl.unlock()
+	}
+	if moved == "" {
+		t.Fatalf("expected a large value to be stored in its alternate bucket\n")
+	}
+	numEntries := func() int {
+		n := 0
+		for _, bucket := range lru.buckets {
+			n += len(bucket.elements)
+		}
+		return n
+	}
+	before := numEntries()
+	if _, err := lru.Add(moved, []byte("1"), 0, 0); err != nil {
+		t.Fatalf("failed to add (%s): %v\n", moved, err)
+	}
+	if numEntries() != before {
+		t.Errorf("expected (%d) entries after overwriting (%s) but got (%d)\n", before, moved, numEntries())
+	}
+	if value, _, err := lru.Incr(moved, 1, true, 0); err != nil || value != 2 {
+		t.Errorf("expected to incr (%s) to 2 but got (%d): %v\n", moved, value, err)
+	}
+	if _, err := lru.Add(moved, large, 0, 0); err != nil {
+		t.Fatalf("failed to add (%s): %v\n", moved, err)
+	}
+	if err := lru.Delete(moved); err != nil {
+		t.Errorf("failed to delete (%s): %v\n", moved, err)
+	}
+	if _, _, _, err := lru.Get(moved); err != ErrCacheMiss {
+		t.Errorf("expected a miss for deleted (%s) but got: %v\n", moved, err)
+	}
+	if numEntries() != before-1 {
+		t.Errorf("expected (%d) entries after deleting (%s) but got (%d)\n", before-1, moved, numEntries())
+	}
+}
+
+func TestLRUEvict(t *testing.T) {
+	lru := newOrderedLRU(1024)
+	value := []byte("123456789")
+	for i := 0; i < 5; i++ {
+		lru.Add(strconv.Itoa(i), value, 0, 0)
+	}
+
+	// evicts whole entries, in eviction order
+	if evicted := lru.Evict(15); evicted != 20 {
+		t.Errorf("Evict expected (20) bytes evicted but received (%d)\n", evicted)
+	}
+	checkEvictOrder(t, lru, "4", "3", "2")
+
+	if evicted := lru.Evict(1024); evicted != 30 {
+		t.Errorf("Evict expected (30) bytes evicted but received (%d)\n", evicted)
+	}
+	checkEvictOrder(t, lru)
+}
+
+func TestLRUMaxEntriesPerBucket(t *testing.T) {
+	lru := newOrderedLRU(1024 * 1024)
+	lru.SetMaxEntriesPerBucket(3)
+	value := []byte("x")
+
+	for i := 0; i < 5; i++ {
+		lru.Add(strconv.Itoa(i), value, 0, 0)
+	}
+	// well under the byte capacity, but only the 3 most recent entries are kept
+	checkEvictOrder(t, lru, "4", "3", "2")
+
+	// updates don't add entries
+	lru.Add("2", value, 0, 0)
+	checkEvictOrder(t, lru, "2", "4", "3")
+
+	// lowering the limit evicts right away
+	lru.SetMaxEntriesPerBucket(1)
+	checkEvictOrder(t, lru, "2")
+}
+
+func TestLRUSoftCapacity(t *testing.T) {
+	lru := newOrderedLRU(100)
+	lru.SetSoftCapacity(0.5)
+	value := []byte("123456789")
+
+	for i := 0; i < 5; i++ {
+		lru.Add(strconv.Itoa(i), value, 0, 0)
+	}
+	lru.Add("5", value, 0, 0)
+	lru.Add("6", value, 0, 0)
+	checkEvictOrder(t, lru, "6", "5", "4", "3", "2")
+
+	// past the soft capacity a write only evicts a couple of entries
+	lru.Add("7", []byte(strings.Repeat("x", 29)), 0, 0)
+	checkEvictOrder(t, lru, "7", "6", "5", "4")
+
+	// the hard capacity is never exceeded
+	big := []byte(strings.Repeat("x", 80))
+	if _, err := lru.Add("8", big, 0, 0); err != nil {
+		t.Errorf("ADD for key (8) received unexpected err: %s\n", err)
+	}
+	checkEvictOrder(t, lru, "8")
+
+	// and larger entries are rejected, leaving the cache untouched
+	big = append(big, "xxxxxxxxxxxxxxxxxxxx"...)
+	if _, err := lru.Add("9", big, 0, 0); err != ErrOutOfMemory {
+		t.Errorf("ADD for key (9) expected err (%s) but received (%v)\n", ErrOutOfMemory, err)
+	}
+	checkEvictOrder(t, lru, "8")
+}
+
+func TestLockWaitPercentiles(t *testing.T) {
+	var h lockWaitHistogram
+	if p := h.percentile(50); p != 0 {
+		t.Errorf("percentile of an empty histogram expected (0) but received (%s)\n", p)
+	}
+	for i := 0; i < 90; i++ {
+		h.record(100 * time.Nanosecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.record(10 * time.Microsecond)
+	}
+	// reported as the upper bound of their power of two range
+	if p := h.percentile(50); p != 127*time.Nanosecond {
+		t.Errorf("p50 expected (127ns) but received (%s)\n", p)
+	}
+	if p := h.percentile(90); p != 127*time.Nanosecond {
+		t.Errorf("p90 expected (127ns) but received (%s)\n", p)
+	}
+	if p := h.percentile(99); p != 16383*time.Nanosecond {
+		t.Errorf("p99 expected (16.383µs) but received (%s)\n", p)
+	}
+}
+
+func TestLRUDeleteReturning(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	key := "k1"
+
+	cas, _ := lru.Add(key, []byte("wombat"), 13, 0)
+	item, err := lru.DeleteReturning(key)
+	if err != nil || string(item.Value) != "wombat" || item.Flags != 13 || item.Cas != cas {
+		t.Errorf("DeleteReturning for key (%s) expected (wombat) with cas (%d) but received (%+v) and err (%v)\n", key, cas, item, err)
+	}
+	if _, err := lru.DeleteReturning(key); err != ErrCacheMiss {
+		t.Errorf("DeleteReturning for key (%s) expected err (%s) but received (%v)\n", key, ErrCacheMiss, err)
+	}
+	if lru.buckets[0].size != 0 {
+		t.Errorf("expected an empty bucket but size is (%d)\n", lru.buckets[0].size)
+	}
+}
+
+func TestLRUAccessTracking(t *testing.T) {
+	lru := NewLRU(1024, 1)
+	key := "k1"
+
+	// untracked entries only report whether they were fetched
+	lru.Add(key, []byte("wombat"), 0, 0)
+	item, err := lru.GetStale(key)
+	if err != nil || item.Tracked || item.Fetched {
+		t.Errorf("GetStale for key (%s) expected an untracked unfetched item but received (%+v) with err: %v\n", key, item, err)
+	}
+	if item, _ = lru.GetStale(key); !item.Fetched {
+		t.Errorf("GetStale for key (%s) expected a fetched item but received (%+v)\n", key, item)
+	}
+
+	lru.EnableAccessTracking()
+	lru.Add("k2", []byte("wombat"), 0, 0)
+	now := time.Now().Unix()
+	for i := uint64(0); i < 3; i++ {
+		item, err = lru.GetStale("k2")
+		if err != nil || !item.Tracked || item.Accesses != i || item.LastAccess < now-1 || item.LastAccess > now+1 {
+			t.Errorf("GetStale for key (k2) expected (%d) prior accesses at (%d) but received (%+v) with err: %v\n", i, now, item, err)
+		}
+	}
+	lru.Get("k2")
+	if item, _ = lru.GetStale("k2"); item.Accesses != 4 {
+		t.Errorf("GetStale for key (k2) expected (4) prior accesses but received (%d)\n", item.Accesses)
+	}
+}
+
+func TestLRUTake(t *testing.T) {
+	lru := NewLRU(1024*1024, 16)
+	key := "job1"
+
+	cas, _ := lru.Add(key, []byte("wombat"), 13, 0)
+	value, flags, takenCas, err := lru.Take(key)
+	if err != nil || string(value) != "wombat" || flags != 13 || takenCas != cas {
+		t.Errorf("Take for key (%s) expected (wombat) with cas (%d) but received (%s) (%d) (%d) and err (%v)\n", key, cas, value, flags, takenCas, err)
+	}
+	if _, _, _, err := lru.Take(key); err != ErrCacheMiss {
+		t.Errorf("Take for key (%s) expected err (%s) but received (%v)\n", key, ErrCacheMiss, err)
+	}
+
+	// an expired entry is removed but never taken, even within the stale grace
+	lru.SetStaleGrace(time.Minute)
+	lru.Add(key, []byte("wombat"), 0, -1)
+	if _, _, _, err := lru.Take(key); err != ErrCacheMiss {
+		t.Errorf("Take for key (%s) expected err (%s) but received (%v)\n", key, ErrCacheMiss, err)
+	}
+	if _, err := lru.GetStale(key); err != ErrCacheMiss {
+		t.Errorf("GetStale for key (%s) expected err (%s) but received (%v)\n", key, ErrCacheMiss, err)
+	}
+
+	// only one of many concurrent callers takes the entry
+	lru.Add(key, []byte("wombat"), 0, 0)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := lru.Take(key); err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 1 {
+		t.Errorf("expected exactly one Take to succeed but (%d) did\n", taken)
+	}
+}
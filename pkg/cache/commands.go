@@ -0,0 +1,110 @@
+package cache
+
+// Commands implements the semantics of the memcache commands on top of a
+// Cache, so applications embedding the cache in-process behave exactly like
+// clients of the server (which uses Commands to apply every command).
+//
+//	c := cache.NewCommands(cache.NewLRU(64*1024*1024, 16))
+//	c.Set("k1", []byte("wombat"), 0, 60)
+//	item, err := c.Get("k1")
+type Commands struct {
+	cache Cache
+}
+
+// NewCommands returns the commands for the cache.
+func NewCommands(cache Cache) Commands {
+	return Commands{cache: cache}
+}
+
+// Set stores the value for the key (ie: `set`), returning its new cas token.
+// Returns ErrOutOfMemory if the value is too large to be stored.
+func (c Commands) Set(key string, value []byte, flags uint32, expTime int32) (uint64, error) {
+	return c.cache.Add(key, value, flags, expTime)
+}
+
+// Get returns the item for the key (ie: `gets`).
+// Returns ErrCacheMiss if the key is not found.
+func (c Commands) Get(key string) (Item, error) {
+	value, flags, cas, err := c.cache.Get(key)
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{Key: key, Value: value, Flags: flags, Cas: cas}, nil
+}
+
+// GetStale returns the item for the key like Get, but also returns an expired
+// item within its stale grace period if the cache supports it (ie: `mg`, see
+// StaleGetter).
+func (c Commands) GetStale(key string) (Item, error) {
+	if staleGetter, ok := c.cache.(StaleGetter); ok {
+		return staleGetter.GetStale(key)
+	}
+	return c.Get(key)
+}
+
+// GetOrCompute returns the item for the key, storing the value returned by
+// 'compute' if it is missing. If the cache supports it (see Computer), only
+// one of the callers in the process missing the key at once calls 'compute',
+// the others returning the item it stored. It has no equivalent command, as
+// clients over the network can't be coordinated.
+func (c Commands) GetOrCompute(key string, compute func() (value []byte, flags uint32, expTime int32)) (Item, error) {
+	if computer, ok := c.cache.(Computer); ok {
+		return computer.GetOrCompute(key, compute)
+	}
+	item, err := c.Get(key)
+	if err != ErrCacheMiss {
+		return item, err
+	}
+	value, flags, expTime := compute()
+	cas, err := c.Set(key, value, flags, expTime)
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{Key: key, Value: value, Flags: flags, Cas: cas}, nil
+}
+
+// Cas stores the value for the key only if its cas token still matches 'cas'
+// (ie: `cas`), returning the new cas token.
+// Returns ErrCacheMiss if the key is not found or ErrCasConflict if it has
+// been modified since 'cas' was retrieved.
+//
+// If the cache supports it (see MultiCaser), the token is checked and the
+// value swapped in a single operation, so of several callers holding the
+// same token only one succeeds. Otherwise this falls back to a Get then an
+// Add, between which another caller can store the key (and have its value
+// overwritten), and the Get counts as a read of the key.
+func (c Commands) Cas(key string, value []byte, flags uint32, expTime int32, cas uint64) (uint64, error) {
+	if caser, ok := c.cache.(MultiCaser); ok {
+		tokens, err := caser.CasMulti([]CasItem{{Key: key, Value: value, Flags: flags, ExpTime: expTime, Cas: cas}})
+		if err != nil {
+			return 0, err
+		}
+		return tokens[0], nil
+	}
+	_, _, entryCas, err := c.cache.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if cas != entryCas {
+		return 0, ErrCasConflict
+	}
+	return c.cache.Add(key, value, flags, expTime)
+}
+
+// Delete removes the key (ie: `delete`).
+// Returns ErrCacheMiss if the key is not found.
+func (c Commands) Delete(key string) error {
+	return c.cache.Delete(key)
+}
+
+// Incr adds 'delta' to the decimal value of the key (ie: `incr`), returning
+// the new value and cas token.
+func (c Commands) Incr(key string, delta uint64) (uint64, uint64, error) {
+	return c.cache.Incr(key, delta, true, 0)
+}
+
+// Decr subtracts 'delta' from the decimal value of the key, stopping at 0
+// (ie: `decr`), returning the new value and cas token.
+func (c Commands) Decr(key string, delta uint64) (uint64, uint64, error) {
+	return c.cache.Incr(key, delta, false, 0)
+}
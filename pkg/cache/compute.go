@@ -0,0 +1,80 @@
+package cache
+
+import "sync"
+
+// flight is a single computation of a missing key, waited on by every
+// other caller missing the same key meanwhile
+type flight struct {
+	done chan struct{}
+	item Item
+	err  error
+}
+
+// flightGroup holds the computations in progress (see GetOrCompute)
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// join returns the computation in progress for the key, or starts a new one
+// returning true if the caller is to compute it
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{}), err: ErrCacheMiss}
+	g.flights[key] = f
+	return f, true
+}
+
+// land ends the computation, releasing the callers waiting on it
+func (g *flightGroup) land(key string, f *flight) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// GetOrCompute returns the item for the key, calling 'compute' to store it
+// if it is missing (ie: a read-through cache in front of a backing store).
+//
+// However many callers miss the same key at once, only one of them calls
+// 'compute' while the others wait for (and return) the item it stored, so a
+// popular key missing from the cache is only loaded once from the backing
+// store. If 'compute' panics, the callers waiting on it return ErrCacheMiss.
+//
+// This only applies to callers in the same process: clients of the server
+// getting and setting the key over the network aren't coordinated.
+func (lru *LRU) GetOrCompute(key string, compute func() (value []byte, flags uint32, expTime int32)) (Item, error) {
+	if value, flags, cas, err := lru.Get(key); err != ErrCacheMiss {
+		return Item{Key: key, Value: value, Flags: flags, Cas: cas}, err
+	}
+
+	f, computing := lru.flights.join(key)
+	if !computing {
+		<-f.done
+		return f.item, f.err
+	}
+	defer lru.flights.land(key, f)
+
+	// stored by a computation that landed since the miss
+	if value, flags, cas, err := lru.Get(key); err != ErrCacheMiss {
+		f.item, f.err = Item{Key: key, Value: value, Flags: flags, Cas: cas}, err
+		return f.item, f.err
+	}
+	value, flags, expTime := compute()
+	cas, err := lru.Add(key, value, flags, expTime)
+	if err != nil {
+		f.item, f.err = Item{}, err
+	} else {
+		f.item, f.err = Item{Key: key, Value: value, Flags: flags, Cas: cas}, nil
+	}
+	return f.item, f.err
+}
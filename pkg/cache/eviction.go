@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy decides which entry of a bucket is evicted next.
+//
+// Each bucket has its own policy (see SetEvictionPolicy), and every method is
+// called with the bucket's lock held, so a policy needs no locking of its own.
+// Entries are identified by their element in the bucket's evict list: a new
+// entry is pushed to the front of the list before RecordInsert is called, and
+// the bucket removes elements itself (on delete, expiration or eviction). A
+// policy may reorder the list (ie: move an accessed element to the front) but
+// must not add or remove elements. Passing elements around rather than keys
+// means the hot path does neither a map lookup nor an allocation.
+type EvictionPolicy interface {
+	// RecordInsert is called after a new entry 'e' is stored
+	RecordInsert(e *list.Element)
+	// RecordAccess is called after the entry 'e' is read or updated
+	RecordAccess(e *list.Element)
+	// Victim returns the entry to evict next, or nil if there is none
+	Victim() *list.Element
+}
+
+// ReadLockedPolicy is implemented by eviction policies whose RecordAccess is
+// safe to call concurrently with the bucket's lock only held for reading
+// (ie: setting an atomic bit rather than reordering the evict list). With
+// such a policy, Get holds the bucket's lock for reading, so gets of the
+// same bucket no longer wait on each other. RecordInsert and Victim are
+// still called with the lock held for writing.
+type ReadLockedPolicy interface {
+	EvictionPolicy
+	ReadLocked()
+}
+
+// SetEvictionPolicy replaces the eviction policy of every bucket with one
+// returned by 'newPolicy', which is called once per bucket with that bucket's
+// evict list. The default is to evict the least recently used entry.
+// This should be called before the LRU is used, as the order of existing
+// entries is kept as is.
+func (lru *LRU) SetEvictionPolicy(newPolicy func(evictList *list.List) EvictionPolicy) {
+	readLocked := true
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.policy = newPolicy(bucket.evictList)
+		if _, ok := bucket.policy.(ReadLockedPolicy); !ok {
+			readLocked = false
+		}
+		bucket.Unlock()
+	}
+	lru.setReadLockedGets(readLocked)
+}
+
+// EnableClockEviction evicts entries with the CLOCK algorithm, an
+// approximation of LRU: a get only marks its entry as referenced, and
+// eviction sweeps the evict list from its back (the oldest entry), giving
+// every referenced entry a second chance (clearing its mark and moving it to
+// the front) until it finds one that isn't. As gets don't reorder the evict
+// list, they hold the bucket's lock for reading (see ReadLockedPolicy). This
+// should be called before the LRU is used.
+func (lru *LRU) EnableClockEviction() {
+	lru.SetEvictionPolicy(func(evictList *list.List) EvictionPolicy {
+		return &clockPolicy{evictList: evictList}
+	})
+}
+
+// setReadLockedGets makes Get hold the lock of buckets for reading if
+// 'readLocked' (see ReadLockedPolicy)
+func (lru *LRU) setReadLockedGets(readLocked bool) {
+	var v uint32
+	if readLocked {
+		v = 1
+	}
+	atomic.StoreUint32(&lru.readLockedGets, v)
+}
+
+// number of entries looked at, from the back of the evict list, for one
+// with an expiration time (see SetVolatileEviction)
+const volatileEvictionSamples = 16
+
+// SetVolatileEviction makes eviction prefer entries with an expiration time
+// (ie: Redis' volatile-lru), protecting entries stored without one (ie:
+// semi-permanent configuration) from being pushed out by ephemeral ones.
+// When the policy's victim has no expiration time, the least recent of the
+// last few entries (16) of the evict list that has one is evicted instead.
+// If there is none, the victim is evicted anyway (counted in
+// StatsEvictedWithoutTTL), so a bucket never stays over capacity.
+func (lru *LRU) SetVolatileEviction(volatile bool) {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.volatileEviction = volatile
+		bucket.Unlock()
+	}
+}
+
+// victim returns the element to evict next, or nil if there is none
+func (bucket *Bucket) victim() *list.Element {
+	victim := bucket.policy.Victim()
+	if !bucket.volatileEviction || victim == nil || victim.Value.(*entry).expiresAt != 0 {
+		return victim
+	}
+	// never the newest element (ie: the one just written)
+	newest := bucket.evictList.Front()
+	e := bucket.evictList.Back()
+	for i := 0; e != nil && e != newest && i < volatileEvictionSamples; i++ {
+		if e.Value.(*entry).expiresAt != 0 {
+			return e
+		}
+		e = e.Prev()
+	}
+	StatsEvictedWithoutTTL.Add(1)
+	return victim
+}
+
+// policyName returns the name of the bucket's eviction policy for Settings
+func (bucket *Bucket) policyName() string {
+	switch bucket.policy.(type) {
+	case *lruPolicy:
+		return "lru"
+	case *randomPolicy:
+		return "random"
+	case *clockPolicy:
+		return "clock"
+	default:
+		return "custom"
+	}
+}
+
+// lruPolicy evicts the least recently used entry, keeping the evict list
+// ordered from most to least recently used.
+type lruPolicy struct {
+	evictList *list.List
+}
+
+func newLRUPolicy(evictList *list.List) EvictionPolicy {
+	return &lruPolicy{evictList: evictList}
+}
+
+func (p *lruPolicy) RecordInsert(e *list.Element) {}
+
+func (p *lruPolicy) RecordAccess(e *list.Element) {
+	p.evictList.MoveToFront(e)
+}
+
+func (p *lruPolicy) Victim() *list.Element {
+	return p.evictList.Back()
+}
+
+// clockPolicy evicts the oldest entry not referenced since the eviction sweep
+// last passed it (see EnableClockEviction). The evict list is the clock: its
+// back is the hand, and passing a referenced entry moves it to the front.
+type clockPolicy struct {
+	evictList *list.List
+}
+
+func (p *clockPolicy) RecordInsert(e *list.Element) {}
+
+// RecordAccess marks the entry as referenced. The mark is only written if it
+// isn't set yet, so gets of a hot entry don't keep writing the same memory.
+func (p *clockPolicy) RecordAccess(e *list.Element) {
+	en := e.Value.(*entry)
+	if atomic.LoadUint32(&en.referenced) == 0 {
+		atomic.StoreUint32(&en.referenced, 1)
+	}
+}
+
+// Victim sweeps the evict list from the back, clearing the mark of entries
+// referenced and moving them to the front, until it reaches one that isn't
+// referenced. The most recently added element (ie: the one just written) is
+// passed over like a referenced one, so it is only returned if it is the last
+// one left. Accesses can't mark entries during the sweep (the bucket is
+// locked for writing), so it takes at most one pass over the list.
+func (p *clockPolicy) Victim() *list.Element {
+	if p.evictList.Len() == 0 {
+		return nil
+	}
+	newest := p.evictList.Front()
+	for i := 0; i <= p.evictList.Len(); i++ {
+		e := p.evictList.Back()
+		en := e.Value.(*entry)
+		if e != newest && atomic.LoadUint32(&en.referenced) == 0 {
+			return e
+		}
+		atomic.StoreUint32(&en.referenced, 0)
+		p.evictList.MoveToFront(e)
+	}
+	return p.evictList.Back()
+}
+
+func (p *clockPolicy) ReadLocked() {}
+
+// number of entries sampled to find an expired entry to evict
+const randomEvictionSamples = 5
+
+// randomPolicy evicts a random entry (see EnableRandomEviction). Accesses
+// don't reorder the evict list, so it stays in insertion order.
+type randomPolicy struct {
+	// entries are sampled from the bucket's map
+	bucket *Bucket
+}
+
+func (p *randomPolicy) RecordInsert(e *list.Element) {}
+
+func (p *randomPolicy) RecordAccess(e *list.Element) {}
+
+func (p *randomPolicy) ReadLocked() {}
+
+// Victim returns an element at random (relying on the randomized iteration
+// order of maps), preferring an expired element among the first few sampled.
+// The most recently added element (ie: the one just written) is only
+// returned if it is the last one left.
+func (p *randomPolicy) Victim() *list.Element {
+	bucket := p.bucket
+	now := time.Now().Unix()
+	newest := bucket.evictList.Front()
+	var victim *list.Element
+	sampled := 0
+	for _, e := range bucket.elements {
+		if e == newest && bucket.evictList.Len() > 1 {
+			continue
+		}
+		if e.Value.(*entry).expired(now) {
+			return e
+		}
+		if victim == nil {
+			victim = e
+		}
+		if sampled++; sampled >= randomEvictionSamples {
+			break
+		}
+	}
+	return victim
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"math/bits"
+	mrand "math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// one in every lockWaitSampleRate bucket lock acquisitions is timed
+	lockWaitSampleRate = 64
+	// number of power of two (nanosecond) ranges in a lock wait histogram
+	lockWaitRanges = 40
+)
+
+// lockWaitHistogram counts sampled bucket lock wait times in power of two
+// ranges (in nanoseconds), which is enough to report approximate percentiles.
+type lockWaitHistogram struct {
+	counts [lockWaitRanges]uint64
+}
+
+// record counts a single lock wait
+func (h *lockWaitHistogram) record(d time.Duration) {
+	i := bits.Len64(uint64(d))
+	if i >= lockWaitRanges {
+		i = lockWaitRanges - 1
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+// percentile returns the upper bound of the range holding the 'p'th
+// percentile (0 < p <= 100) of the recorded lock waits, 0 if none were recorded.
+func (h *lockWaitHistogram) percentile(p float64) time.Duration {
+	var counts [lockWaitRanges]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(float64(total)*p/100 + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	var seen uint64
+	for i, count := range counts {
+		if seen += count; seen >= target {
+			return time.Duration(uint64(1)<<uint(i)) - 1
+		}
+	}
+	return time.Duration(uint64(1)<<uint(lockWaitRanges-1)) - 1
+}
+
+// lockTimed locks the bucket, recording how long it waited for the lock in
+// 'h' for a sample of the acquisitions.
+func (bucket *Bucket) lockTimed(h *lockWaitHistogram) {
+	if mrand.Intn(lockWaitSampleRate) != 0 {
+		bucket.Lock()
+		return
+	}
+	start := time.Now()
+	bucket.Lock()
+	h.record(time.Since(start))
+}
+
+// rlockTimed locks the bucket for reading, like lockTimed
+func (bucket *Bucket) rlockTimed(h *lockWaitHistogram) {
+	if mrand.Intn(lockWaitSampleRate) != 0 {
+		bucket.RLock()
+		return
+	}
+	start := time.Now()
+	bucket.RLock()
+	h.record(time.Since(start))
+}
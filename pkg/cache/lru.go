@@ -1,11 +1,21 @@
 package cache
 
 import (
+	"bytes"
 	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"hash/fnv"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 // This implements a very straight forward LRU using buckets of maps and doubly linked lists.
@@ -18,9 +28,11 @@ import (
 //
 // To keep track of the number of objects instead of bytes, have "entry.size()" always return 1.
 //
+// Entries past their expiration time are removed lazily when they are next accessed.
+//
 // Doesn't handle pre-allocation of memory.
 type LRU struct {
-	// approximate maximum number of bytes to be stored (never changes)
+	// approximate maximum number of bytes to be stored (see Resize)
 	capacity uint64
 
 	// number of buckets to hash across
@@ -34,102 +46,632 @@ type LRU struct {
 
 	// unique token counter for inserts and updates
 	casToken uint64
+
+	// FNV-1a offset basis mixed with a random seed so bucket assignment
+	// can't be predicted (see SetHashSeed)
+	hashBasis uint32
+
+	// entries of at least this many bytes may be stored in an alternate
+	// bucket (see SetSizeAwarePlacement), 0 disables
+	sizeAwareThreshold int
+
+	// invalidations of the tags of entries (see InvalidateTag)
+	tags *tagTable
+
+	// computations of missing keys in progress (see GetOrCompute)
+	flights *flightGroup
+
+	// 1 if Get holds the lock of buckets for reading, as their eviction
+	// policy allows it (see ReadLockedPolicy)
+	readLockedGets uint32
 }
 
 // Bucket implements a simple hash and LRU using a doubly linked list.
 // The `capacity` parameter is the approximate maximum number of bytes that can be
 // stored until eviction occurs.
 type Bucket struct {
-	// approximate maximum number of bytes to be stored (never changes)
+	// approximate maximum number of bytes to be stored
 	capacity uint64
 
 	// current number of bytes stored
 	size uint64
 
+	// bytes of 'size' that are keys and tags, the rest are values (see
+	// MemoryBreakdown)
+	keyBytes uint64
+	tagBytes uint64
+
 	// table of entries stored (k: key of entry)
 	elements map[string]*list.Element
 
 	// doubly linked list for entries to be evicted
 	evictList *list.List
 
+	// store and verify a checksum of each entry's value
+	checksums bool
+
+	// unix time (in seconds) until which eviction prefers expired entries
+	warmupUntil int64
+
+	// number of seconds an expired entry can still be served as stale
+	staleGrace int64
+
+	// values larger than this are stored as chunks of this size (0 disables)
+	chunkSize int
+
+	// decides which entry is evicted next (see SetEvictionPolicy)
+	policy EvictionPolicy
+
+	// eviction prefers entries with an expiration time (see SetVolatileEviction)
+	volatileEviction bool
+
+	// fraction of 'capacity' above which entries are gently evicted (see SetSoftCapacity)
+	softFraction float64
+
+	// maximum number of entries stored, regardless of their size (0 is unlimited)
+	maxEntries int
+
+	// record the last access time and number of accesses of each entry
+	trackAccess bool
+
+	// a set of an identical value keeps the stored entry (see SkipIdenticalSets)
+	skipIdenticalSets bool
+
+	// called with the key of every evicted entry (see SetEvictHook)
+	evictHook func(key string)
+
+	// invalidations of the tags of entries, shared by every bucket
+	tags *tagTable
+
 	// protects access to:
+	// - capacity
 	// - elements
 	// - evicList
-	// - size
+	// - size, keyBytes, tagBytes
 	sync.RWMutex
 }
 
 // entry holds the information for an entry in the Bucket's map.
 type entry struct {
 	key   string
-	value string
-	flags uint32
-	cas   uint64
+	value []byte
+	// the value split into fixed size chunks instead (see SetChunkSize),
+	// 'value' is nil when set
+	chunks   [][]byte
+	flags    uint32
+	cas      uint64
+	checksum uint32
+	// unix time (in seconds) the entry expires at, 0 means never
+	expiresAt int64
+	// unix time (in seconds) the entry was last stored at
+	storedAt int64
+	// set once the entry has been retrieved by a Get
+	fetched bool
+	// set by gets for the CLOCK policy (see EnableClockEviction), written
+	// atomically as gets may only hold the bucket's lock for reading
+	referenced uint32
+	// set once a caller has been told to refresh this (stale) entry
+	winSent bool
+	// access statistics, only allocated if the bucket tracks accesses
+	access *accessInfo
+	// tags the entry can be invalidated by (see AddTagged)
+	tags []string
+	// number of seconds the entry is served as stale once expired, instead
+	// of its bucket's 'staleGrace' (0 uses the bucket's)
+	grace int64
+}
+
+// accessInfo is the access statistics of an entry (see EnableAccessTracking)
+type accessInfo struct {
+	// unix time (in seconds) of the last access, or of the last store
+	lastAccess int64
+	// number of accesses since the entry was last stored
+	count uint64
 }
 
 // size returns an approximate count of bytes for an entry
 func (e *entry) size() uint64 {
-	return uint64(len(e.key) + len(e.value))
+	return uint64(len(e.key) + e.valueLen() + tagsSize(e.tags))
+}
+
+// valueLen returns the length of the entry's value
+func (e *entry) valueLen() int {
+	if e.chunks == nil {
+		return len(e.value)
+	}
+	n := 0
+	for _, chunk := range e.chunks {
+		n += len(chunk)
+	}
+	return n
+}
+
+// setValue stores 'value' in the entry, copying it into chunks of
+// 'chunkSize' bytes if it is larger than that (and chunkSize isn't 0).
+func (e *entry) setValue(value []byte, chunkSize int) {
+	if chunkSize <= 0 || len(value) <= chunkSize {
+		e.value = value
+		e.chunks = nil
+		return
+	}
+	e.value = nil
+	e.chunks = make([][]byte, 0, (len(value)+chunkSize-1)/chunkSize)
+	for len(value) > 0 {
+		n := chunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		chunk := make([]byte, n)
+		copy(chunk, value)
+		e.chunks = append(e.chunks, chunk)
+		value = value[n:]
+	}
+}
+
+// bytes returns the entry's value, reassembling it if it is chunked
+func (e *entry) bytes() []byte {
+	if e.chunks == nil {
+		return e.value
+	}
+	value := make([]byte, 0, e.valueLen())
+	for _, chunk := range e.chunks {
+		value = append(value, chunk...)
+	}
+	return value
+}
+
+// recordAccess marks the entry as retrieved, updating its access statistics
+// if they are tracked
+func (e *entry) recordAccess() {
+	e.fetched = true
+	if e.access != nil {
+		e.access.lastAccess = time.Now().Unix()
+		e.access.count++
+	}
+}
+
+// equalValue returns true if the entry's value is the same as 'value'
+func (e *entry) equalValue(value []byte) bool {
+	if e.chunks == nil {
+		return bytes.Equal(e.value, value)
+	}
+	if e.valueLen() != len(value) {
+		return false
+	}
+	for _, chunk := range e.chunks {
+		if !bytes.Equal(chunk, value[:len(chunk)]) {
+			return false
+		}
+		value = value[len(chunk):]
+	}
+	return true
+}
+
+// expired returns true if the entry has passed its expiration time
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt != 0 && now >= e.expiresAt
+}
+
+// staleUntil returns the unix time (in seconds) until which the expired
+// entry is still served as stale, given its bucket's 'staleGrace'
+func (e *entry) staleUntil(staleGrace int64) int64 {
+	if e.grace > 0 {
+		return e.expiresAt + e.grace
+	}
+	return e.expiresAt + staleGrace
+}
+
+// verify returns true if the entry's value still matches its stored checksum
+func (e *entry) verify() bool {
+	if e.chunks == nil {
+		return crc32.ChecksumIEEE(e.value) == e.checksum
+	}
+	var checksum uint32
+	for _, chunk := range e.chunks {
+		checksum = crc32.Update(checksum, crc32.IEEETable, chunk)
+	}
+	return checksum == e.checksum
+}
+
+// maximum number of seconds for an expiration time to be considered relative
+// to the current time (30 days), larger values are an absolute unix time
+const maxRelativeExpTime = 60 * 60 * 24 * 30
+
+// ExpiresAt converts a memcached expiration time into an absolute unix time.
+// 0 means never expire, a negative value means already expired.
+func ExpiresAt(expTime int32, now int64) int64 {
+	switch {
+	case expTime == 0:
+		return 0
+	case expTime < 0:
+		return now
+	case expTime <= maxRelativeExpTime:
+		return now + int64(expTime)
+	default:
+		return int64(expTime)
+	}
 }
 
 // NewLRU returns a new LRU object.
 func NewLRU(capacity uint64, numBuckets uint32) *LRU {
+	tags := newTagTable()
 	buckets := make([]*Bucket, numBuckets)
 	for i := uint32(0); i < numBuckets; i++ {
 		b := &Bucket{
 			capacity:  capacity / uint64(numBuckets),
 			elements:  make(map[string]*list.Element),
 			evictList: list.New(),
+			tags:      tags,
 		}
+		b.policy = newLRUPolicy(b.evictList)
 		buckets[i] = b
 	}
-	return &LRU{capacity: capacity, numBuckets: numBuckets, buckets: buckets}
+	lru := &LRU{capacity: capacity, numBuckets: numBuckets, buckets: buckets, tags: tags, flights: newFlightGroup()}
+	lru.SetHashSeed(randomSeed())
+	return lru
+}
+
+// randomSeed returns a random seed for hashing keys
+func randomSeed() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("unable to generate random hash seed: %s\n", err)
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// SetHashSeed changes the seed mixed into the hash of each key.
+// NewLRU uses a random seed so an adversary can't craft keys that all land
+// in the same bucket. Overriding it is intended for deterministic tests and
+// must be done before the LRU is used, as existing entries are not rehashed.
+func (lru *LRU) SetHashSeed(seed uint64) {
+	h := fnv.New32a()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	h.Write(b[:])
+	lru.hashBasis = h.Sum32()
+}
+
+// CasToken returns the last cas token handed out (0 if none has been).
+// Every write takes the next one, so tokens are unique and increasing within
+// an LRU.
+func (lru *LRU) CasToken() uint64 {
+	return atomic.LoadUint64(&lru.casToken)
+}
+
+// SetCasToken moves the cas token counter to 'last', so the next write
+// takes 'last'+1 (ie: for tests asserting exact tokens, or to continue the
+// sequence of a previous LRU whose entries are restored). The counter never
+// moves back: if it's already past 'last' it's left as is, as handing out a
+// token again could let a client's stale token match a newer entry.
+func (lru *LRU) SetCasToken(last uint64) {
+	for {
+		current := atomic.LoadUint64(&lru.casToken)
+		if current >= last || atomic.CompareAndSwapUint64(&lru.casToken, current, last) {
+			return
+		}
+	}
+}
+
+// EnableChecksums turns on storing a CRC32 of each value alongside its entry.
+// The checksum is verified on every Get and a mismatch is treated as a cache miss.
+// This is a debugging aid (off by default given the CPU cost) and should be
+// called before the LRU is used.
+func (lru *LRU) EnableChecksums() {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.checksums = true
+		bucket.Unlock()
+	}
+}
+
+// SetWarmup starts a warmup window of duration 'd' from now. While warming
+// up (ie: right after startup or a restore), a bucket over capacity first
+// removes any expired entries before evicting live entries, so entries that
+// are still filling the cache are not evicted needlessly.
+func (lru *LRU) SetWarmup(d time.Duration) {
+	until := time.Now().Add(d).Unix()
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.warmupUntil = until
+		bucket.Unlock()
+	}
+}
+
+// SetStaleGrace allows expired entries to be served by GetStale (flagged as
+// stale) for duration 'd' after they expire, while a client refreshes them.
+// Get still treats expired entries as a miss. An entry stored with its own
+// grace (see SetOptions.Grace) uses that instead.
+func (lru *LRU) SetStaleGrace(d time.Duration) {
+	grace := int64(d / time.Second)
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.staleGrace = grace
+		bucket.Unlock()
+	}
+}
+
+// SetChunkSize stores values larger than 'size' bytes as a list of chunks of
+// (at most) 'size' bytes instead of a single slice, so large values don't need
+// large contiguous allocations to be kept around. A chunked value is copied
+// into its chunks when stored and reassembled into a new slice by every Get.
+// 0 (the default) disables chunking. This should be called before the LRU is
+// used, existing entries are not re-chunked.
+func (lru *LRU) SetChunkSize(size int) {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.chunkSize = size
+		bucket.Unlock()
+	}
+}
+
+// EnableRandomEviction turns the LRU into a plain cache: accessing an entry no
+// longer moves it to the front of the evict list and a bucket over capacity
+// evicts a random entry (preferring an expired one from a small sample)
+// instead of the least recently used. This is intended for caches where every
+// entry has an expiration time, and removes the cost of maintaining recency
+// from the read path. This should be called before the LRU is used.
+func (lru *LRU) EnableRandomEviction() {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.policy = &randomPolicy{bucket: bucket}
+		bucket.Unlock()
+	}
+	lru.setReadLockedGets(true)
+}
+
+// SetSoftCapacity sets a soft limit on the number of bytes stored, as a
+// 'fraction' of the capacity (which is the hard limit). Past the soft limit,
+// each write evicts only a few entries, so a bucket settles between its soft
+// and hard limits instead of evicting everything over capacity at once. The
+// hard limit is never exceeded, and a single entry larger than a bucket's
+// hard limit is rejected with ErrOutOfMemory. A fraction of 0 or 1 (the
+// default) makes both limits the same.
+func (lru *LRU) SetSoftCapacity(fraction float64) {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.softFraction = fraction
+		bucket.Unlock()
+	}
+}
+
+// SetEvictHook calls 'hook' with the key of every entry evicted from now on
+// (nil removes it). The hook is called with the bucket's lock held, so it
+// must be quick and must not call back into the LRU.
+func (lru *LRU) SetEvictHook(hook func(key string)) {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.evictHook = hook
+		bucket.Unlock()
+	}
+}
+
+// SkipIdenticalSets makes an Add of the value and flags already stored for a
+// key (ie: a client periodically refreshing it) only update the entry's
+// expiration time, recency and time stored (see OldestItemAge): the stored
+// value is kept, so nothing is
+// allocated, and the cas token is NOT changed.
+//
+// This means a client holding the cas token from before such a set can still
+// cas the entry successfully, since its value and flags are unchanged, and a
+// cas token can no longer be used to tell whether the key was written since
+// it was retrieved (only whether it was modified). Off by default.
+// The comparison costs a read of the stored value on every update.
+func (lru *LRU) SkipIdenticalSets() {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.skipIdenticalSets = true
+		bucket.Unlock()
+	}
+}
+
+// EnableAccessTracking records the last access time and number of accesses of
+// every entry added from now on, reported by GetStale (see Item). This helps
+// find entries that are written but rarely read, or read constantly, at the
+// cost of a small allocation per entry and a couple of writes per Get, so it
+// is off by default.
+func (lru *LRU) EnableAccessTracking() {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.trackAccess = true
+		bucket.Unlock()
+	}
+}
+
+// SetMaxEntriesPerBucket limits the number of entries each bucket stores to
+// 'n', evicting entries past it even while the bucket is under its byte
+// capacity. This bounds the size of every bucket's map and evict list (and
+// so the work for the garbage collector) when the cache fills up with many
+// tiny entries, whose per-entry overhead isn't counted against the capacity.
+// 0 (the default) is unlimited.
+func (lru *LRU) SetMaxEntriesPerBucket(n int) {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.maxEntries = n
+		bucket.checkCapacity()
+		bucket.Unlock()
+	}
 }
 
 // Add inserts or updates the element for the specified key.
-func (lru *LRU) Add(key, value string, flags uint32) {
-	bucket := lru.buckets[lru.hash(key)%lru.numBuckets]
-	newCas := lru.getNewCasToken()
+// 'expTime' follows memcached semantics: 0 never expires, up to 30 days is
+// a number of seconds from now, and anything larger is an absolute unix time.
+// Returns the cas token assigned to the element, or ErrOutOfMemory if the
+// element is larger than its bucket's capacity (see SetSoftCapacity).
+func (lru *LRU) Add(key string, value []byte, flags uint32, expTime int32) (uint64, error) {
+	return lru.AddWithOptions(key, value, flags, expTime, SetOptions{})
+}
 
-	bucket.Lock()
-	defer bucket.Unlock()
+// AddWithOptions inserts or updates the element for the specified key like
+// Add, with the tags (see AddTagged) and stale grace of 'opts'. With a grace,
+// the element is served by GetStale for that many seconds once expired
+// (whatever the grace set with SetStaleGrace), so clients pick which keys
+// tolerate staleness and for how long. Incr and CasMulti keep the options of
+// the element, a later Add removes them.
+func (lru *LRU) AddWithOptions(key string, value []byte, flags uint32, expTime int32, opts SetOptions) (uint64, error) {
+	tags := opts.Tags
+	if len(tags) == 0 {
+		tags = nil
+	}
+	grace := int64(0)
+	if opts.Grace > 0 {
+		grace = int64(opts.Grace)
+	}
+
+	kl := lru.lockKey(key, &lockWaitSet)
+	defer kl.unlock()
 
-	if e, ok := bucket.elements[key]; ok {
-		bucket.updateElement(e, value, flags, newCas)
+	size := len(key) + len(value) + tagsSize(tags)
+	bucket := kl.bucketOf(key)
+	target := kl.placement(size, lru.sizeAwareThreshold)
+	if uint64(size) > target.capacity {
+		return 0, ErrOutOfMemory
+	}
+	exp := ExpiresAt(expTime, time.Now().Unix())
+
+	e, ok := bucket.elements[key]
+	if ok && bucket.invalidated(e.Value.(*entry)) {
+		// an invalidated element is never kept, even if identical
+		bucket.deleteElement(e)
+		ok = false
+	}
+	if ok && bucket.skipIdenticalSets && e.Value.(*entry).flags == flags && e.Value.(*entry).equalValue(value) && sameTags(e.Value.(*entry).tags, tags) {
+		// only the expiration time, recency and time stored change (see
+		// SkipIdenticalSets)
+		e.Value.(*entry).expiresAt = exp
+		e.Value.(*entry).storedAt = time.Now().Unix()
+		e.Value.(*entry).grace = grace
+		e.Value.(*entry).winSent = false
+		bucket.refreshElement(e)
+		StatsSetsUnchanged.Add(1)
+		return e.Value.(*entry).cas, nil
+	}
+
+	newCas := lru.getNewCasToken()
+	if ok && bucket != target {
+		// moving to the other bucket of the key (see SetSizeAwarePlacement)
+		bucket.deleteElement(e)
+		ok = false
+	}
+	if ok {
+		bucket.updateElement(e, value, flags, newCas, exp)
 	} else {
-		bucket.addElement(key, value, flags, newCas)
+		e = target.addElement(key, value, flags, newCas, exp)
 	}
-	bucket.checkCapacity()
+	target.setTags(e, tags)
+	e.Value.(*entry).grace = grace
+	target.checkCapacity()
+
+	return newCas, nil
+}
+
+// SetNegative stores a negative cache marker for the specified key (an empty
+// value with NegativeFlag set), recording that the key is known not to exist.
+// 'expTime' should be short so the marker doesn't outlive the key's absence.
+// Returns the cas token assigned to the element.
+func (lru *LRU) SetNegative(key string, expTime int32) (uint64, error) {
+	return lru.Add(key, []byte{}, NegativeFlag, expTime)
 }
 
 // Get retrieves the value and cas token stored in the element
 // for the specified key.
 // Returns error if element is not found.
-func (lru *LRU) Get(key string) (string, uint32, uint64, error) {
-	bucket := lru.buckets[lru.hash(key)%lru.numBuckets]
+//
+// With a ReadLockedPolicy, the bucket is only locked for reading, unless the
+// get has more to change than the entry's recency (see getReadLocked).
+func (lru *LRU) Get(key string) ([]byte, uint32, uint64, error) {
+	if atomic.LoadUint32(&lru.readLockedGets) == 1 {
+		if value, flags, cas, err := lru.getReadLocked(key); err != errWriteLockNeeded {
+			return value, flags, cas, err
+		}
+	}
 
-	bucket.Lock()
-	defer bucket.Unlock()
+	kl := lru.lockKey(key, &lockWaitGet)
+	defer kl.unlock()
+
+	bucket := kl.bucketOf(key)
+
+	e := bucket.lookup(key)
+	if e == nil {
+		return nil, 0, 0, ErrCacheMiss
+	}
+	bucket.refreshElement(e)
+	e.Value.(*entry).recordAccess()
+
+	return e.Value.(*entry).bytes(), e.Value.(*entry).flags, e.Value.(*entry).cas, nil
+}
+
+// returned by getReadLocked for a get that has to lock the bucket for writing
+var errWriteLockNeeded = errors.New("write lock needed")
+
+// getReadLocked is Get holding the bucket(s) of the key for reading. Reading
+// an entry only changes its recency, which the policy records concurrently,
+// except for its first get (which marks it as fetched), with access tracking
+// (which counts the get), and for an entry removed by the get (expired,
+// invalidated or failing its checksum). These return errWriteLockNeeded
+// instead, to be done by Get under the write lock.
+func (lru *LRU) getReadLocked(key string) ([]byte, uint32, uint64, error) {
+	kl := lru.rlockKey(key, &lockWaitGet)
+	defer kl.unlock()
+
+	bucket := kl.bucketOf(key)
 
 	e, ok := bucket.elements[key]
 	if !ok {
-		return "", 0, 0, ErrCacheMiss
+		return nil, 0, 0, ErrCacheMiss
+	}
+	en := e.Value.(*entry)
+	if !en.fetched || en.access != nil || en.expired(time.Now().Unix()) || bucket.invalidated(en) || (bucket.checksums && !en.verify()) {
+		return nil, 0, 0, errWriteLockNeeded
 	}
 	bucket.refreshElement(e)
 
-	return e.Value.(*entry).value, e.Value.(*entry).flags, e.Value.(*entry).cas, nil
+	return en.bytes(), en.flags, en.cas, nil
+}
+
+// GetStale retrieves the item for the specified key like Get, but also
+// returns expired items still within the stale grace period (see
+// SetStaleGrace). Stale items have 'Stale' set, and the first caller to
+// receive a stale item also has 'Win' set (and is expected to refresh it).
+// Returns error if element is not found.
+func (lru *LRU) GetStale(key string) (Item, error) {
+	kl := lru.lockKey(key, &lockWaitGet)
+	defer kl.unlock()
+
+	bucket := kl.bucketOf(key)
+
+	e, stale := bucket.lookupStale(key)
+	if e == nil {
+		return Item{}, ErrCacheMiss
+	}
+	bucket.refreshElement(e)
+	en := e.Value.(*entry)
+
+	item := Item{Key: key, Value: en.bytes(), Flags: en.flags, Cas: en.cas, Stale: stale, Fetched: en.fetched}
+	if en.access != nil {
+		item.Tracked = true
+		item.LastAccess = en.access.lastAccess
+		item.Accesses = en.access.count
+	}
+	en.recordAccess()
+	if stale && !en.winSent {
+		en.winSent = true
+		item.Win = true
+	}
+	return item, nil
 }
 
 // Delete removes the element for the specified key.
 // Returns error if element is not found.
 func (lru *LRU) Delete(key string) error {
-	bucket := lru.buckets[lru.hash(key)%lru.numBuckets]
+	kl := lru.lockKey(key, &lockWaitDelete)
+	defer kl.unlock()
 
-	bucket.Lock()
-	defer bucket.Unlock()
+	bucket := kl.bucketOf(key)
 
-	e, ok := bucket.elements[key]
-	if !ok {
+	e, _ := bucket.lookupStale(key)
+	if e == nil {
 		return ErrCacheMiss
 	}
 	bucket.deleteElement(e)
@@ -137,11 +679,421 @@ func (lru *LRU) Delete(key string) error {
 	return nil
 }
 
-// hash returns the hash of the specified key
+// DeleteReturning removes the element for the specified key like Delete and
+// returns it, atomically (ie: a get and delete without any race in between).
+// An expired element still within the stale grace period is returned with
+// 'Stale' set.
+// Returns error if element is not found.
+func (lru *LRU) DeleteReturning(key string) (Item, error) {
+	kl := lru.lockKey(key, &lockWaitDelete)
+	defer kl.unlock()
+
+	bucket := kl.bucketOf(key)
+
+	e, stale := bucket.lookupStale(key)
+	if e == nil {
+		return Item{}, ErrCacheMiss
+	}
+	en := e.Value.(*entry)
+	item := Item{Key: key, Value: en.bytes(), Flags: en.flags, Cas: en.cas, Stale: stale}
+	bucket.deleteElement(e)
+
+	return item, nil
+}
+
+// Take removes the element for the specified key and returns its value,
+// flags and cas token under a single bucket lock, so at most one caller can
+// take a given element (ie: to pop a job from a work queue keyed by job id).
+// Unlike DeleteReturning, an expired element is never returned (but is still
+// removed).
+// Returns error if element is not found.
+func (lru *LRU) Take(key string) ([]byte, uint32, uint64, error) {
+	item, err := lru.DeleteReturning(key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if item.Stale {
+		return nil, 0, 0, ErrCacheMiss
+	}
+	return item.Value, item.Flags, item.Cas, nil
+}
+
+// Incr increments (or decrements if 'incr' is false) the decimal value stored
+// in the element for the specified key by 'delta', returning the new value and
+// cas token. Incrementing wraps around at 64 bits, decrementing stops at 0.
+// If 'cas' is non-zero, the element is only updated if its cas token matches.
+// Returns error if element is not found, the cas token does not match, or the
+// value is not a number.
+func (lru *LRU) Incr(key string, delta uint64, incr bool, cas uint64) (uint64, uint64, error) {
+	kl := lru.lockKey(key, &lockWaitIncr)
+	defer kl.unlock()
+
+	bucket := kl.bucketOf(key)
+
+	e := bucket.lookup(key)
+	if e == nil {
+		return 0, 0, ErrCacheMiss
+	}
+	en := e.Value.(*entry)
+	if cas != 0 && cas != en.cas {
+		return 0, 0, ErrCasConflict
+	}
+	value, err := strconv.ParseUint(string(en.bytes()), 10, 64)
+	if err != nil {
+		return 0, 0, ErrNotANumber
+	}
+	if incr {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+
+	newCas := lru.getNewCasToken()
+	bucket.updateElement(e, []byte(strconv.FormatUint(value, 10)), en.flags, newCas, en.expiresAt)
+	bucket.checkCapacity()
+
+	return value, newCas, nil
+}
+
+// CasMulti stores every item only if all of their keys currently hold the
+// item's cas token, returning the new cas token of each item (in order).
+// Returns ErrCacheMiss if any key is not found, ErrCasConflict if any token
+// does not match or ErrOutOfMemory if any value is too large, in which case
+// nothing is stored. If a key is repeated, the
+// last item for it is kept.
+//
+// The buckets of all keys are locked for the duration of the operation. To
+// avoid deadlocks between concurrent calls (or with single key operations,
+// which only ever hold one bucket lock), each bucket is locked once and
+// always in ascending bucket order.
+func (lru *LRU) CasMulti(items []CasItem) ([]uint64, error) {
+	locked := make(map[uint32]bool, len(items))
+	order := make([]uint32, 0, len(items))
+	for _, item := range items {
+		// both buckets a key can be stored in (see SetSizeAwarePlacement)
+		home, alt := lru.candidates(item.Key)
+		for _, index := range []uint32{home, alt} {
+			if !locked[index] {
+				locked[index] = true
+				order = append(order, index)
+			}
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	for _, index := range order {
+		lru.buckets[index].Lock()
+	}
+	defer func() {
+		for i := len(order) - 1; i >= 0; i-- {
+			lru.buckets[order[i]].Unlock()
+		}
+	}()
+
+	// check every token before storing anything
+	buckets := make([]*Bucket, len(items))
+	elements := make([]*list.Element, len(items))
+	for i, item := range items {
+		home, alt := lru.candidates(item.Key)
+		buckets[i] = lru.buckets[home]
+		if _, ok := lru.buckets[alt].elements[item.Key]; ok {
+			buckets[i] = lru.buckets[alt]
+		}
+		e := buckets[i].lookup(item.Key)
+		if e == nil {
+			return nil, ErrCacheMiss
+		}
+		if e.Value.(*entry).cas != item.Cas {
+			return nil, ErrCasConflict
+		}
+		// the entry keeps its tags, which count against the capacity too
+		if uint64(len(item.Key)+len(item.Value)+tagsSize(e.Value.(*entry).tags)) > buckets[i].capacity {
+			return nil, ErrOutOfMemory
+		}
+		elements[i] = e
+	}
+
+	now := time.Now().Unix()
+	tokens := make([]uint64, len(items))
+	for i, item := range items {
+		tokens[i] = lru.getNewCasToken()
+		buckets[i].updateElement(elements[i], item.Value, item.Flags, tokens[i], ExpiresAt(item.ExpTime, now))
+	}
+	for _, index := range order {
+		lru.buckets[index].checkCapacity()
+	}
+
+	return tokens, nil
+}
+
+// Clear removes all elements from the cache.
+// Each bucket is reset under its own lock, so concurrent operations
+// are only blocked on one bucket at a time rather than the entire cache.
+// The old entries are dropped and left for the garbage collector.
+func (lru *LRU) Clear() {
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.elements = make(map[string]*list.Element)
+		// reset in place, the eviction policy holds on to the list
+		bucket.evictList.Init()
+		bucket.size, bucket.keyBytes, bucket.tagBytes = 0, 0, 0
+		bucket.Unlock()
+	}
+
+	// no entry is left to be invalidated
+	lru.tags.mu.Lock()
+	lru.tags.invalidated = make(map[string]uint64)
+	lru.tags.mu.Unlock()
+}
+
+// DeletePrefix removes every element whose key starts with the specified
+// prefix and returns the number of elements removed.
+//
+// This is O(n) across the entire cache (each bucket is scanned under its own
+// lock), so it is intended for admin use and not the hot path.
+func (lru *LRU) DeletePrefix(prefix string) int {
+	count := 0
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		for e := bucket.evictList.Front(); e != nil; {
+			next := e.Next()
+			if strings.HasPrefix(e.Value.(*entry).key, prefix) {
+				bucket.deleteElement(e)
+				count++
+			}
+			e = next
+		}
+		bucket.Unlock()
+	}
+	return count
+}
+
+// FlushBucket removes every entry of bucket 'n' (0 to the number of buckets
+// - 1) under its lock and returns the number of entries removed. The other
+// buckets are untouched. This destroys data and is meant for diagnosing a
+// problem suspected to be local to a bucket.
+func (lru *LRU) FlushBucket(n int) (int, error) {
+	if n < 0 || n >= len(lru.buckets) {
+		return 0, ErrNoSuchBucket
+	}
+	bucket := lru.buckets[n]
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	count := 0
+	for e := bucket.evictList.Front(); e != nil; {
+		next := e.Next()
+		bucket.deleteElement(e)
+		count++
+		e = next
+	}
+	return count, nil
+}
+
+// SizeHistogram returns the number of entries in each power of two size
+// range, keyed by the (inclusive) upper bound of the range in bytes
+// (ie: an entry of 100 bytes is counted in the 128 range).
+//
+// This walks every entry in the cache (each bucket under its own lock),
+// so it is expensive and intended for occasional diagnostics only.
+func (lru *LRU) SizeHistogram() map[uint64]uint64 {
+	histogram := make(map[uint64]uint64)
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		for e := bucket.evictList.Front(); e != nil; e = e.Next() {
+			size := e.Value.(*entry).size()
+			upper := uint64(1)
+			for upper < size {
+				upper <<= 1
+			}
+			histogram[upper]++
+		}
+		bucket.Unlock()
+	}
+	return histogram
+}
+
+// OldestItemAge returns the number of seconds since the oldest of the
+// entries next in line for eviction (the back of each bucket's evict list)
+// was stored, or 0 if the cache is empty. With the default policy these are
+// the least recently used entries, so this is roughly how long an entry
+// nobody reads survives before being evicted: the effective retention of
+// the cache.
+func (lru *LRU) OldestItemAge() int64 {
+	now := time.Now().Unix()
+	var age int64
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		if e := bucket.evictList.Back(); e != nil {
+			if a := now - e.Value.(*entry).storedAt; a > age {
+				age = a
+			}
+		}
+		bucket.Unlock()
+	}
+	return age
+}
+
+// estimated bytes taken by each entry besides its key, value and tags: the
+// entry itself, its evict list element, and its slot in the bucket's map (the
+// key's string header, the element pointer and the map's own bookkeeping)
+var entryOverhead = uint64(unsafe.Sizeof(entry{}) + unsafe.Sizeof(list.Element{}) + 32)
+
+// MemoryBreakdown returns the bytes stored by keys, values and tags, and the
+// estimated overhead of the structures holding them, summed across buckets
+// (ie: to tell whether shortening keys or compressing values would save the
+// most). Only keys, values and tags count against the capacity. The overhead
+// is an estimate: it leaves out the access statistics of EnableAccessTracking,
+// the chunk headers of SetChunkSize and the map's unused slots.
+func (lru *LRU) MemoryBreakdown() MemoryBreakdown {
+	var breakdown MemoryBreakdown
+	for _, bucket := range lru.buckets {
+		bucket.RLock()
+		entries := uint64(len(bucket.elements))
+		breakdown.Entries += entries
+		breakdown.Keys += bucket.keyBytes
+		breakdown.Tags += bucket.tagBytes
+		breakdown.Values += bucket.size - bucket.keyBytes - bucket.tagBytes
+		breakdown.Overhead += entries * entryOverhead
+		bucket.RUnlock()
+	}
+	return breakdown
+}
+
+// Verify recomputes the size of every bucket from the entries in its map,
+// under its lock, and returns the buckets whose tracked size differs, or
+// whose map and evict list don't hold the same number of entries. Either
+// means an update got its accounting wrong, which eventually shows as
+// 'evict_anomaly'. Returns nil if every bucket is consistent.
+//
+// This walks every entry in the cache, so it is expensive and intended for
+// debugging only.
+func (lru *LRU) Verify() []BucketDiscrepancy {
+	var discrepancies []BucketDiscrepancy
+	for i, bucket := range lru.buckets {
+		bucket.Lock()
+		actual := uint64(0)
+		for _, e := range bucket.elements {
+			actual += e.Value.(*entry).size()
+		}
+		if actual != bucket.size || len(bucket.elements) != bucket.evictList.Len() {
+			discrepancies = append(discrepancies, BucketDiscrepancy{
+				Bucket:  i,
+				Size:    bucket.size,
+				Actual:  actual,
+				Entries: len(bucket.elements),
+				Listed:  bucket.evictList.Len(),
+			})
+		}
+		bucket.Unlock()
+	}
+	return discrepancies
+}
+
+// Resize changes the approximate maximum number of bytes to be stored.
+// The new capacity is split evenly across buckets. Each bucket is resized
+// under its own lock, evicting entries if it is now over capacity, so
+// concurrent operations on other buckets are not blocked.
+func (lru *LRU) Resize(newCapacity uint64) {
+	atomic.StoreUint64(&lru.capacity, newCapacity)
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		bucket.capacity = newCapacity / uint64(lru.numBuckets)
+		bucket.checkCapacity()
+		bucket.Unlock()
+	}
+}
+
+// Evict evicts entries, in the order of each bucket's eviction policy, until
+// about 'target' bytes have been freed (split evenly across buckets, each
+// evicted under its own lock). Returns the number of bytes evicted.
+func (lru *LRU) Evict(target uint64) uint64 {
+	perBucket := target/uint64(lru.numBuckets) + 1
+	evicted := uint64(0)
+	for _, bucket := range lru.buckets {
+		bucket.Lock()
+		before := bucket.size
+		for before-bucket.size < perBucket && bucket.evictList.Len() > 0 {
+			if !bucket.evict() {
+				break
+			}
+		}
+		evicted += before - bucket.size
+		bucket.Unlock()
+	}
+	return evicted
+}
+
+// Capacity returns the approximate maximum number of bytes to be stored.
+func (lru *LRU) Capacity() uint64 {
+	return atomic.LoadUint64(&lru.capacity)
+}
+
+// ByteSize returns the approximate number of bytes stored, as counted against
+// the capacity. Buckets are read one after the other, so this is O(buckets).
+func (lru *LRU) ByteSize() uint64 {
+	var size uint64
+	for _, bucket := range lru.buckets {
+		bucket.RLock()
+		size += bucket.size
+		bucket.RUnlock()
+	}
+	return size
+}
+
+// Settings returns the effective configuration of the LRU.
+// Options are applied to every bucket alike, so they are read from the first.
+func (lru *LRU) Settings() map[string]string {
+	settings := map[string]string{
+		"capacity":    strconv.FormatUint(lru.Capacity(), 10),
+		"num_buckets": strconv.FormatUint(uint64(lru.numBuckets), 10),
+	}
+	if len(lru.buckets) == 0 {
+		return settings
+	}
+
+	bucket := lru.buckets[0]
+	bucket.RLock()
+	defer bucket.RUnlock()
+
+	soft := bucket.softFraction
+	if soft <= 0 || soft >= 1 {
+		soft = 1
+	}
+	settings["eviction_policy"] = bucket.policyName()
+	settings["eviction_scope"] = "allkeys"
+	if bucket.volatileEviction {
+		settings["eviction_scope"] = "volatile"
+	}
+	settings["soft_capacity"] = strconv.FormatFloat(soft, 'f', -1, 64)
+	settings["checksums"] = strconv.FormatBool(bucket.checksums)
+	settings["chunk_size"] = strconv.Itoa(bucket.chunkSize)
+	settings["max_entries_per_bucket"] = strconv.Itoa(bucket.maxEntries)
+	settings["access_tracking"] = strconv.FormatBool(bucket.trackAccess)
+	settings["skip_identical_sets"] = strconv.FormatBool(bucket.skipIdenticalSets)
+	settings["size_aware_threshold"] = strconv.Itoa(lru.sizeAwareThreshold)
+	settings["stale_grace"] = (time.Duration(bucket.staleGrace) * time.Second).String()
+	settings["warmup_until"] = strconv.FormatInt(bucket.warmupUntil, 10)
+	return settings
+}
+
+// FNV-1a 32 bit prime
+const fnvPrime32 = 16777619
+
+// hash returns the seeded FNV-1a hash of the specified key
 func (lru *LRU) hash(key string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return h.Sum32()
+	h := lru.hashBasis
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// getBucket returns the bucket the specified key hashes into
+func (lru *LRU) getBucket(key string) *Bucket {
+	return lru.buckets[lru.hash(key)%lru.numBuckets]
 }
 
 // atomically increment and return unique cas token
@@ -163,26 +1115,103 @@ func (bucket *Bucket) PrintEvictList() {
 	log.Println(s)
 }
 
+// lookup returns the element for the specified key, or nil if it is not found
+// or stale.
+func (bucket *Bucket) lookup(key string) *list.Element {
+	e, stale := bucket.lookupStale(key)
+	if stale {
+		return nil
+	}
+	return e
+}
+
+// lookupStale returns the element for the specified key, or nil if it is not
+// found. Expired elements still within the stale grace period are returned
+// (and reported as stale), other expired elements and elements failing their
+// checksum are removed.
+func (bucket *Bucket) lookupStale(key string) (*list.Element, bool) {
+	e, ok := bucket.elements[key]
+	if !ok {
+		return nil, false
+	}
+	if bucket.checksums && !e.Value.(*entry).verify() {
+		log.Printf("checksum mismatch for key (%s), dropping entry\n", key)
+		StatsCorruptions.Add(1)
+		bucket.deleteElement(e)
+		return nil, false
+	}
+	if bucket.invalidated(e.Value.(*entry)) {
+		StatsTagInvalidated.Add(1)
+		bucket.deleteElement(e)
+		return nil, false
+	}
+	now := time.Now().Unix()
+	if e.Value.(*entry).expired(now) {
+		if now < e.Value.(*entry).staleUntil(bucket.staleGrace) {
+			return e, true
+		}
+		bucket.expireElement(e)
+		return nil, false
+	}
+	return e, false
+}
+
 // add element to cache and update evict list for this element
-func (bucket *Bucket) addElement(key, value string, flags uint32, cas uint64) {
-	e := bucket.evictList.PushFront(&entry{key: key, value: value, flags: flags, cas: cas})
+func (bucket *Bucket) addElement(key string, value []byte, flags uint32, cas uint64, expiresAt int64) *list.Element {
+	en := &entry{key: key, flags: flags, cas: cas, expiresAt: expiresAt, storedAt: time.Now().Unix()}
+	en.setValue(value, bucket.chunkSize)
+	if bucket.trackAccess {
+		en.access = &accessInfo{lastAccess: time.Now().Unix()}
+	}
+	if bucket.checksums {
+		en.checksum = crc32.ChecksumIEEE(value)
+	}
+	e := bucket.evictList.PushFront(en)
 	bucket.elements[key] = e
 	bucket.size += e.Value.(*entry).size()
+	bucket.keyBytes += uint64(len(key))
+	bucket.policy.RecordInsert(e)
+	return e
 }
 
 // update element in cache and update evict list for this element
-func (bucket *Bucket) updateElement(e *list.Element, value string, flags uint32, cas uint64) {
+func (bucket *Bucket) updateElement(e *list.Element, value []byte, flags uint32, cas uint64, expiresAt int64) {
 	oldSize := e.Value.(*entry).size()
-	e.Value.(*entry).value = value
+	e.Value.(*entry).setValue(value, bucket.chunkSize)
 	e.Value.(*entry).flags = flags
 	e.Value.(*entry).cas = cas
-	bucket.evictList.MoveToFront(e)
+	e.Value.(*entry).expiresAt = expiresAt
+	e.Value.(*entry).storedAt = time.Now().Unix()
+	e.Value.(*entry).fetched = false
+	e.Value.(*entry).winSent = false
+	if access := e.Value.(*entry).access; access != nil {
+		*access = accessInfo{lastAccess: time.Now().Unix()}
+	}
+	if bucket.checksums {
+		e.Value.(*entry).checksum = crc32.ChecksumIEEE(value)
+	}
+	bucket.refreshElement(e)
+	bucket.size += e.Value.(*entry).size() - oldSize
+}
+
+// replace the tags of this element
+func (bucket *Bucket) setTags(e *list.Element, tags []string) {
+	oldSize := e.Value.(*entry).size()
+	bucket.tagBytes -= uint64(tagsSize(e.Value.(*entry).tags))
+	e.Value.(*entry).tags = tags
 	bucket.size += e.Value.(*entry).size() - oldSize
+	bucket.tagBytes += uint64(tagsSize(tags))
 }
 
-// update evict list for this element
+// invalidated returns true if one of the entry's tags was invalidated after
+// it was stored (see InvalidateTag)
+func (bucket *Bucket) invalidated(en *entry) bool {
+	return en.tags != nil && bucket.tags.stale(en.tags, en.cas)
+}
+
+// record an access of this element with the eviction policy
 func (bucket *Bucket) refreshElement(e *list.Element) {
-	bucket.evictList.MoveToFront(e)
+	bucket.policy.RecordAccess(e)
 }
 
 // remove element from cache and evict list
@@ -190,16 +1219,86 @@ func (bucket *Bucket) deleteElement(e *list.Element) {
 	delete(bucket.elements, e.Value.(*entry).key)
 	bucket.evictList.Remove(e)
 	bucket.size -= e.Value.(*entry).size()
+	bucket.keyBytes -= uint64(len(e.Value.(*entry).key))
+	bucket.tagBytes -= uint64(tagsSize(e.Value.(*entry).tags))
+}
+
+// remove an expired element from cache and evict list
+func (bucket *Bucket) expireElement(e *list.Element) {
+	if !e.Value.(*entry).fetched {
+		StatsExpiredUnfetched.Add(1)
+	}
+	bucket.deleteElement(e)
+}
+
+// maximum number of entries evicted by a write while between the soft
+// and hard capacity
+const softEvictionsPerWrite = 2
+
+// softCapacity returns the number of bytes past which entries are evicted
+// gently (see SetSoftCapacity)
+func (bucket *Bucket) softCapacity() uint64 {
+	if bucket.softFraction <= 0 || bucket.softFraction >= 1 {
+		return bucket.capacity
+	}
+	return uint64(float64(bucket.capacity) * bucket.softFraction)
 }
 
 // remove last element in evict list if we have more than 'capacity' bytes
+// or 'maxEntries' entries, then a few more if we are still over the soft
+// capacity
 func (bucket *Bucket) checkCapacity() {
+	soft := bucket.softCapacity()
+	if bucket.size > soft {
+		if now := time.Now().Unix(); now < bucket.warmupUntil {
+			bucket.removeExpired(now, soft)
+		}
+	}
 	for bucket.size > bucket.capacity {
-		e := bucket.evictList.Back()
-		if e == nil {
-			log.Println("want to evict but found nothing on the evict list, this should rarely happen")
-			break
+		if !bucket.evict() {
+			return
 		}
-		bucket.deleteElement(e)
+	}
+	for bucket.maxEntries > 0 && bucket.evictList.Len() > bucket.maxEntries {
+		if !bucket.evict() {
+			return
+		}
+		StatsEvictedEntryLimit.Add(1)
+	}
+	// never evict the only entry left (ie: the one just written)
+	for i := 0; i < softEvictionsPerWrite && bucket.size > soft && bucket.evictList.Len() > 1; i++ {
+		if !bucket.evict() {
+			return
+		}
+	}
+}
+
+// evict removes the next element to be evicted, returning false if there is none
+func (bucket *Bucket) evict() bool {
+	e := bucket.victim()
+	if e == nil {
+		log.Println("want to evict but found nothing on the evict list, this should rarely happen")
+		StatsEvictAnomaly.Add(1)
+		return false
+	}
+	if !e.Value.(*entry).fetched {
+		StatsEvictedUnfetched.Add(1)
+	}
+	bucket.deleteElement(e)
+	if bucket.evictHook != nil {
+		bucket.evictHook(e.Value.(*entry).key)
+	}
+	return true
+}
+
+// remove expired elements (from the back of the evict list) until we no
+// longer have more than 'target' bytes
+func (bucket *Bucket) removeExpired(now int64, target uint64) {
+	for e := bucket.evictList.Back(); e != nil && bucket.size > target; {
+		prev := e.Prev()
+		if e.Value.(*entry).expired(now) {
+			bucket.expireElement(e)
+		}
+		e = prev
 	}
 }
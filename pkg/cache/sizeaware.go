@@ -0,0 +1,124 @@
+package cache
+
+// Size-aware placement (see SetSizeAwarePlacement) gives every key a second,
+// alternate bucket. Entries at least 'sizeAwareThreshold' bytes are stored in
+// whichever of the two buckets has the most room, so a few large values no
+// longer overload the bucket their key happens to hash to while others sit
+// near empty. Smaller entries stay in their home bucket.
+//
+// As an entry can be in either bucket, every operation on a key locks both of
+// them (in index order, so concurrent operations can't deadlock), which roughly
+// doubles the cost of locking. It is off by default.
+
+// SetSizeAwarePlacement stores entries of at least 'threshold' bytes (key and
+// value) in the less full of two candidate buckets instead of always in the
+// bucket their key hashes to, spreading large values more evenly across
+// buckets when value sizes vary wildly. 0 (the default) disables it. This must
+// be called before the LRU is used, as existing entries are not moved.
+func (lru *LRU) SetSizeAwarePlacement(threshold int) {
+	if lru.numBuckets < 2 {
+		return
+	}
+	lru.sizeAwareThreshold = threshold
+}
+
+// keyLock holds the lock of the bucket(s) a key can be stored in: its home
+// bucket and, with size-aware placement, its alternate bucket.
+type keyLock struct {
+	home *Bucket
+	alt  *Bucket
+	// the locks are held for reading (see rlockKey)
+	read bool
+}
+
+// candidates returns the index of the home and alternate buckets of a key
+// (the same index twice without size-aware placement)
+func (lru *LRU) candidates(key string) (uint32, uint32) {
+	h := lru.hash(key)
+	home := h % lru.numBuckets
+	if lru.sizeAwareThreshold <= 0 {
+		return home, home
+	}
+	// offset by 1 to numBuckets-1 so the alternate is always another bucket
+	return home, (home + 1 + (h>>16)%(lru.numBuckets-1)) % lru.numBuckets
+}
+
+// lockKey locks the bucket(s) of a key, timing the wait for the first lock
+// in 'h' (see lockTimed).
+func (lru *LRU) lockKey(key string, h *lockWaitHistogram) keyLock {
+	home, alt := lru.candidates(key)
+	if home == alt {
+		bucket := lru.buckets[home]
+		bucket.lockTimed(h)
+		return keyLock{home: bucket}
+	}
+	first, second := home, alt
+	if second < first {
+		first, second = second, first
+	}
+	lru.buckets[first].lockTimed(h)
+	lru.buckets[second].Lock()
+	return keyLock{home: lru.buckets[home], alt: lru.buckets[alt]}
+}
+
+// rlockKey locks the bucket(s) of a key for reading, like lockKey
+func (lru *LRU) rlockKey(key string, h *lockWaitHistogram) keyLock {
+	home, alt := lru.candidates(key)
+	if home == alt {
+		bucket := lru.buckets[home]
+		bucket.rlockTimed(h)
+		return keyLock{home: bucket, read: true}
+	}
+	first, second := home, alt
+	if second < first {
+		first, second = second, first
+	}
+	lru.buckets[first].rlockTimed(h)
+	lru.buckets[second].RLock()
+	return keyLock{home: lru.buckets[home], alt: lru.buckets[alt], read: true}
+}
+
+// unlock releases the lock(s) taken by lockKey or rlockKey
+func (l keyLock) unlock() {
+	if l.read {
+		if l.alt != nil {
+			l.alt.RUnlock()
+		}
+		l.home.RUnlock()
+		return
+	}
+	if l.alt != nil {
+		l.alt.Unlock()
+	}
+	l.home.Unlock()
+}
+
+// bucketOf returns the bucket storing the key, or its home bucket if
+// neither does
+func (l keyLock) bucketOf(key string) *Bucket {
+	if l.alt != nil {
+		if _, ok := l.alt.elements[key]; ok {
+			return l.alt
+		}
+	}
+	return l.home
+}
+
+// placement returns the bucket a new entry of 'size' bytes is stored in
+func (l keyLock) placement(size, threshold int) *Bucket {
+	if l.alt == nil || size < threshold {
+		return l.home
+	}
+	if free(l.alt) > free(l.home) {
+		return l.alt
+	}
+	return l.home
+}
+
+// free returns the number of bytes the bucket can store before evicting
+func free(bucket *Bucket) uint64 {
+	if bucket.size >= bucket.capacity {
+		return 0
+	}
+	return bucket.capacity - bucket.size
+}
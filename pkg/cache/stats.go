@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"expvar"
+	"fmt"
+)
+
+var (
+	StatsCorruptions = expvar.NewInt("corruptions")
+
+	// entries removed before ever being retrieved by a Get
+	StatsEvictedUnfetched = expvar.NewInt("evicted_unfetched")
+	StatsExpiredUnfetched = expvar.NewInt("expired_unfetched")
+
+	// sets of an identical value that kept the stored entry (see SkipIdenticalSets)
+	StatsSetsUnchanged = expvar.NewInt("sets_unchanged")
+
+	// entries evicted because their bucket held too many entries (see SetMaxEntriesPerBucket)
+	StatsEvictedEntryLimit = expvar.NewInt("evicted_entry_limit")
+
+	// entries without an expiration time evicted for lack of an entry with
+	// one (see SetVolatileEviction)
+	StatsEvictedWithoutTTL = expvar.NewInt("evicted_without_ttl")
+
+	// evictions that found nothing to evict with the bucket still over its
+	// limits, a sign its size is overcounted relative to its entries
+	StatsEvictAnomaly = expvar.NewInt("evict_anomaly")
+
+	// entries removed because one of their tags was invalidated (see InvalidateTag)
+	StatsTagInvalidated = expvar.NewInt("tag_invalidated")
+)
+
+// sampled time spent waiting for bucket locks, by operation (see lockTimed)
+var (
+	lockWaitGet    lockWaitHistogram
+	lockWaitSet    lockWaitHistogram
+	lockWaitDelete lockWaitHistogram
+	lockWaitIncr   lockWaitHistogram
+)
+
+// publishes the lock wait percentiles of each operation
+// (ie: lock_wait_get_p99_ns)
+func init() {
+	histograms := map[string]*lockWaitHistogram{
+		"get":    &lockWaitGet,
+		"set":    &lockWaitSet,
+		"delete": &lockWaitDelete,
+		"incr":   &lockWaitIncr,
+	}
+	for op, h := range histograms {
+		for _, p := range []int{50, 90, 99} {
+			h, p := h, p
+			expvar.Publish(fmt.Sprintf("lock_wait_%s_p%d_ns", op, p), expvar.Func(func() interface{} {
+				return int64(h.percentile(float64(p)))
+			}))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"sync"
+)
+
+// Tags (see AddTagged) group entries so they can be invalidated together
+// (ie: every entry derived from product 42 carries the tag "product:42").
+//
+// Rather than an index of the keys carrying each tag, which would have to be
+// kept consistent with every eviction, expiry and overwrite, an invalidation
+// only records the next cas token for its tag. As cas tokens are increasing,
+// a tagged entry whose cas token is older than the invalidation of one of its
+// tags was stored before it: such an entry is removed when it's next looked
+// up, like an expired entry, and until then is evicted like any other. An
+// entry stored after the invalidation has a newer cas token and is kept.
+//
+// Invalidating is O(1) and untagged entries cost nothing more to look up, at
+// the price of remembering every tag ever invalidated (a map entry each) until
+// the cache is cleared.
+
+// tagTable holds the cas token of the last invalidation of each tag
+type tagTable struct {
+	mu          sync.RWMutex
+	invalidated map[string]uint64
+}
+
+func newTagTable() *tagTable {
+	return &tagTable{invalidated: make(map[string]uint64)}
+}
+
+// stale returns true if one of the tags was invalidated after 'cas' was
+// handed out
+func (t *tagTable) stale(tags []string, cas uint64) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, tag := range tags {
+		if cas < t.invalidated[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsSize returns the number of bytes accounted for the tags of an entry
+func tagsSize(tags []string) int {
+	n := 0
+	for _, tag := range tags {
+		n += len(tag)
+	}
+	return n
+}
+
+// sameTags returns true if both entries have the same tags, in order
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AddTagged inserts or updates the element for the specified key like Add,
+// tagging it with 'tags' (see InvalidateTag). The tags replace those of the
+// current element, if any: a later Add removes them, while Incr and CasMulti
+// keep them.
+func (lru *LRU) AddTagged(key string, value []byte, flags uint32, expTime int32, tags []string) (uint64, error) {
+	return lru.AddWithOptions(key, value, flags, expTime, SetOptions{Tags: tags})
+}
+
+// InvalidateTag removes every element currently tagged with 'tag'. Elements
+// are removed lazily: they are misses from now on, but their memory is only
+// freed once they are next looked up or evicted.
+func (lru *LRU) InvalidateTag(tag string) {
+	lru.tags.mu.Lock()
+	defer lru.tags.mu.Unlock()
+
+	lru.tags.invalidated[tag] = lru.getNewCasToken()
+}
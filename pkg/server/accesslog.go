@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// number of entries buffered in memory before new entries are dropped
+	accessLogQueueSize = 4096
+	// how often buffered entries are flushed to the writer
+	accessLogFlushInterval = time.Second
+	// maximum length of the result recorded for a command
+	maxAccessLogResult = 64
+	// timestamp layout of the Common Log Format
+	accessLogTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLog is an append-only audit trail of who changed what: every
+// mutating command (set, cas, delete, incr/decr, ms, md, ma and mcas)
+// dispatched to the cache, with the client it came from and its result.
+//
+// Each entry is a line in a format modeled on the Common Log Format, whose
+// fields never change order:
+//
+//	10.0.0.1:52311 - - [14/Oct/2026:13:53:44 +0000] "set user:42" "STORED" 6
+//
+// that is the client address, two unused fields, the time the command was
+// received, the command and its keys (as stored, namespace included), the
+// first line of its reply, and the bytes stored ("-" if none). Any byte of a
+// quoted field that is a quote, a backslash or not printable ASCII is written
+// as \xHH, so keys can't break the format.
+//
+// Unlike the CommandLog, the log can't be replayed, it records failures too
+// (ie: NOT_FOUND) and never the values. Entries are queued and written by a
+// background goroutine so logging never blocks a connection: entries are
+// dropped (and counted in 'access_log_dropped') when the queue is full, and
+// anything not yet flushed is lost if the process crashes.
+type AccessLog struct {
+	writer  io.Writer
+	entries chan string
+	done    chan struct{}
+}
+
+// NewAccessLog starts the background writer of entries to 'w', which is
+// owned by the caller (ie: a file opened for appending).
+func NewAccessLog(w io.Writer) *AccessLog {
+	l := &AccessLog{
+		writer:  w,
+		entries: make(chan string, accessLogQueueSize),
+		done:    make(chan struct{}),
+	}
+	go l.writeLoop()
+	return l
+}
+
+// writeLoop writes queued entries until the log is closed, flushing at least
+// every accessLogFlushInterval.
+func (l *AccessLog) writeLoop() {
+	defer close(l.done)
+
+	writer := bufio.NewWriter(l.writer)
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-l.entries:
+			if !ok {
+				if err := writer.Flush(); err != nil {
+					log.Printf("AccessLog: flush failed: %s\n", err)
+				}
+				return
+			}
+			writer.WriteString(entry)
+		case <-ticker.C:
+			if err := writer.Flush(); err != nil {
+				log.Printf("AccessLog: flush failed: %s\n", err)
+			}
+		}
+	}
+}
+
+// Close flushes any queued entries, leaving the writer open.
+// No entries may be logged after calling Close.
+func (l *AccessLog) Close() {
+	close(l.entries)
+	<-l.done
+}
+
+// log queues the entry of a command received from 'addr' at 'at', dropping
+// it if the queue is full. A nil AccessLog logs nothing.
+func (l *AccessLog) log(addr string, at time.Time, request Request, result string) {
+	if l == nil {
+		return
+	}
+	stored := "-"
+	switch request.cmd {
+	case cmdSet, cmdCas, cmdMetaSet:
+		stored = fmt.Sprint(len(request.dataBlock))
+	case cmdMultiCas:
+		n := 0
+		for _, item := range request.items {
+			n += len(item.Value)
+		}
+		stored = fmt.Sprint(n)
+	}
+	command := strings.Join(append([]string{request.cmd}, request.keys...), " ")
+	entry := fmt.Sprintf("%s - - [%s] \"%s\" \"%s\" %s\n", addr, at.Format(accessLogTimeLayout), escapeLogField(command), escapeLogField(result), stored)
+
+	select {
+	case l.entries <- entry:
+	default:
+		StatsAccessLogDropped.Add(1)
+	}
+}
+
+// escapeLogField escapes every quote, backslash and non printable ASCII
+// byte of 's' as \xHH
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' || c < 0x20 || c >= 0x7f {
+			fmt.Fprintf(&b, "\\x%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// replyRecorder is the writer of a connection's replies with AccessLog set,
+// keeping the first line of each reply as the result of its command.
+type replyRecorder struct {
+	io.Writer
+	line []byte
+	// set once the first line is complete (or too long to keep whole)
+	done bool
+}
+
+func (r *replyRecorder) Write(b []byte) (int, error) {
+	if !r.done {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			r.line = append(r.line, b[:i]...)
+			r.done = true
+		} else {
+			r.line = append(r.line, b...)
+		}
+		if len(r.line) > maxAccessLogResult {
+			r.line = r.line[:maxAccessLogResult]
+			r.done = true
+		}
+	}
+	return r.Writer.Write(b)
+}
+
+// reset forgets the last reply, before dispatching the next command
+func (r *replyRecorder) reset() {
+	r.line, r.done = r.line[:0], false
+}
+
+// result returns the first line of the reply since the last reset
+func (r *replyRecorder) result() string {
+	return strings.TrimSuffix(string(r.line), "\r")
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// standardCommands are the verbs of every command the server handles, which
+// command aliases map to and can't shadow
+var standardCommands = map[string]bool{
+	cmdCas:            true,
+	cmdDecr:           true,
+	cmdDelete:         true,
+	cmdGet:            true,
+	cmdGets:           true,
+	cmdIncr:           true,
+	cmdQuit:           true,
+	cmdSet:            true,
+	cmdStats:          true,
+	cmdVerbosity:      true,
+	cmdHire:           true,
+	cmdMetaArithmetic: true,
+	cmdMetaDelete:     true,
+	cmdMetaGet:        true,
+	cmdMetaSet:        true,
+	cmdMultiCas:       true,
+	cmdNamespace:      true,
+}
+
+// commandAliases map nonstandard verbs to the standard command they stand
+// for (see CommandAliases). A nil map resolves no alias.
+type commandAliases map[string]string
+
+// newCommandAliases validates the aliases (k: alias, v: standard command):
+// an alias is a single token that isn't a standard command, and maps to a
+// standard command rather than to another alias.
+func newCommandAliases(aliases map[string]string) (commandAliases, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	resolved := make(commandAliases, len(aliases))
+	for alias, cmd := range aliases {
+		if alias == "" || strings.IndexFunc(alias, isSeparator) >= 0 || strings.IndexByte(alias, deadlineModifier) >= 0 {
+			return nil, fmt.Errorf("invalid command alias (%s)", alias)
+		}
+		if standardCommands[alias] {
+			return nil, fmt.Errorf("command alias (%s) shadows a standard command", alias)
+		}
+		if !standardCommands[cmd] {
+			return nil, fmt.Errorf("command alias (%s) of unknown command (%s)", alias, cmd)
+		}
+		resolved[alias] = cmd
+	}
+	return resolved, nil
+}
+
+// resolve returns the standard command of the verb 'cmd' if it is an alias,
+// keeping any deadline modifier (ie: "fetch@50" is "get@50" with fetch an
+// alias of get), or 'cmd' itself otherwise
+func (a commandAliases) resolve(cmd string) string {
+	verb, modifier := cmd, ""
+	if i := strings.IndexByte(cmd, deadlineModifier); i >= 0 {
+		verb, modifier = cmd[:i], cmd[i:]
+	}
+	if standard, ok := a[verb]; ok {
+		return standard + modifier
+	}
+	return cmd
+}
+
+// String returns the aliases as "alias=command" pairs, sorted and comma
+// separated, or "none" without any (a setting is never empty)
+func (a commandAliases) String() string {
+	if len(a) == 0 {
+		return "none"
+	}
+	pairs := make([]string, 0, len(a))
+	for alias, cmd := range a {
+		pairs = append(pairs, alias+"="+cmd)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// setListenBacklog sets the backlog of the listening socket to 'backlog'.
+//
+// The backlog can't be set by a ListenConfig's Control function, which runs
+// before the socket listens, so listen(2) is called again on the listening
+// socket: with the same socket, it only updates the length of its queue.
+func setListenBacklog(l net.Listener, backlog int) error {
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	c, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = c.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package server
+
+import (
+	"net"
+)
+
+// setListenBacklog leaves the OS default backlog, as it can't be changed on
+// this platform.
+func setListenBacklog(l net.Listener, backlog int) error {
+	return errListenBacklogUnsupported
+}
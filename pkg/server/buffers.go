@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// bufferPools hold the read and write buffers given back by idle
+// connections (see IdleBufferRelease), shared by every connection of the
+// server. Every buffer of a server has the same size, so any can be reused.
+type bufferPools struct {
+	readers sync.Pool
+	writers sync.Pool
+}
+
+// reader returns a pooled reader of 'src', or a new one of 'size' bytes
+func (p *bufferPools) reader(src io.Reader, size int) *bufio.Reader {
+	if reader, ok := p.readers.Get().(*bufio.Reader); ok {
+		reader.Reset(src)
+		return reader
+	}
+	return bufio.NewReaderSize(src, size)
+}
+
+// writer returns a pooled writer to 'dst', or a new one of 'size' bytes
+func (p *bufferPools) writer(dst io.Writer, size int) *bufio.Writer {
+	if writer, ok := p.writers.Get().(*bufio.Writer); ok {
+		writer.Reset(dst)
+		return writer
+	}
+	return bufio.NewWriterSize(dst, size)
+}
+
+// bufferReleaser gives the buffers of a connection back to the server's pools
+// once it has waited 'period' for its next command, taking them again once
+// the command starts arriving (see IdleBufferRelease). A nil releaser never
+// releases anything.
+//
+// The reader's buffer is held for as long as a read is blocked on it, so the
+// wait for the first byte of the next command past 'period' is done without
+// it, on 'first'. The reader taken back reads that byte before the rest of
+// the connection.
+type bufferReleaser struct {
+	conn   *idleConn
+	period time.Duration
+	pools  *bufferPools
+	size   int
+	// signals the connection's handler to release its writer as well
+	released chan struct{}
+	// first byte received once released, not yet read by the reader
+	first   [1]byte
+	pending bool
+}
+
+func newBufferReleaser(conn *idleConn, period time.Duration, pools *bufferPools, size int) *bufferReleaser {
+	return &bufferReleaser{
+		conn:     conn,
+		period:   period,
+		pools:    pools,
+		size:     size,
+		released: make(chan struct{}, 1),
+	}
+}
+
+// Read returns the first byte received once released, then reads the
+// connection
+func (r *bufferReleaser) Read(b []byte) (int, error) {
+	if r.pending && len(b) > 0 {
+		b[0] = r.first[0]
+		r.pending = false
+		return 1, nil
+	}
+	return r.conn.Read(b)
+}
+
+// await waits for the next command to start arriving, releasing the buffers
+// of the connection if that takes longer than 'period'. Returns the reader to
+// read the command from, which is only the same as 'reader' if the buffers
+// weren't released, or the error reading failed with.
+func (r *bufferReleaser) await(reader *bufio.Reader) (*bufio.Reader, error) {
+	if r == nil || reader.Buffered() > 0 {
+		return reader, nil
+	}
+	r.conn.deadline = time.Now().Add(r.period)
+	_, err := reader.Peek(1)
+	expired := r.conn.expired(err)
+	r.conn.deadline = time.Time{}
+	if !expired {
+		return reader, err
+	}
+
+	reader.Reset(nil)
+	r.pools.readers.Put(reader)
+	select {
+	case r.released <- struct{}{}:
+	default:
+	}
+	StatsIdleBuffersReleased.Add(1)
+
+	n, err := r.conn.Read(r.first[:])
+	if err != nil {
+		return nil, err
+	}
+	r.pending = n == 1
+	return r.pools.reader(r, r.size), nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maximum number of distinct clients counted separately
+	maxTrackedClients = 1024
+	// identity of the clients counted together once maxTrackedClients are
+	untrackedClients = "other"
+)
+
+// clientCounts are the operations of a single client identity, updated
+// atomically by each of its connections
+type clientCounts struct {
+	commands int64
+	// keys looked up by get, gets and mg
+	gets int64
+	// items stored by set, cas, ms and mcas, and their bytes
+	sets  int64
+	bytes int64
+}
+
+// record counts the request, which has been validated. A nil clientCounts
+// records nothing.
+func (c *clientCounts) record(request Request) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.commands, 1)
+	switch request.cmd {
+	case cmdGet, cmdGets, cmdMetaGet:
+		atomic.AddInt64(&c.gets, int64(len(request.keys)))
+	case cmdSet, cmdCas, cmdMetaSet:
+		atomic.AddInt64(&c.sets, 1)
+		atomic.AddInt64(&c.bytes, int64(len(request.dataBlock)))
+	case cmdMultiCas:
+		bytes := 0
+		for _, item := range request.items {
+			bytes += len(item.Value)
+		}
+		atomic.AddInt64(&c.sets, int64(len(request.items)))
+		atomic.AddInt64(&c.bytes, int64(bytes))
+	}
+}
+
+// clientTable holds the operation counts of every client identity (see
+// TrackClients). Counts are kept once a client disconnects, so they add up
+// over the life of the server.
+//
+// Memory is bounded by counting clients past the first maxTrackedClients
+// together, as 'untrackedClients', rather than forgetting any counts.
+type clientTable struct {
+	mu      sync.Mutex
+	clients map[string]*clientCounts
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{clients: make(map[string]*clientCounts)}
+}
+
+// counts returns the counts of the client identity, looked up once per
+// connection
+func (t *clientTable) counts(identity string) *clientCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.clients[identity]; ok {
+		return c
+	}
+	if len(t.clients) >= maxTrackedClients {
+		identity = untrackedClients
+		if c, ok := t.clients[identity]; ok {
+			return c
+		}
+	}
+	c := &clientCounts{}
+	t.clients[identity] = c
+	return c
+}
+
+// clientSummary describes the counts of a client for /clients
+type clientSummary struct {
+	Client   string `json:"client"`
+	Commands int64  `json:"commands"`
+	Gets     int64  `json:"gets"`
+	Sets     int64  `json:"sets"`
+	Bytes    int64  `json:"bytes_set"`
+}
+
+// list returns the counts of every client, most commands first
+func (t *clientTable) list() []clientSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clients := make([]clientSummary, 0, len(t.clients))
+	for identity, c := range t.clients {
+		clients = append(clients, clientSummary{
+			Client:   identity,
+			Commands: atomic.LoadInt64(&c.commands),
+			Gets:     atomic.LoadInt64(&c.gets),
+			Sets:     atomic.LoadInt64(&c.sets),
+			Bytes:    atomic.LoadInt64(&c.bytes),
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Commands != clients[j].Commands {
+			return clients[i].Commands > clients[j].Commands
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	return clients
+}
+
+// clientsHandler returns the operation counts of every client, by IP (ie:
+// GET /clients).
+func (s *Server) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.TrackClients {
+		http.Error(w, "client tracking is disabled", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(s.clients.list())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
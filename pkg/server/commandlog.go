@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
+)
+
+const (
+	// number of entries buffered in memory before new entries are dropped
+	commandLogQueueSize = 4096
+	// how often buffered entries are flushed to the file
+	commandLogFlushInterval = time.Second
+)
+
+// CommandLog is an append-only journal of the mutating commands (set, cas,
+// delete, incr/decr and their meta equivalents) applied to the cache.
+//
+// Each entry is written as a text protocol command, so the log is human
+// readable and can be replayed against a fresh server (see Replay) to
+// reproduce the state of the cache. Relative expiration times are converted
+// to absolute unix times and a successful cas is logged as a set, since cas
+// tokens are not preserved by a replay. An ms with tags or a stale grace is
+// logged as an ms, so the replayed entries can still be invalidated by their
+// tags and served stale for as long.
+//
+// Entries are queued and written by a background goroutine so logging never
+// blocks a connection. The log is lossy: entries are dropped (and counted in
+// 'command_log_dropped') when the queue is full, and anything not yet flushed
+// is lost if the process crashes.
+type CommandLog struct {
+	file    *os.File
+	entries chan []byte
+	done    chan struct{}
+}
+
+// NewCommandLog opens (or creates) the file at 'path' for appending and
+// starts the background writer.
+func NewCommandLog(path string) (*CommandLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &CommandLog{
+		file:    file,
+		entries: make(chan []byte, commandLogQueueSize),
+		done:    make(chan struct{}),
+	}
+	go l.writeLoop()
+	return l, nil
+}
+
+// writeLoop writes queued entries to the file until the log is closed,
+// flushing at least every commandLogFlushInterval.
+func (l *CommandLog) writeLoop() {
+	defer close(l.done)
+
+	writer := bufio.NewWriter(l.file)
+	ticker := time.NewTicker(commandLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-l.entries:
+			if !ok {
+				if err := writer.Flush(); err != nil {
+					log.Printf("CommandLog: flush failed: %s\n", err)
+				}
+				return
+			}
+			writer.Write(entry)
+		case <-ticker.C:
+			if err := writer.Flush(); err != nil {
+				log.Printf("CommandLog: flush failed: %s\n", err)
+			}
+		}
+	}
+}
+
+// Close flushes any queued entries and closes the file.
+// No entries may be logged after calling Close.
+func (l *CommandLog) Close() error {
+	close(l.entries)
+	<-l.done
+	return l.file.Close()
+}
+
+// append queues an entry for writing, dropping it if the queue is full.
+func (l *CommandLog) append(entry []byte) {
+	select {
+	case l.entries <- entry:
+	default:
+		StatsCommandLogDropped.Add(1)
+	}
+}
+
+// logSet records a set of 'key' (also used for a successful cas or ms).
+func (l *CommandLog) logSet(key string, value []byte, flags uint32, expTime int32) {
+	if l == nil {
+		return
+	}
+	header := fmt.Sprintf("%s %s %d %d %d%s", cmdSet, key, flags, absoluteExpTime(expTime), len(value), endOfLine)
+	entry := make([]byte, 0, len(header)+len(value)+len(endOfLine))
+	entry = append(entry, header...)
+	entry = append(entry, value...)
+	entry = append(entry, endOfLine...)
+	l.append(entry)
+}
+
+// logMetaSet records an ms of 'key' stored with options, keeping them (the
+// G flag of its tags and the X flag of its stale grace) so they are replayed
+// as well.
+func (l *CommandLog) logMetaSet(key string, value []byte, flags uint32, expTime int32, opts cache.SetOptions) {
+	if l == nil {
+		return
+	}
+	header := fmt.Sprintf("%s %s %d F%d T%d", cmdMetaSet, key, len(value), flags, absoluteExpTime(expTime))
+	if opts.Tags != nil {
+		header += " G" + strings.Join(opts.Tags, ",")
+	}
+	if opts.Grace > 0 {
+		header += fmt.Sprintf(" X%d", opts.Grace)
+	}
+	header += endOfLine
+	entry := make([]byte, 0, len(header)+len(value)+len(endOfLine))
+	entry = append(entry, header...)
+	entry = append(entry, value...)
+	entry = append(entry, endOfLine...)
+	l.append(entry)
+}
+
+// logDelete records a delete of 'key'.
+func (l *CommandLog) logDelete(key string) {
+	if l == nil {
+		return
+	}
+	l.append([]byte(fmt.Sprintf("%s %s%s", cmdDelete, key, endOfLine)))
+}
+
+// logIncr records an incr (or decr) of 'key' by 'delta'.
+func (l *CommandLog) logIncr(key string, delta uint64, incr bool) {
+	if l == nil {
+		return
+	}
+	cmd := cmdIncr
+	if !incr {
+		cmd = cmdDecr
+	}
+	l.append([]byte(fmt.Sprintf("%s %s %d%s", cmd, key, delta, endOfLine)))
+}
+
+// absoluteExpTime converts an expiration time relative to now into an
+// absolute unix time so it still holds when the log is replayed later.
+func absoluteExpTime(expTime int32) int32 {
+	now := time.Now().Unix()
+	exp := cache.ExpiresAt(expTime, now)
+	switch {
+	case exp == 0:
+		return 0
+	case exp <= now:
+		return -1
+	default:
+		return int32(exp)
+	}
+}
+
+// Replay sends every command of the command log read from 'r' to the
+// memcache server at 'address' and returns the number of commands that
+// failed (ie: an incr of a key that was since evicted).
+func Replay(r io.Reader, address string) (int, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// replies are read concurrently so neither side blocks on a full buffer
+	failures := make(chan int)
+	go func() {
+		failed := 0
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader)
+			if err != nil && err != ErrLineTooLong {
+				break
+			}
+			if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") ||
+				strings.HasPrefix(line, "SERVER_ERROR") || line == strings.TrimSuffix(replyNotFound, endOfLine) {
+				failed++
+			}
+		}
+		failures <- failed
+	}()
+
+	writer := bufio.NewWriter(conn)
+	if _, err := io.Copy(writer, r); err != nil {
+		return 0, err
+	}
+	writer.WriteString(cmdQuit + endOfLine)
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	return <-failures, nil
+}
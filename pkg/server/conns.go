@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// openConn is a client connection being handled, in the registry of open
+// connections (see /conns)
+type openConn struct {
+	conn        net.Conn
+	connectedAt time.Time
+	history     *commandHistory
+}
+
+// connRegistry holds the open client connections by remote address, so a
+// misbehaving client can be listed and disconnected (see /conns/kill).
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]openConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[string]openConn)}
+}
+
+// add registers a connection about to be handled, with its history of
+// commands (nil if disabled)
+func (r *connRegistry) add(conn net.Conn, history *commandHistory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[conn.RemoteAddr().String()] = openConn{conn: conn, connectedAt: time.Now(), history: history}
+}
+
+// remove unregisters a connection once it has been closed
+func (r *connRegistry) remove(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, conn.RemoteAddr().String())
+}
+
+// len returns the number of open connections
+func (r *connRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.conns)
+}
+
+// kill closes the connection of the address, returning false if there is
+// none, along with its last commands (see ConnHistory). The connection's
+// handler then stops as if reading from it had failed.
+func (r *connRegistry) kill(addr string) ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	open, ok := r.conns[addr]
+	if !ok {
+		return nil, false
+	}
+	// drained before closing, so the handler doesn't dump them too
+	history := open.history.drain()
+	open.conn.Close()
+	return history, true
+}
+
+// connSummary describes an open connection for /conns
+type connSummary struct {
+	Addr        string `json:"addr"`
+	ConnectedAt string `json:"connected_at"`
+	Seconds     int64  `json:"connected_seconds"`
+}
+
+// list returns the open connections, oldest first
+func (r *connRegistry) list() []connSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]connSummary, 0, len(r.conns))
+	for addr, open := range r.conns {
+		conns = append(conns, connSummary{
+			Addr:        addr,
+			ConnectedAt: open.connectedAt.UTC().Format(time.RFC3339),
+			Seconds:     int64(time.Since(open.connectedAt).Seconds()),
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].Seconds != conns[j].Seconds {
+			return conns[i].Seconds > conns[j].Seconds
+		}
+		return conns[i].Addr < conns[j].Addr
+	})
+	return conns
+}
+
+// connsHandler returns the open client connections (ie: GET /conns).
+func (s *Server) connsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.conns.list())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// connKillResult is the reply of /conns/kill
+type connKillResult struct {
+	Found   bool     `json:"found"`
+	History []string `json:"history,omitempty"`
+}
+
+// connsKillHandler closes the client connection of the `addr` query
+// parameter (ie: POST /conns/kill?addr=10.0.0.1:52311, as listed by /conns)
+// and returns whether it was found, with its last commands if ConnHistory is
+// set. The connection is closed even if a command is in flight, whose reply
+// is lost.
+func (s *Server) connsKillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	if addr == "" {
+		http.Error(w, "missing addr", http.StatusBadRequest)
+		return
+	}
+
+	history, found := s.conns.kill(addr)
+	if found {
+		StatsConnectionsKilled.Add(1)
+		s.logf("connsKillHandler: closed connection (%s)\n", addr)
+		s.logHistory(addr, history, "killed")
+	}
+
+	data, err := json.Marshal(connKillResult{Found: found, History: history})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
@@ -2,69 +2,184 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sfjuggernaut/go-memcached/pkg/cache"
 )
 
 const (
-	cmdCas    = "cas"
-	cmdDelete = "delete"
-	cmdGet    = "get"
-	cmdGets   = "gets"
-	cmdQuit   = "quit"
-	cmdSet    = "set"
-	cmdHire   = "hireeric?"
+	cmdCas       = "cas"
+	cmdDecr      = "decr"
+	cmdDelete    = "delete"
+	cmdGet       = "get"
+	cmdGets      = "gets"
+	cmdIncr      = "incr"
+	cmdQuit      = "quit"
+	cmdSet       = "set"
+	cmdStats     = "stats"
+	cmdVerbosity = "verbosity"
+	cmdHire      = "hireeric?"
 )
 
 const (
-	endOfLine      = "\r\n"
-	replyDeleted   = "DELETED\r\n"
-	replyEnd       = "END\r\n"
-	replyError     = "ERROR\r\n"
-	replyExists    = "EXISTS\r\n"
-	replyNotFound  = "NOT_FOUND\r\n"
-	replyNotStored = "NOT_STORED\r\n"
-	replyStored    = "STORED\r\n"
-	replyYes       = "totes\r\n"
+	endOfLine         = "\r\n"
+	replyDeleted      = "DELETED\r\n"
+	replyEnd          = "END\r\n"
+	replyError        = "ERROR\r\n"
+	replyExists       = "EXISTS\r\n"
+	replyNotFound     = "NOT_FOUND\r\n"
+	replyNotStored    = "NOT_STORED\r\n"
+	replyOutOfMemory  = "SERVER_ERROR out of memory storing object\r\n"
+	replyReadOnly     = "SERVER_ERROR read-only replica\r\n"
+	replyTimeout      = "SERVER_ERROR timeout\r\n"
+	replyTooManyConns = "SERVER_ERROR too many connections\r\n"
+	replyOverloaded   = "SERVER_ERROR overloaded\r\n"
+	replyOK           = "OK\r\n"
+	replyStored       = "STORED\r\n"
+	replyYes          = "totes\r\n"
 )
 
 var (
 	ErrInsufficientArgs = errors.New("Insufficient args")
+	ErrLineTooLong      = errors.New("line is too long")
+	ErrBadDataChunk     = errors.New("bad data chunk")
+	ErrInvalidDelta     = errors.New("invalid numeric delta argument")
+	ErrKeyTooLong       = fmt.Errorf("key is too long (max is %d bytes)", maxKeyLength)
+	ErrTooManyKeys      = errors.New("too many keys")
+	ErrNonNumericValue  = errors.New("cannot increment or decrement non-numeric value")
+	ErrBadToken         = errors.New("bad token in command line format")
+	ErrInvalidLevel     = errors.New("invalid verbosity level")
+	ErrBadModifier      = errors.New("bad command modifier")
 )
 
+// dataBlockError is a framing error of a data block. Every cause is replied
+// to as a bad data chunk (like memcached), but counted by its own stat so a
+// client with a framing bug can be told apart from one sending bad commands
+// (see StatsErrNumBadCommand).
+type dataBlockError struct {
+	cause string
+	stat  *expvar.Int
+}
+
+func (e *dataBlockError) Error() string {
+	return ErrBadDataChunk.Error()
+}
+
+var (
+	// the length of the data block (or number of mcas items) is not a valid number
+	errDataLength = &dataBlockError{cause: "invalid length", stat: StatsErrNumDataLength}
+	// the data block isn't followed by \r\n, ie: it's longer than its length
+	errDataTerminator = &dataBlockError{cause: "missing \\r\\n after data", stat: StatsErrNumDataTerminator}
+	// an mcas item line is malformed
+	errDataItem = &dataBlockError{cause: "invalid item line", stat: StatsErrNumDataItem}
+)
+
+// mutatingCommands are the commands rejected by a read-only server
+var mutatingCommands = map[string]bool{
+	cmdCas:            true,
+	cmdDecr:           true,
+	cmdDelete:         true,
+	cmdIncr:           true,
+	cmdSet:            true,
+	cmdMetaArithmetic: true,
+	cmdMetaDelete:     true,
+	cmdMetaSet:        true,
+	cmdMultiCas:       true,
+}
+
 // Request stores the information for a single client request
 type Request struct {
 	cmd  string
 	keys []string
+	// the keys as sent by the client, without the connection's namespace
+	// (see cmdNamespace)
+	clientKeys []string
+	// any remaining arguments for commands that don't take keys (ie: stats)
+	args []string
 	// flags is 32bits to support memcached 1.2.1
 	flags     uint32
 	expTime   int32
 	n         int
 	cas       uint64
-	dataBlock string
-	err       error
+	delta     uint64
+	dataBlock []byte
+	// items to compare-and-swap for mcas
+	items []cache.CasItem
+	// time budget of a get or gets (see deadlineModifier), 0 is none
+	timeout time.Duration
+	err     error
 }
 
-// parseRequest verifies and parses the incoming request
-func parseRequest(line string) (r Request, err error) {
-	if len(line) == 0 {
+// deadlineModifier attaches a time budget in milliseconds to a get or gets
+// (ie: "get@50 k1 k2 k3"). Keys still to be looked up once the budget is
+// spent are abandoned and `SERVER_ERROR timeout` is replied instead of any
+// value. This is best-effort: the budget is checked between keys, so it only
+// means something for large multi-key gets, and starts once the server
+// begins executing the command (not when it was sent).
+const deadlineModifier = '@'
+
+// parseModifier strips a deadline modifier from the command of 'r' (see
+// deadlineModifier).
+func (r *Request) parseModifier() error {
+	i := strings.IndexByte(r.cmd, deadlineModifier)
+	if i < 0 {
+		return nil
+	}
+	ms, err := strconv.Atoi(r.cmd[i+1:])
+	r.cmd = r.cmd[:i]
+	if err != nil || ms <= 0 || (r.cmd != cmdGet && r.cmd != cmdGets) {
+		return ErrBadModifier
+	}
+	r.timeout = time.Duration(ms) * time.Millisecond
+	return nil
+}
+
+// isSeparator reports whether 'c' separates the tokens of a command line
+func isSeparator(c rune) bool {
+	return c == ' ' || c == '\t'
+}
+
+// splitArgs splits a command line into its tokens.
+// Any run of spaces and tabs is a single separator and leading or trailing
+// whitespace is ignored, so "get  k1\tk2 " has the tokens "get", "k1" and
+// "k2". Every command is tokenized this way.
+func splitArgs(line string) []string {
+	return strings.FieldsFunc(line, isSeparator)
+}
+
+// parseRequest verifies and parses the incoming request, its verb resolved
+// from 'aliases' first (see CommandAliases)
+func parseRequest(line string, aliases commandAliases) (r Request, err error) {
+	args := splitArgs(line)
+	if len(args) == 0 {
 		err = errors.New("no command provided")
 		return
 	}
-
-	args := strings.Split(line, " ")
-	r.cmd = args[0]
+	r.cmd = aliases.resolve(args[0])
+	if err = r.parseModifier(); err != nil {
+		return
+	}
 
 	switch r.cmd {
 	case cmdCas:
-		r.keys = make([]string, 1)
-		_, err = fmt.Sscanf(line, "%s%s%d%d%d%d", &r.cmd, &r.keys[0], &r.flags, &r.expTime, &r.n, &r.cas)
+		if len(args) < 6 {
+			err = ErrInsufficientArgs
+			return
+		}
+		if err = r.parseStorageArgs(args); err != nil {
+			return
+		}
+		if r.cas, err = strconv.ParseUint(args[5], 10, 64); err != nil {
+			err = ErrBadToken
+		}
 	case cmdDelete:
 		if len(args) < 2 {
 			err = ErrInsufficientArgs
@@ -72,122 +187,594 @@ func parseRequest(line string) (r Request, err error) {
 		}
 		r.keys = make([]string, 1)
 		r.keys[0] = args[1]
+	case cmdIncr, cmdDecr:
+		if len(args) < 3 {
+			err = ErrInsufficientArgs
+			return
+		}
+		r.keys = []string{args[1]}
+		if r.delta, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+			err = ErrInvalidDelta
+		}
+	case cmdMetaArithmetic, cmdMetaDelete, cmdMetaGet:
+		if len(args) < 2 {
+			err = ErrInsufficientArgs
+			return
+		}
+		r.keys = []string{args[1]}
+		r.args = args[2:]
+	case cmdMetaSet:
+		if len(args) < 3 {
+			err = ErrInsufficientArgs
+			return
+		}
+		r.keys = []string{args[1]}
+		if r.n, err = strconv.Atoi(args[2]); err != nil || r.n < 0 {
+			err = errDataLength
+		}
+		r.args = args[3:]
 	case cmdGet, cmdGets:
-		r.keys = make([]string, len(args)-1)
-		for i := 0; i < len(args)-1; i++ {
-			r.keys[i] = args[i+1]
+		if len(args) < 2 {
+			err = ErrInsufficientArgs
+			return
 		}
+		// the keys are the rest of the line, not copied as nothing else uses it
+		r.keys = args[1:]
 	case cmdSet:
-		r.keys = make([]string, 1)
-		_, err = fmt.Sscanf(line, "%s%s%d%d%d", &r.cmd, &r.keys[0], &r.flags, &r.expTime, &r.n)
+		if len(args) < 5 {
+			err = ErrInsufficientArgs
+			return
+		}
+		err = r.parseStorageArgs(args)
+	case cmdMultiCas:
+		if len(args) < 2 {
+			err = ErrInsufficientArgs
+			return
+		}
+		if r.n, err = strconv.Atoi(args[1]); err != nil || r.n <= 0 || r.n > maxMultiCasItems {
+			err = errDataLength
+		}
+	case cmdStats:
+		r.args = args[1:]
+	case cmdNamespace:
+		if len(args) > 2 {
+			err = ErrBadToken
+			return
+		}
+		r.args = args[1:]
+	case cmdVerbosity:
+		if len(args) < 2 {
+			err = ErrInsufficientArgs
+			return
+		}
+		if r.n, err = strconv.Atoi(args[1]); err != nil {
+			err = ErrInvalidLevel
+		}
 	}
 	return
 }
 
-// continually consumes input from the connection
-func connReader(scanner *bufio.Scanner, requests chan Request) {
-	var line string
+// parseStorageArgs parses the "<key> <flags> <exptime> <bytes>" arguments
+// shared by `set` and `cas` (args[0] is the command).
+// Every argument must be a complete number, so "5abc" is rejected instead of
+// being read as 5.
+func (r *Request) parseStorageArgs(args []string) error {
+	r.keys = []string{args[1]}
+	flags, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return ErrBadToken
+	}
+	expTime, err := strconv.ParseInt(args[3], 10, 32)
+	if err != nil {
+		return ErrBadToken
+	}
+	n, err := strconv.Atoi(args[4])
+	if err != nil || n < 0 {
+		return errDataLength
+	}
+	r.flags, r.expTime, r.n = uint32(flags), int32(expTime), n
+	return nil
+}
+
+// readLine reads a single command line from the connection, stripping the
+// trailing "\r\n". Lines longer than maxLineLength are discarded and
+// ErrLineTooLong is returned.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if len(line)+len(chunk) > maxLineLength {
+				// swallow the rest of the line so we can sync up with the next command
+				for err == bufio.ErrBufferFull {
+					_, err = reader.ReadSlice('\n')
+				}
+				if err != nil {
+					return "", err
+				}
+				return "", ErrLineTooLong
+			}
+			line = append(line, chunk...)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		break
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+// readDataBlock reads exactly 'n' bytes of data followed by "\r\n".
+// The data is read directly into a buffer of size 'n' so a large value
+// is only allocated once.
+//
+// A connection closed before the terminator is io.ErrUnexpectedEOF, even
+// with all 'n' bytes read, so a value that was never fully framed is not
+// stored.
+func readDataBlock(reader *bufio.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	terminator, err := reader.Peek(len(endOfLine))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(terminator) != endOfLine {
+		// swallow the rest of the line so we can sync up with the next command
+		if _, err := readLine(reader); err != nil && err != ErrLineTooLong {
+			return nil, err
+		}
+		return nil, errDataTerminator
+	}
+	reader.Discard(len(endOfLine))
+	return data, nil
+}
+
+// how long a connection is kept open after `quit` for the client to read
+// the last replies and close its side
+const quitLinger = time.Second
+
+// closeAfterQuit half-closes the connection after `quit`, sending a FIN once
+// every reply has been written, then discards anything else the client sends
+// until it closes its side (or quitLinger has passed).
+//
+// Closing outright with commands pipelined after `quit` still unread makes
+// the kernel reset the connection, which can discard replies the client has
+// yet to read.
+func (server *Server) closeAfterQuit(conn net.Conn, requests chan Request) {
+	if c, ok := unwrapConn(conn).(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
 
+	// unblocks connReader, which stops once reading fails
+	timer := time.AfterFunc(quitLinger, func() { conn.Close() })
+	defer timer.Stop()
 	for {
-		// scan for cmd
-		if valid := scanner.Scan(); !valid {
-			// done scanning for this connection
-			requests <- Request{err: io.EOF}
+		select {
+		case request := <-requests:
+			if isConnDone(request.err) {
+				return
+			}
+		case <-server.quit:
+			return
+		}
+	}
+}
+
+// readError is a failure reading from the connection other than the client
+// closing it (ie: a reset, a read timeout or the connection being killed),
+// after which nothing more can be read
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+// connError returns io.EOF if reading failed because the client closed the
+// connection (even in the middle of a request), or a readError otherwise
+func connError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return &readError{err: err}
+}
+
+// isConnDone reports whether the error ends the reading of the connection
+// (see connError)
+func isConnDone(err error) bool {
+	_, ok := err.(*readError)
+	return ok || err == io.EOF
+}
+
+// isDataBlockError reports whether the error is a framing error of a data
+// block, after which reading the connection can go on
+func isDataBlockError(err error) bool {
+	_, ok := err.(*dataBlockError)
+	return ok
+}
+
+// desyncError is a framing error in the middle of a request (ie: a malformed
+// item of an mcas), after which the rest of the request can't be told apart
+// from the commands following it. It is replied to like the dataBlockError
+// it wraps, then the connection is closed without running anything else the
+// client sent.
+type desyncError struct {
+	*dataBlockError
+}
+
+// continually consumes input from the connection.
+//
+// Requests are read strictly one after the other: the data block of a
+// storage command (or the items of an mcas) is read whole before the next
+// command line, so a connection has at most one command waiting for its data
+// and pipelining many command lines without their data blocks can't pile up
+// pending requests. Reading must stay serialized this way. With a 'timer',
+// a data block that doesn't arrive in time abandons the connection instead
+// of blocking the reader indefinitely. With a 'releaser', the reader is
+// replaced whenever the connection idles long enough to release it.
+func connReader(reader *bufio.Reader, requests chan Request, timer *dataBlockTimer, releaser *bufferReleaser, aliases commandAliases) {
+	for {
+		var err error
+		if reader, err = releaser.await(reader); err != nil {
+			// done reading for this connection
+			requests <- Request{err: connError(err)}
 			break
 		}
-		line = scanner.Text()
-		if err := scanner.Err(); err != nil {
+
+		// read cmd
+		line, err := readLine(reader)
+		if err == ErrLineTooLong {
 			requests <- Request{err: err}
 			continue
 		}
-		request, err := parseRequest(line)
+		if err != nil {
+			// done reading for this connection
+			requests <- Request{err: connError(err)}
+			break
+		}
+		request, err := parseRequest(line, aliases)
 		if err != nil {
 			request.err = err
 			requests <- request
 			continue
 		}
 
-		// scan for data block if SET or CAS
-		if request.cmd == cmdSet || request.cmd == cmdCas {
-			// wait for data block
-			if valid := scanner.Scan(); !valid {
-				// done scanning for this connection
-				requests <- Request{err: io.EOF}
-				break
+		// read data block if SET, CAS or MS
+		if request.cmd == cmdSet || request.cmd == cmdCas || request.cmd == cmdMetaSet {
+			if request.n < 0 || request.n > maxValueLength {
+				requests <- Request{err: errDataLength}
+				continue
 			}
-			data := scanner.Text()
-			if err := scanner.Err(); err != nil {
+			timer.start()
+			data, err := readDataBlock(reader, request.n)
+			expired := timer.stop(err)
+			if isDataBlockError(err) {
 				requests <- Request{err: err}
 				continue
 			}
-			if len(data) > request.n {
-				requests <- Request{err: errors.New("data block provided is too long")}
-				continue
+			if expired {
+				// done reading for this connection, the data block never arrived
+				StatsErrNumDataTimeout.Add(1)
+				requests <- Request{err: connError(err)}
+				break
+			}
+			if err != nil {
+				// done reading for this connection, in the middle of a data block
+				StatsErrNumDataTruncated.Add(1)
+				requests <- Request{err: connError(err)}
+				break
 			}
 			request.dataBlock = data
 		}
+
+		// read every item if MCAS
+		if request.cmd == cmdMultiCas {
+			timer.start()
+			items, err := readMultiCasItems(reader, request.n)
+			expired := timer.stop(err)
+			if dataErr, ok := err.(*dataBlockError); ok {
+				// whatever follows is discarded, rather than read as commands
+				requests <- Request{err: &desyncError{dataErr}}
+				continue
+			}
+			if expired {
+				// done reading for this connection, the items never arrived
+				StatsErrNumDataTimeout.Add(1)
+				requests <- Request{err: connError(err)}
+				break
+			}
+			if err != nil {
+				// done reading for this connection, in the middle of the items
+				StatsErrNumDataTruncated.Add(1)
+				requests <- Request{err: connError(err)}
+				break
+			}
+			request.items = items
+			request.keys = make([]string, len(items))
+			for i, item := range items {
+				request.keys[i] = item.Key
+			}
+		}
 		requests <- request
 	}
 }
 
+// writeValue writes a VALUE line followed by its data block.
+// The value is the cache's own (immutable) slice rather than a copy. Values
+// larger than the space left in the writer's buffer are streamed straight
+// to the connection after flushing the header, instead of being copied
+// through the buffer.
+func writeValue(writer *bufio.Writer, header string, value []byte) {
+	writer.WriteString(header)
+	if len(value) > writer.Available() {
+		writer.Flush()
+	}
+	writer.Write(value)
+	writer.WriteString(endOfLine)
+}
+
+// validKey returns false if the key is too long. The length is the only
+// rule every protocol shares: the text protocol's keys can't hold
+// whitespace as they are space separated tokens of the command line, which
+// parseRequest already enforces.
+func validKey(key string) bool {
+	return len(key) <= maxKeyLength
+}
+
+// validKeys returns false if any of the keys are too long
+func validKeys(keys []string) bool {
+	for _, key := range keys {
+		if !validKey(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeClientError replies with a CLIENT_ERROR for 'err', counting it in
+// the total number of client errors and in 'reason' (if not nil).
+func writeClientError(writer *bufio.Writer, reason *expvar.Int, err error) {
+	writer.WriteString(fmt.Sprintf("CLIENT_ERROR %s%s", err, endOfLine))
+	StatsErrNumClientErrors.Add(1)
+	if reason != nil {
+		reason.Add(1)
+	}
+}
+
+// writeUnsupported replies to a command the server does not support
+func (server *Server) writeUnsupported(writer *bufio.Writer, cmd string) {
+	server.logAt(verbosityConnections, "handleConnection: unsupported cmd: %s\n", cmd)
+	writer.WriteString(replyError)
+	writer.Flush()
+	StatsErrNumUnsupportedCmds.Add(1)
+}
+
 // Loop waiting for new commands to be received until either the
 // client closes the connection, we pass our deadline, or receive
 // quit signal.
 //
 // Currently only supports the text protocol.
 func (server *Server) handleConnection(conn net.Conn) {
+	// bounds the wait for data blocks (see DataBlockTimeout)
+	var timer *dataBlockTimer
+	// releases the buffers of the connection while idle (see IdleBufferRelease)
+	var releaser *bufferReleaser
+	var released chan struct{}
+	if server.IdleTimeout > 0 || server.DataBlockTimeout > 0 || server.IdleBufferRelease > 0 {
+		idle := &idleConn{Conn: conn}
+		if server.IdleTimeout > 0 {
+			idle.timeout = jitter(server.IdleTimeout, server.IdleTimeoutJitter)
+		}
+		if server.DataBlockTimeout > 0 {
+			timer = &dataBlockTimer{conn: idle, timeout: server.DataBlockTimeout}
+		}
+		if server.IdleBufferRelease > 0 {
+			releaser = newBufferReleaser(idle, server.IdleBufferRelease, &server.buffers, server.ReadBufferSize)
+			released = releaser.released
+		}
+		conn = idle
+	}
+	var reader *bufio.Reader
+	if releaser != nil {
+		reader = server.buffers.reader(conn, server.ReadBufferSize)
+	} else {
+		reader = bufio.NewReaderSize(conn, server.ReadBufferSize)
+	}
+	if server.adminListener != nil && isHTTPRequest(reader) {
+		// admin HTTP sharing the memcache port, the HTTP server owns the connection now
+		if !server.adminListener.handoff(&sniffedConn{Conn: conn, reader: reader}) {
+			conn.Close()
+		}
+		return
+	}
 	defer conn.Close()
+	// last commands of the connection (see ConnHistory)
+	history := newCommandHistory(server.ConnHistory)
+	server.conns.add(conn, history)
+	defer server.conns.remove(conn)
+	// operation counts of the client (see TrackClients)
+	var counts *clientCounts
+	if server.TrackClients {
+		counts = server.clients.counts(remoteIP(conn))
+	}
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	scanner := bufio.NewScanner(reader)
+	// keeps the result of each command for the access log (see AccessLog)
+	var recorder *replyRecorder
+	var replies io.Writer = conn
+	var addr string
+	if server.AccessLog != nil {
+		recorder = &replyRecorder{Writer: conn}
+		replies = recorder
+		addr = conn.RemoteAddr().String()
+	}
+	var writer *bufio.Writer
+	if releaser != nil {
+		writer = server.buffers.writer(replies, server.WriteBufferSize)
+		defer func() {
+			// the reader is left to connReader, which may still be using it
+			if writer != nil {
+				writer.Reset(nil)
+				server.buffers.writers.Put(writer)
+			}
+		}()
+	} else {
+		writer = bufio.NewWriterSize(replies, server.WriteBufferSize)
+	}
 	var reply string
+	// prepended to every key of the connection (see cmdNamespace)
+	var namespace string
+	// VALUE line of single key gets, reused by each (see writeSingleGet)
+	header := make([]byte, 0, 64)
 
+	connectedAt := time.Now()
+	// number of commands received, for the connection's log lines
+	served := 0
 	requests := make(chan Request)
-	go connReader(scanner, requests)
+	go connReader(reader, requests, timer, releaser, server.aliases)
 
 Loop:
 	for {
 		select {
+		case <-released:
+			// idle, taken again by the next request
+			writer.Reset(nil)
+			server.buffers.writers.Put(writer)
+			writer = nil
 		case request := <-requests:
+			if writer == nil {
+				writer = server.buffers.writer(replies, server.WriteBufferSize)
+			}
 			if request.err == io.EOF {
 				// client closed the connection
-				log.Printf("handleConnection: client (%s) closed the connection\n", conn.RemoteAddr())
+				server.logAt(verbosityConnections, "handleConnection: client (%s) closed the connection %s\n", conn.RemoteAddr(), connLifetime(connectedAt, served))
+				break Loop
+			}
+			if readErr, ok := request.err.(*readError); ok {
+				server.logAt(verbosityConnections, "handleConnection: reading from client (%s) failed %s: %s\n", conn.RemoteAddr(), connLifetime(connectedAt, served), readErr.err)
+				StatsConnectionReadErrors.Add(1)
+				server.logHistory(conn.RemoteAddr().String(), history.drain(), "reading failed")
 				break Loop
 			}
+			served++
 			if request.err != nil {
-				reply = fmt.Sprintf("CLIENT_ERROR %s%s", request.err, endOfLine)
-				writer.WriteString(reply)
+				history.record(request)
+				server.logHistory(conn.RemoteAddr().String(), history.drain(), "invalid command")
+				if desyncErr, ok := request.err.(*desyncError); ok {
+					server.logAt(verbosityConnections, "handleConnection: client (%s) sent a bad data block, closing the connection: %s\n", conn.RemoteAddr(), desyncErr.cause)
+					desyncErr.stat.Add(1)
+					writeClientError(writer, StatsErrNumBadDataChunk, request.err)
+					writer.Flush()
+					server.closeAfterQuit(conn, requests)
+					break Loop
+				}
+				if dataErr, ok := request.err.(*dataBlockError); ok {
+					server.logAt(verbosityConnections, "handleConnection: client (%s) sent a bad data block: %s\n", conn.RemoteAddr(), dataErr.cause)
+					dataErr.stat.Add(1)
+					writeClientError(writer, StatsErrNumBadDataChunk, request.err)
+				} else {
+					server.logAt(verbosityConnections, "handleConnection: client (%s) sent a bad command: %s\n", conn.RemoteAddr(), request.err)
+					if request.err == ErrLineTooLong {
+						StatsErrNumLineTooLong.Add(1)
+					}
+					writeClientError(writer, StatsErrNumBadCommand, request.err)
+				}
 				writer.Flush()
 				continue
 			}
 
+			server.logAt(verbosityCommands, "handleConnection: client (%s) sent cmd: %s\n", conn.RemoteAddr(), request.cmd)
+			history.record(request)
+
 			if request.cmd == cmdQuit {
-				// close connection for the client
+				// close connection for the client, once it has every reply
+				server.logAt(verbosityConnections, "handleConnection: client (%s) quit %s\n", conn.RemoteAddr(), connLifetime(connectedAt, served))
+				writer.Flush()
+				server.closeAfterQuit(conn, requests)
 				break Loop
 			}
 
-			// XXX need to support multiple keys
-			for i := 0; i < len(request.keys); i++ {
-				if len(request.keys[i]) > maxKeyLength {
-					reply = fmt.Sprintf("CLIENT_ERROR key is too long (max is 250 bytes)%s", endOfLine)
-					writer.WriteString(reply)
-					writer.Flush()
-					continue
+			// never shed nor rejected, so the connection's keys can't
+			// escape its namespace
+			if request.cmd == cmdNamespace {
+				if len(request.args) == 1 && !validKey(request.args[0]) {
+					writeClientError(writer, StatsErrNumKeyTooLong, ErrKeyTooLong)
+				} else {
+					namespace = strings.Join(request.args, "")
+					writer.WriteString(replyOK)
 				}
+				writer.Flush()
+				continue
+			}
+			request.withNamespace(namespace)
+			if server.DedupeGetKeys && (request.cmd == cmdGet || request.cmd == cmdGets) {
+				request.dedupeKeys()
 			}
 
+			// every command is validated here before being dispatched,
+			// a single invalid key rejects the entire request
+			if !validKeys(request.keys) {
+				writeClientError(writer, StatsErrNumKeyTooLong, ErrKeyTooLong)
+				writer.Flush()
+				continue
+			}
+			if (request.cmd == cmdGet || request.cmd == cmdGets) &&
+				server.MaxKeysPerGet > 0 && len(request.keys) > server.MaxKeysPerGet {
+				writeClientError(writer, StatsErrNumBadCommand, ErrTooManyKeys)
+				writer.Flush()
+				continue
+			}
+			if server.ReadOnly && mutatingCommands[request.cmd] {
+				StatsErrNumReadOnly.Add(1)
+				writer.WriteString(replyReadOnly)
+				writer.Flush()
+				continue
+			}
+			if server.ShedLatency > 0 && server.shed.shedding() && !server.critical(request.cmd) {
+				StatsErrNumOverloaded.Add(1)
+				writer.WriteString(replyOverloaded)
+				writer.Flush()
+				continue
+			}
+			var start time.Time
+			if server.ShedLatency > 0 {
+				start = time.Now()
+			}
+			for _, key := range request.keys {
+				server.hotKeys.record(key)
+				server.watch.publish(request.cmd, key)
+			}
+			counts.record(request)
+			audited := recorder != nil && mutatingCommands[request.cmd]
+			var receivedAt time.Time
+			if audited {
+				recorder.reset()
+				receivedAt = time.Now()
+			}
+
+			commands := cache.NewCommands(server.Cache)
 			switch request.cmd {
 			case cmdCas:
-				_, _, entryCas, err := server.Cache.Get(request.keys[0])
+				_, err := commands.Cas(request.keys[0], request.dataBlock, request.flags, request.expTime, request.cas)
 				if err == cache.ErrCacheMiss {
 					reply = replyNotFound
+				} else if err == cache.ErrCasConflict {
+					reply = replyExists
+				} else if err == cache.ErrOutOfMemory {
+					reply = replyOutOfMemory
 				} else if err != nil {
 					reply = replyNotStored
-				} else if request.cas != entryCas {
-					reply = replyExists
 				} else {
-					server.Cache.Add(request.keys[0], request.dataBlock, request.flags)
+					server.CommandLog.logSet(request.keys[0], request.dataBlock, request.flags, request.expTime)
 					reply = replyStored
 				}
 				writer.WriteString(reply)
@@ -195,10 +782,13 @@ Loop:
 				StatsNumCas.Add(1)
 
 			case cmdDelete:
-				err := server.Cache.Delete(request.keys[0])
-				if err != nil {
+				err := commands.Delete(request.keys[0])
+				if err == cache.ErrCacheMiss && server.IdempotentDelete {
+					reply = replyDeleted
+				} else if err != nil {
 					reply = replyNotFound
 				} else {
+					server.CommandLog.logDelete(request.keys[0])
 					reply = replyDeleted
 				}
 				writer.WriteString(reply)
@@ -206,49 +796,134 @@ Loop:
 				StatsNumDelete.Add(1)
 
 			case cmdGet:
-				for _, key := range request.keys {
-					value, flags, _, err := server.Cache.Get(key)
-					if err == nil {
-						reply = fmt.Sprintf("VALUE %s %d %d%s%s%s", key, flags, len(value), endOfLine, value, endOfLine)
-						writer.WriteString(reply)
-					}
+				if len(request.keys) == 1 {
+					header = writeSingleGet(writer, commands, request.keys[0], request.clientKeys[0], false, header)
+					StatsNumGet.Add(1)
+					break
 				}
-				writer.WriteString(replyEnd)
-				writer.Flush()
+				results, ok := server.getItemsWithin(commands, request.keys, request.timeout)
+				if !ok {
+					StatsErrNumTimeouts.Add(1)
+					writer.WriteString(replyTimeout)
+					writer.Flush()
+					StatsNumGet.Add(1)
+					break
+				}
+				writeGetReply(writer, conn, request.clientKeys, results, false)
 				StatsNumGet.Add(1)
 
 			case cmdGets:
-				for _, key := range request.keys {
-					value, flags, cas, err := server.Cache.Get(key)
-					if err == nil {
-						reply = fmt.Sprintf("VALUE %s %d %d %d%s%s%s", key, flags, len(value), cas, endOfLine, value, endOfLine)
-						writer.WriteString(reply)
-					}
+				if len(request.keys) == 1 {
+					header = writeSingleGet(writer, commands, request.keys[0], request.clientKeys[0], true, header)
+					StatsNumGets.Add(1)
+					break
 				}
-				writer.WriteString(replyEnd)
-				writer.Flush()
+				results, ok := server.getItemsWithin(commands, request.keys, request.timeout)
+				if !ok {
+					StatsErrNumTimeouts.Add(1)
+					writer.WriteString(replyTimeout)
+					writer.Flush()
+					StatsNumGets.Add(1)
+					break
+				}
+				writeGetReply(writer, conn, request.clientKeys, results, true)
 				StatsNumGets.Add(1)
 
 			case cmdSet:
-				server.Cache.Add(request.keys[0], request.dataBlock, request.flags)
-				reply = replyStored
+				if _, err := commands.Set(request.keys[0], request.dataBlock, request.flags, request.expTime); err != nil {
+					reply = replyOutOfMemory
+				} else {
+					server.CommandLog.logSet(request.keys[0], request.dataBlock, request.flags, request.expTime)
+					reply = replyStored
+				}
 				writer.WriteString(reply)
 				writer.Flush()
 				StatsNumSet.Add(1)
 
+			case cmdIncr, cmdDecr:
+				var value uint64
+				var err error
+				if request.cmd == cmdIncr {
+					value, _, err = commands.Incr(request.keys[0], request.delta)
+				} else {
+					value, _, err = commands.Decr(request.keys[0], request.delta)
+				}
+				switch err {
+				case nil:
+					server.CommandLog.logIncr(request.keys[0], request.delta, request.cmd == cmdIncr)
+					writer.WriteString(fmt.Sprintf("%d%s", value, endOfLine))
+				case cache.ErrCacheMiss:
+					writer.WriteString(replyNotFound)
+				case cache.ErrNotANumber:
+					writeClientError(writer, nil, ErrNonNumericValue)
+				default:
+					writer.WriteString(fmt.Sprintf("SERVER_ERROR %s%s", err, endOfLine))
+				}
+				writer.Flush()
+				if request.cmd == cmdIncr {
+					StatsNumIncr.Add(1)
+				} else {
+					StatsNumDecr.Add(1)
+				}
+
+			case cmdMetaArithmetic:
+				server.handleMetaArithmetic(writer, request)
+
+			case cmdMetaDelete:
+				server.handleMetaDelete(writer, request)
+
+			case cmdMetaGet:
+				server.handleMetaGet(writer, request)
+
+			case cmdMetaSet:
+				server.handleMetaSet(writer, request)
+
+			case cmdMultiCas:
+				server.handleMultiCas(writer, request)
+
+			case cmdStats:
+				server.writeStats(writer, request.args)
+
+			case cmdVerbosity:
+				SetVerbosity(request.n)
+				writer.WriteString(replyOK)
+				writer.Flush()
+
 			case cmdHire:
+				if server.DisableEasterEgg {
+					server.writeUnsupported(writer, request.cmd)
+					break
+				}
 				writer.WriteString(replyYes)
 				writer.Flush()
 
 			default:
-				log.Println("handleConnection: unsupported cmd:", request.cmd)
-				reply = replyError
-				writer.WriteString(reply)
-				writer.Flush()
-				StatsErrNumUnsupportedCmds.Add(1)
+				server.writeUnsupported(writer, request.cmd)
+			}
+			if audited {
+				server.AccessLog.log(addr, receivedAt, request, recorder.result())
+			}
+			if server.ShedLatency > 0 {
+				if avg := server.shed.record(time.Since(start), server.ShedLatency); avg > 0 {
+					server.logAt(verbosityQuiet, "Server: average command latency (%s) over (%s), shedding load\n", avg, server.ShedLatency)
+				}
+			}
+
+			// recycle old connections between commands, once the reply is sent
+			if server.MaxConnLifetime > 0 && time.Since(connectedAt) > server.MaxConnLifetime {
+				server.logAt(verbosityConnections, "handleConnection: closing connection (%s) past its max lifetime %s\n", conn.RemoteAddr(), connLifetime(connectedAt, served))
+				StatsConnectionsRecycled.Add(1)
+				break Loop
 			}
 		case <-server.quit:
+			server.logAt(verbosityConnections, "handleConnection: closing connection (%s) as the server stops %s\n", conn.RemoteAddr(), connLifetime(connectedAt, served))
 			break Loop
 		}
 	}
 }
+
+// connLifetime describes how long a connection has been open and the number
+// of commands it sent, for its log lines (ie: "after (1.5s) and (42) commands")
+func connLifetime(connectedAt time.Time, served int) string {
+	return fmt.Sprintf("after (%s) and (%d) commands", time.Since(connectedAt).Round(time.Millisecond), served)
+}
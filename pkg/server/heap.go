@@ -0,0 +1,55 @@
+package server
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
+)
+
+// how often the heap is compared against MaxHeap
+const heapCheckInterval = time.Second
+
+// heapWatcher evicts entries whenever the heap in use grows past 'MaxHeap',
+// until the server is stopped (see MaxHeap).
+func (s *Server) heapWatcher() {
+	defer s.wg.Done()
+
+	evicter, ok := s.Cache.(cache.Evicter)
+	if !ok {
+		s.logAt(verbosityQuiet, "Server: cache does not support eviction, ignoring MaxHeap\n")
+		return
+	}
+
+	ticker := time.NewTicker(heapCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkHeap(evicter)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// checkHeap evicts as many bytes as the heap in use is over 'MaxHeap'.
+//
+// Entries take more memory than the bytes they are accounted for, so this
+// undershoots and the next checks evict some more. A garbage collection is
+// forced after evicting, so the next check sees the memory actually freed
+// rather than evicting again for garbage that is yet to be collected.
+func (s *Server) checkHeap(evicter cache.Evicter) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapInuse <= s.MaxHeap {
+		return
+	}
+
+	evicted := evicter.Evict(stats.HeapInuse - s.MaxHeap)
+	StatsHeapLimitEvictions.Add(1)
+	StatsHeapLimitEvictedBytes.Add(int64(evicted))
+	s.logAt(verbosityConnections, "Server: heap in use (%d) over max heap (%d), evicted (%d) bytes\n", stats.HeapInuse, s.MaxHeap, evicted)
+	runtime.GC()
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of keys kept per command in a connection's history
+const maxHistoryKeys = 4
+
+// historyEntry is the metadata of a single command of a connection: never
+// its value, so the history of a connection stays small.
+type historyEntry struct {
+	at   time.Time
+	cmd  string
+	keys []string
+	// number of keys over maxHistoryKeys, not kept
+	more int
+	// length of the data block of a storage command
+	n   int
+	err string
+}
+
+func (e historyEntry) String() string {
+	var b strings.Builder
+	b.WriteString(e.at.UTC().Format("15:04:05.000000"))
+	if e.cmd != "" {
+		b.WriteString(" " + e.cmd)
+	}
+	for _, key := range e.keys {
+		b.WriteString(" " + key)
+	}
+	if e.more > 0 {
+		fmt.Fprintf(&b, " (+%d keys)", e.more)
+	}
+	if e.n > 0 {
+		fmt.Fprintf(&b, " (%d bytes)", e.n)
+	}
+	if e.err != "" {
+		b.WriteString(" error: " + e.err)
+	}
+	return b.String()
+}
+
+// commandHistory is a ring buffer of the last commands of a connection
+// (see ConnHistory), dumped when the connection fails or is killed. A nil
+// history records nothing.
+type commandHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	// index of the next entry written, and whether the ring has wrapped
+	next int
+	full bool
+}
+
+func newCommandHistory(size int) *commandHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &commandHistory{entries: make([]historyEntry, size)}
+}
+
+// record adds the command of the request, overwriting the oldest one once
+// the history is full
+func (h *commandHistory) record(request Request) {
+	if h == nil {
+		return
+	}
+	entry := historyEntry{at: time.Now(), cmd: request.cmd}
+	keys := request.keys
+	if len(keys) > maxHistoryKeys {
+		entry.more = len(keys) - maxHistoryKeys
+		keys = keys[:maxHistoryKeys]
+	}
+	entry.keys = append([]string(nil), keys...)
+	if request.cmd == cmdSet || request.cmd == cmdCas || request.cmd == cmdMetaSet {
+		entry.n = request.n
+	}
+	if request.err != nil {
+		entry.err = request.err.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = entry
+	h.next++
+	if h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// drain returns the commands recorded, oldest first, and empties the
+// history so the same commands are never dumped twice
+func (h *commandHistory) drain() []string {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var entries []historyEntry
+	if h.full {
+		entries = append(entries, h.entries[h.next:]...)
+	}
+	entries = append(entries, h.entries[:h.next]...)
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = entry.String()
+	}
+	h.next, h.full = 0, false
+	return lines
+}
+
+// logHistory logs the last commands of a connection (see drain), if any
+func (s *Server) logHistory(addr string, lines []string, reason string) {
+	if len(lines) == 0 {
+		return
+	}
+	s.logf("Server: last (%d) commands of client (%s), %s:\n\t%s\n", len(lines), addr, reason, strings.Join(lines, "\n\t"))
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// one in every hotKeysSampleRate key accesses is counted
+	hotKeysSampleRate = 100
+	// maximum number of distinct keys tracked at once
+	hotKeysCapacity = 1024
+	// counts are halved every window so old accesses fade out
+	hotKeysWindow = time.Minute
+	// number of keys reported by /hotkeys by default
+	defaultNumHotKeys = 10
+)
+
+// hotKey is a single entry of the hot key report
+type hotKey struct {
+	Key string `json:"key"`
+	// estimated number of accesses over the recent window(s)
+	Count uint64 `json:"count"`
+}
+
+// hotKeys samples key accesses to find the most accessed keys.
+//
+// Only one in 'sampleRate' accesses takes the lock, so recording an access
+// is a random number on the common path. Memory is bounded by halving every
+// count (dropping keys that reach zero) whenever more than 'capacity' keys
+// are tracked, and counts are also halved every 'window' so the report
+// reflects recent traffic.
+type hotKeys struct {
+	sampleRate int
+	capacity   int
+	window     time.Duration
+
+	mu          sync.Mutex
+	counts      map[string]uint64
+	windowStart time.Time
+}
+
+func newHotKeys(sampleRate, capacity int, window time.Duration) *hotKeys {
+	return &hotKeys{
+		sampleRate:  sampleRate,
+		capacity:    capacity,
+		window:      window,
+		counts:      make(map[string]uint64),
+		windowStart: time.Now(),
+	}
+}
+
+// record samples an access of 'key'
+func (h *hotKeys) record(key string) {
+	if h.sampleRate > 1 && rand.Intn(h.sampleRate) != 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now := time.Now(); now.Sub(h.windowStart) > h.window {
+		h.decay()
+		h.windowStart = now
+	}
+	h.counts[key]++
+	if len(h.counts) > h.capacity {
+		h.decay()
+	}
+}
+
+// decay halves every count, forgetting keys that reach zero.
+// Must be called with the lock held.
+func (h *hotKeys) decay() {
+	for key, count := range h.counts {
+		if count <= 1 {
+			delete(h.counts, key)
+			continue
+		}
+		h.counts[key] = count / 2
+	}
+}
+
+// top returns (at most) the 'n' most accessed keys, most accessed first
+func (h *hotKeys) top(n int) []hotKey {
+	h.mu.Lock()
+	keys := make([]hotKey, 0, len(h.counts))
+	for key, count := range h.counts {
+		keys = append(keys, hotKey{Key: key, Count: count * uint64(h.sampleRate)})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
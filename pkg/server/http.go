@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
 )
 
 const (
@@ -17,26 +21,64 @@ const (
 // This admin HTTP port allows one to query the memcached
 // server to retrieve stats via HTTP (instead of the memcache protocol).
 
-func (s *Server) adminHttpServerStart(port int) {
+// adminHttpServerStart starts serving the admin HTTP interface on 'port', or
+// on the memcache port with SharedAdminPort. Its port is bound before
+// returning, so failing to bind it (ie: the port is already in use) is
+// returned rather than leaving the admin endpoints silently unreachable.
+// Port 0 disables the admin interface (unless it is shared).
+func (s *Server) adminHttpServerStart(port int) error {
+	if port == 0 && s.adminListener == nil {
+		return nil
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/stats", s.getStatsHandler)
+	mux.HandleFunc("/stats/sizes", s.getSizeStatsHandler)
+	mux.HandleFunc("/stats/settings", s.getSettingsHandler)
+	mux.HandleFunc("/capacity", s.capacityHandler)
+	mux.HandleFunc("/flush", s.flushHandler)
+	mux.HandleFunc("/buckets/", s.bucketFlushHandler)
+	mux.HandleFunc("/verify", s.verifyHandler)
+	mux.HandleFunc("/tags/invalidate", s.tagInvalidateHandler)
+	mux.HandleFunc("/hotkeys", s.hotKeysHandler)
+	mux.HandleFunc("/verbosity", s.verbosityHandler)
+	mux.HandleFunc("/watch", s.watchHandler)
+	mux.HandleFunc("/conns", s.connsHandler)
+	mux.HandleFunc("/conns/kill", s.connsKillHandler)
+	mux.HandleFunc("/clients", s.clientsHandler)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 
 	address := fmt.Sprintf(":%d", port)
-	httpServer := &http.Server{Addr: address, Handler: mux}
+	var l net.Listener
+	if s.adminListener != nil {
+		// connections are handed off from the memcache port
+		l = s.adminListener
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", address); err != nil {
+			return err
+		}
+	}
+	httpServer := &http.Server{Addr: address, Handler: mux, ErrorLog: s.Logger}
 	s.adminHttpServer = httpServer
 	go func() {
-		if err := httpServer.ListenAndServe(); err != nil {
-			log.Printf("listen received err: %s\n", err)
+		if err := httpServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logf("admin HTTP server received err: %s\n", err)
 		}
 	}()
+	return nil
 }
 
+// adminHttpServerStop shuts down the admin HTTP server, if it was started
 func (s *Server) adminHttpServerStop() {
-	ctx, _ := context.WithTimeout(context.Background(), defaultShutdownDelay)
+	if s.adminHttpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownDelay)
+	defer cancel()
 	s.adminHttpServer.Shutdown(ctx)
 }
 
@@ -52,3 +94,271 @@ func (s *Server) getStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	w.Write(data)
 }
+
+// getSettingsHandler returns the effective configuration, like `stats settings`.
+func (s *Server) getSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.getSettings())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (s *Server) getSizeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	sizes := s.getSizeStats()
+	if sizes == nil {
+		http.Error(w, "size histogram is disabled", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(sizes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// capacityHandler returns the cache's capacity, or changes it when
+// POSTed with a `bytes` query parameter (ie: POST /capacity?bytes=1048576).
+func (s *Server) capacityHandler(w http.ResponseWriter, r *http.Request) {
+	resizer, ok := s.Cache.(cache.Resizer)
+	if !ok {
+		http.Error(w, "cache does not support resizing", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		capacity, err := strconv.ParseUint(r.URL.Query().Get("bytes"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid capacity: %s", err), http.StatusBadRequest)
+			return
+		}
+		resizer.Resize(capacity)
+		s.logf("capacityHandler: resized cache to (%d) bytes\n", capacity)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(map[string]uint64{"capacity": resizer.Capacity()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// flushHandler removes all entries whose key starts with the `prefix`
+// query parameter (ie: POST /flush?prefix=user:) and returns the number
+// of entries deleted. This scans the entire cache.
+func (s *Server) flushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deleter, ok := s.Cache.(cache.PrefixDeleter)
+	if !ok {
+		http.Error(w, "cache does not support prefix deletion", http.StatusNotImplemented)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "missing prefix", http.StatusBadRequest)
+		return
+	}
+
+	count := deleter.DeletePrefix(prefix)
+	s.logf("flushHandler: deleted (%d) entries with prefix (%s)\n", count, prefix)
+
+	data, err := json.Marshal(map[string]int{"deleted": count})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// tagInvalidateHandler removes every entry tagged with the `tag` query
+// parameter (ie: POST /tags/invalidate?tag=product:42, see the G flag of ms).
+// Entries stored with the tag afterwards are kept.
+func (s *Server) tagInvalidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tagger, ok := s.Cache.(cache.Tagger)
+	if !ok {
+		http.Error(w, "cache does not support tags", http.StatusNotImplemented)
+		return
+	}
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		http.Error(w, "missing tag", http.StatusBadRequest)
+		return
+	}
+
+	tagger.InvalidateTag(tag)
+	s.logf("tagInvalidateHandler: invalidated tag (%s)\n", tag)
+
+	data, err := json.Marshal(map[string]string{"invalidated": tag})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// bucketFlushHandler removes every entry of a single bucket of the cache
+// (ie: POST /buckets/3/flush) and returns the number of entries deleted.
+// This destroys data, it's meant for diagnosing a problem suspected to be
+// local to a bucket.
+func (s *Server) bucketFlushHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/buckets/"), "/")
+	if len(parts) != 2 || parts[1] != "flush" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := s.Cache.(cache.BucketFlusher)
+	if !ok {
+		http.Error(w, "cache does not support flushing a bucket", http.StatusNotImplemented)
+		return
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid bucket (%s)", parts[0]), http.StatusBadRequest)
+		return
+	}
+
+	count, err := flusher.FlushBucket(n)
+	if err == cache.ErrNoSuchBucket {
+		http.Error(w, fmt.Sprintf("no bucket (%d)", n), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logf("bucketFlushHandler: deleted (%d) entries of bucket (%d)\n", count, n)
+
+	data, err := json.Marshal(map[string]int{"deleted": count})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// bucketDiscrepancy describes a bucket whose size accounting has drifted,
+// for /verify
+type bucketDiscrepancy struct {
+	Bucket  int    `json:"bucket"`
+	Size    uint64 `json:"size"`
+	Actual  uint64 `json:"actual_size"`
+	Entries int    `json:"entries"`
+	Listed  int    `json:"evict_list_entries"`
+}
+
+// verifyHandler checks the size accounting of every bucket against the
+// entries it holds and returns the buckets that don't match, if any (ie:
+// GET /verify). This is O(n), each bucket being locked while it is checked.
+func (s *Server) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	verifier, ok := s.Cache.(cache.Verifier)
+	if !ok {
+		http.Error(w, "cache does not support verification", http.StatusNotImplemented)
+		return
+	}
+
+	discrepancies := []bucketDiscrepancy{}
+	for _, d := range verifier.Verify() {
+		s.logAt(verbosityQuiet, "verifyHandler: bucket (%d) has a size of (%d) bytes but holds (%d), with (%d) entries and (%d) on its evict list\n", d.Bucket, d.Size, d.Actual, d.Entries, d.Listed)
+		discrepancies = append(discrepancies, bucketDiscrepancy(d))
+	}
+
+	data, err := json.Marshal(map[string][]bucketDiscrepancy{"discrepancies": discrepancies})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// hotKeysHandler returns the most accessed keys over the recent past, with
+// their estimated number of accesses (ie: GET /hotkeys?n=20, default 10).
+func (s *Server) hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	n := defaultNumHotKeys
+	if param := r.URL.Query().Get("n"); param != "" {
+		var err error
+		if n, err = strconv.Atoi(param); err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid number of keys (%s)", param), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := json.Marshal(s.hotKeys.top(n))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// verbosityHandler returns the log level, or changes it when POSTed with a
+// `level` query parameter (ie: POST /verbosity?level=2), like the
+// `verbosity` command.
+func (s *Server) verbosityHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level, err := strconv.Atoi(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid level: %s", err), http.StatusBadRequest)
+			return
+		}
+		SetVerbosity(level)
+		s.logf("verbosityHandler: set verbosity to (%d)\n", level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(map[string]int{"verbosity": Verbosity()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
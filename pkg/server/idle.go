@@ -0,0 +1,89 @@
+package server
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// default fraction of 'IdleTimeout' each connection's timeout is randomly
+// moved by (ie: 10% of a 60s timeout is anywhere between 54s and 66s)
+const defaultIdleTimeoutJitter = 0.1
+
+// idleConn is a connection whose reads fail (closing it) once no data has
+// been received for 'timeout' (0 is never), or once the read in progress is
+// past its own deadline: the deadline of the data block being read (see
+// dataBlockTimer), or of the wait for the next command before releasing the
+// connection's buffers (see bufferReleaser).
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	// deadline of the read in progress, zero if none
+	deadline time.Time
+}
+
+// Read extends the read deadline before every read, up to the deadline of
+// the read in progress if any.
+func (c *idleConn) Read(b []byte) (int, error) {
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if !c.deadline.IsZero() && (deadline.IsZero() || c.deadline.Before(deadline)) {
+		deadline = c.deadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	return c.Conn.Read(b)
+}
+
+// expired reports whether reading failed for the deadline of the read in
+// progress passing, rather than the connection being idle or closed
+func (c *idleConn) expired(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout() && !c.deadline.IsZero() && !time.Now().Before(c.deadline)
+}
+
+// dataBlockTimer bounds the time the data block of a storage command takes
+// to arrive (see DataBlockTimeout), from the end of its command line. A nil
+// timer bounds nothing.
+type dataBlockTimer struct {
+	conn    *idleConn
+	timeout time.Duration
+}
+
+// start sets the deadline of the data block about to be read
+func (t *dataBlockTimer) start() {
+	if t == nil {
+		return
+	}
+	t.conn.deadline = time.Now().Add(t.timeout)
+}
+
+// stop removes the deadline once the data block has been read, reporting
+// whether reading it failed with 'err' for being past its deadline
+func (t *dataBlockTimer) stop(err error) bool {
+	if t == nil {
+		return false
+	}
+	expired := t.conn.expired(err)
+	t.conn.deadline = time.Time{}
+	return expired
+}
+
+// unwrapConn returns the connection wrapped by an idleConn, or 'conn' itself
+// (ie: to reach the *net.TCPConn underneath)
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*idleConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+// jitter returns 'd' randomly moved by up to +/- 'fraction' of it, so
+// connections established at the same time don't all time out together.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 - fraction + 2*fraction*rand.Float64()))
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
+)
+
+// Meta commands (see memcached's protocol.txt) take a key followed by
+// single character flags, some of which carry a token (ie: "ma k1 D5 MI c v").
+// Reply codes are two characters followed by any requested return flags.
+
+const (
+	cmdMetaArithmetic = "ma"
+	cmdMetaDelete     = "md"
+	cmdMetaGet        = "mg"
+	cmdMetaSet        = "ms"
+)
+
+const (
+	replyMetaHeader   = "HD"
+	replyMetaValue    = "VA"
+	replyMetaMiss     = "EN\r\n"
+	replyMetaExists   = "EX\r\n"
+	replyMetaNotFound = "NF\r\n"
+)
+
+var (
+	ErrInvalidFlag = errors.New("invalid flag")
+	ErrInvalidMode = errors.New("invalid mode for ma")
+)
+
+// metaFlags maps each flag provided with a meta command to its token
+// (empty for flags without a token).
+type metaFlags map[byte]string
+
+// parseMetaFlags parses the flags of a meta command, returning
+// ErrInvalidFlag for any flag not in 'supported'.
+func parseMetaFlags(args []string, supported string) (metaFlags, error) {
+	flags := make(metaFlags, len(args))
+	for _, arg := range args {
+		if len(arg) == 0 {
+			continue
+		}
+		if !containsByte(supported, arg[0]) {
+			return nil, ErrInvalidFlag
+		}
+		flags[arg[0]] = arg[1:]
+	}
+	return flags, nil
+}
+
+// containsByte returns true if 's' contains the byte 'c'
+func containsByte(s string, c byte) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// containsEmpty returns true if one of the strings is empty
+func containsEmpty(s []string) bool {
+	for _, v := range s {
+		if v == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// metaReturnFlags builds the return flags of a meta reply, in the order they
+// were requested, from the values available for each flag (ie: " c5 kfoo").
+func metaReturnFlags(args []string, values map[byte]string) string {
+	ret := ""
+	for _, arg := range args {
+		if len(arg) == 0 {
+			continue
+		}
+		if v, ok := values[arg[0]]; ok {
+			ret += " " + string(arg[0]) + v
+		}
+	}
+	return ret
+}
+
+// handleMetaArithmetic replies to the `ma` meta command.
+//
+// Supported flags:
+// - C(token): only update if the cas token matches
+// - D(token): delta to apply (default 1)
+// - M(token): mode, I or + to increment (default), D or - to decrement
+// - O(token): opaque value, echoed back
+// - c: return the new cas token
+// - k: return the key
+// - v: return the new value
+func (server *Server) handleMetaArithmetic(writer *bufio.Writer, request Request) {
+	defer writer.Flush()
+
+	key := request.keys[0]
+	flags, err := parseMetaFlags(request.args, "CDMOckv")
+	if err != nil {
+		writeClientError(writer, StatsErrNumBadCommand, err)
+		return
+	}
+
+	delta := uint64(1)
+	if token, ok := flags['D']; ok {
+		if delta, err = strconv.ParseUint(token, 10, 64); err != nil {
+			writeClientError(writer, StatsErrNumBadCommand, ErrInvalidDelta)
+			return
+		}
+	}
+	incr := true
+	if mode, ok := flags['M']; ok {
+		switch mode {
+		case "I", "i", "+":
+		case "D", "d", "-":
+			incr = false
+		default:
+			writeClientError(writer, StatsErrNumBadCommand, ErrInvalidMode)
+			return
+		}
+	}
+	var cas uint64
+	if token, ok := flags['C']; ok {
+		if cas, err = strconv.ParseUint(token, 10, 64); err != nil {
+			writeClientError(writer, StatsErrNumBadCommand, ErrBadToken)
+			return
+		}
+	}
+
+	if incr {
+		StatsNumIncr.Add(1)
+	} else {
+		StatsNumDecr.Add(1)
+	}
+
+	value, newCas, err := server.Cache.Incr(key, delta, incr, cas)
+	switch err {
+	case nil:
+		server.CommandLog.logIncr(key, delta, incr)
+	case cache.ErrCacheMiss:
+		writer.WriteString(replyMetaNotFound)
+		return
+	case cache.ErrCasConflict:
+		writer.WriteString(replyMetaExists)
+		return
+	case cache.ErrNotANumber:
+		writeClientError(writer, nil, ErrNonNumericValue)
+		return
+	default:
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s%s", err, endOfLine))
+		return
+	}
+
+	ret := metaReturnFlags(request.args, map[byte]string{
+		'O': flags['O'],
+		'c': strconv.FormatUint(newCas, 10),
+		'k': request.clientKeys[0],
+	})
+	if _, ok := flags['v']; ok {
+		data := strconv.FormatUint(value, 10)
+		writer.WriteString(fmt.Sprintf("%s %d%s%s%s%s", replyMetaValue, len(data), ret, endOfLine, data, endOfLine))
+		return
+	}
+	writer.WriteString(fmt.Sprintf("%s%s%s", replyMetaHeader, ret, endOfLine))
+}
+
+// handleMetaDelete replies to the `md` meta command.
+//
+// Supported flags:
+// - O(token): opaque value, echoed back
+// - k: return the key
+// - c: return the cas token of the deleted item
+// - f: return the client flags of the deleted item
+// - s: return the size of the deleted item
+// - v: return the value of the deleted item
+//
+// Returning the deleted item (c, f, s or v) is an extension to memcached's
+// protocol. The item is removed and returned atomically (see
+// cache.DeleteReturner), so it can be used as a get and delete without racing
+// other clients.
+func (server *Server) handleMetaDelete(writer *bufio.Writer, request Request) {
+	defer writer.Flush()
+
+	key := request.keys[0]
+	flags, err := parseMetaFlags(request.args, "Ocfksv")
+	if err != nil {
+		writeClientError(writer, StatsErrNumBadCommand, err)
+		return
+	}
+
+	StatsNumDelete.Add(1)
+
+	var item cache.Item
+	_, returning := flags['v']
+	for _, flag := range []byte("cfs") {
+		if _, ok := flags[flag]; ok {
+			returning = true
+		}
+	}
+	if returning {
+		deleter, ok := server.Cache.(cache.DeleteReturner)
+		if !ok {
+			server.writeUnsupported(writer, request.cmd)
+			return
+		}
+		item, err = deleter.DeleteReturning(key)
+	} else {
+		err = server.Cache.Delete(key)
+	}
+	if err != nil {
+		writer.WriteString(replyMetaNotFound)
+		return
+	}
+	server.CommandLog.logDelete(key)
+
+	ret := metaReturnFlags(request.args, map[byte]string{
+		'O': flags['O'],
+		'c': strconv.FormatUint(item.Cas, 10),
+		'f': strconv.FormatUint(uint64(item.Flags), 10),
+		'k': request.clientKeys[0],
+		's': strconv.Itoa(len(item.Value)),
+	})
+	if _, ok := flags['v']; ok {
+		writeValue(writer, fmt.Sprintf("%s %d%s%s", replyMetaValue, len(item.Value), ret, endOfLine), item.Value)
+		return
+	}
+	writer.WriteString(fmt.Sprintf("%s%s%s", replyMetaHeader, ret, endOfLine))
+}
+
+// handleMetaGet replies to the `mg` meta command.
+//
+// Supported flags:
+// - O(token): opaque value, echoed back
+// - a: return the number of accesses before this one (an extension, only if
+// the cache tracks accesses)
+// - c: return the cas token
+// - f: return the client flags
+// - h: return whether the item had been retrieved before (0 or 1)
+// - k: return the key
+// - l: return the seconds since the item was last accessed (or stored), only
+// if the cache tracks accesses
+// - p: return how full the cache is, as a percentage of its capacity (an
+// extension, see fillGauge)
+// - s: return the size of the value
+// - v: return the value
+//
+// If the cache serves stale items (see cache.StaleGetter), an expired item
+// within its grace period is returned with the X flag. The first client to
+// receive it also gets the W flag and is expected to refresh it, all others
+// get the Z flag.
+func (server *Server) handleMetaGet(writer *bufio.Writer, request Request) {
+	defer writer.Flush()
+
+	key := request.keys[0]
+	flags, err := parseMetaFlags(request.args, "Oacfhklpsv")
+	if err != nil {
+		writeClientError(writer, StatsErrNumBadCommand, err)
+		return
+	}
+
+	StatsNumGet.Add(1)
+
+	item, err := cache.NewCommands(server.Cache).GetStale(key)
+	if err != nil {
+		writer.WriteString(replyMetaMiss)
+		return
+	}
+
+	values := map[byte]string{
+		'O': flags['O'],
+		'c': strconv.FormatUint(item.Cas, 10),
+		'f': strconv.FormatUint(uint64(item.Flags), 10),
+		'h': "0",
+		'k': request.clientKeys[0],
+		's': strconv.Itoa(len(item.Value)),
+	}
+	if item.Fetched {
+		values['h'] = "1"
+	}
+	if item.Tracked {
+		values['a'] = strconv.FormatUint(item.Accesses, 10)
+		values['l'] = strconv.FormatInt(time.Now().Unix()-item.LastAccess, 10)
+	}
+	if _, ok := flags['p']; ok {
+		if fill, ok := server.fill(); ok {
+			values['p'] = fill
+		}
+	}
+	ret := metaReturnFlags(request.args, values)
+	if item.Win {
+		ret += " W"
+	}
+	if item.Stale {
+		ret += " X"
+		if !item.Win {
+			ret += " Z"
+		}
+	}
+
+	if _, ok := flags['v']; ok {
+		writeValue(writer, fmt.Sprintf("%s %d%s%s", replyMetaValue, len(item.Value), ret, endOfLine), item.Value)
+		return
+	}
+	writer.WriteString(fmt.Sprintf("%s%s%s", replyMetaHeader, ret, endOfLine))
+}
+
+// handleMetaSet replies to the `ms` meta command (ie: "ms <key> <datalen> <flags>*").
+//
+// Supported flags:
+// - F(token): client flags to store
+// - G(token): comma separated tags of the item, to invalidate it along with
+// every other item carrying one of them (an extension, see cache.Tagger)
+// - O(token): opaque value, echoed back
+// - T(token): expiration time
+// - X(token): seconds the item is still served as stale by mg once expired,
+// instead of -stale-grace (an extension, see cache.SetOptions)
+// - c: return the cas token assigned to the stored item
+// - k: return the key
+// - p: return how full the cache is, as a percentage of its capacity (an
+// extension, so writers can back off while the cache is thrashing)
+// - s: return the size of the value stored (an extension, so clients can
+// verify the server received the whole value)
+func (server *Server) handleMetaSet(writer *bufio.Writer, request Request) {
+	defer writer.Flush()
+
+	key := request.keys[0]
+	flags, err := parseMetaFlags(request.args, "FGOTXckps")
+	if err != nil {
+		writeClientError(writer, StatsErrNumBadCommand, err)
+		return
+	}
+
+	var clientFlags uint64
+	if token, ok := flags['F']; ok {
+		if clientFlags, err = strconv.ParseUint(token, 10, 32); err != nil {
+			writeClientError(writer, StatsErrNumBadCommand, ErrBadToken)
+			return
+		}
+	}
+	var expTime int64
+	if token, ok := flags['T']; ok {
+		if expTime, err = strconv.ParseInt(token, 10, 32); err != nil {
+			writeClientError(writer, StatsErrNumBadCommand, ErrBadToken)
+			return
+		}
+	}
+
+	var opts cache.SetOptions
+	if token, ok := flags['G']; ok {
+		if opts.Tags = strings.Split(token, ","); containsEmpty(opts.Tags) {
+			writeClientError(writer, StatsErrNumBadCommand, ErrBadToken)
+			return
+		}
+	}
+	if token, ok := flags['X']; ok {
+		grace, err := strconv.ParseUint(token, 10, 31)
+		if err != nil {
+			writeClientError(writer, StatsErrNumBadCommand, ErrBadToken)
+			return
+		}
+		opts.Grace = int32(grace)
+	}
+	withOptions := opts.Tags != nil || opts.Grace > 0
+	adder, ok := server.Cache.(cache.OptionsAdder)
+	if withOptions && !ok {
+		server.writeUnsupported(writer, request.cmd)
+		return
+	}
+
+	StatsNumSet.Add(1)
+
+	var cas uint64
+	if withOptions {
+		cas, err = adder.AddWithOptions(key, request.dataBlock, uint32(clientFlags), int32(expTime), opts)
+	} else {
+		cas, err = cache.NewCommands(server.Cache).Set(key, request.dataBlock, uint32(clientFlags), int32(expTime))
+	}
+	if err != nil {
+		writer.WriteString(replyOutOfMemory)
+		return
+	}
+	if withOptions {
+		server.CommandLog.logMetaSet(key, request.dataBlock, uint32(clientFlags), int32(expTime), opts)
+	} else {
+		server.CommandLog.logSet(key, request.dataBlock, uint32(clientFlags), int32(expTime))
+	}
+
+	values := map[byte]string{
+		'O': flags['O'],
+		'c': strconv.FormatUint(cas, 10),
+		'k': request.clientKeys[0],
+		's': strconv.Itoa(len(request.dataBlock)),
+	}
+	if _, ok := flags['p']; ok {
+		if fill, ok := server.fill(); ok {
+			values['p'] = fill
+		}
+	}
+	ret := metaReturnFlags(request.args, values)
+	writer.WriteString(fmt.Sprintf("%s%s%s", replyMetaHeader, ret, endOfLine))
+}
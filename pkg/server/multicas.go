@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
+)
+
+// The `mcas` command is an extension (not part of memcached's protocol) to
+// compare-and-swap several keys atomically:
+//
+//	mcas <count>\r\n
+//	<key> <flags> <exptime> <bytes> <cas unique>\r\n
+//	<data block>\r\n
+//	... (<count> items)
+//
+// Either every key still holds its cas token and all of them are stored
+// (STORED), or nothing is stored and the reply is EXISTS (a token didn't
+// match) or NOT_FOUND (a key is missing). See cache.MultiCaser.
+
+const (
+	cmdMultiCas = "mcas"
+
+	// maximum number of items in a single mcas
+	maxMultiCasItems = 256
+)
+
+// readMultiCasItems reads the 'count' items following an mcas command line.
+// A malformed item line returns errDataItem. The remaining items can then no
+// longer be found reliably, so the connection reader closes the connection
+// on any framing error of an item (see desyncError).
+func readMultiCasItems(reader *bufio.Reader, count int) ([]cache.CasItem, error) {
+	items := make([]cache.CasItem, count)
+	for i := range items {
+		line, err := readLine(reader)
+		if err == ErrLineTooLong {
+			return nil, errDataItem
+		}
+		if err != nil {
+			return nil, err
+		}
+		// an item line is tokenized exactly like the arguments of a cas
+		r, err := parseRequest(cmdCas+" "+line, nil)
+		if err != nil || r.n > maxValueLength {
+			return nil, errDataItem
+		}
+		items[i] = cache.CasItem{Key: r.keys[0], Flags: r.flags, ExpTime: r.expTime, Cas: r.cas}
+		if items[i].Value, err = readDataBlock(reader, r.n); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// handleMultiCas replies to the `mcas` command.
+func (server *Server) handleMultiCas(writer *bufio.Writer, request Request) {
+	defer writer.Flush()
+
+	caser, ok := server.Cache.(cache.MultiCaser)
+	if !ok {
+		server.writeUnsupported(writer, request.cmd)
+		return
+	}
+
+	StatsNumCas.Add(1)
+
+	_, err := caser.CasMulti(request.items)
+	switch err {
+	case nil:
+		for _, item := range request.items {
+			server.CommandLog.logSet(item.Key, item.Value, item.Flags, item.ExpTime)
+		}
+		writer.WriteString(replyStored)
+	case cache.ErrCacheMiss:
+		writer.WriteString(replyNotFound)
+	case cache.ErrCasConflict:
+		writer.WriteString(replyExists)
+	case cache.ErrOutOfMemory:
+		writer.WriteString(replyOutOfMemory)
+	default:
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s%s", err, endOfLine))
+	}
+}
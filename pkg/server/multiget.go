@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
+)
+
+// default number of goroutines a large multi-get is split across
+const defaultParallelGetWorkers = 4
+
+// getResult is the result of looking up a single key of a multi-get
+type getResult struct {
+	item  cache.Item
+	found bool
+}
+
+// getItems looks up every key, returning the results in the same order.
+//
+// With at least 'ParallelGetThreshold' keys, the keys are split into
+// contiguous ranges looked up concurrently by 'ParallelGetWorkers'
+// goroutines, so a get spanning many buckets isn't a serial walk over all
+// of them. Smaller gets aren't worth the overhead.
+func (server *Server) getItems(commands cache.Commands, keys []string) []getResult {
+	results, _ := server.getItemsWithin(commands, keys, 0)
+	return results
+}
+
+// getItemsWithin looks up every key like getItems, but gives up on the keys
+// left once 'timeout' has passed (0 is no timeout), returning false if any
+// key was abandoned (see deadlineModifier).
+func (server *Server) getItemsWithin(commands cache.Commands, keys []string, timeout time.Duration) ([]getResult, bool) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	var expired int32
+	results := make([]getResult, len(keys))
+	lookup := func(from, to int) {
+		for i := from; i < to; i++ {
+			if timeout > 0 && (atomic.LoadInt32(&expired) != 0 || time.Now().After(deadline)) {
+				atomic.StoreInt32(&expired, 1)
+				return
+			}
+			item, err := commands.Get(keys[i])
+			results[i] = getResult{item: item, found: err == nil}
+		}
+	}
+
+	workers := server.ParallelGetWorkers
+	if server.ParallelGetThreshold <= 0 || len(keys) < server.ParallelGetThreshold || workers <= 1 {
+		lookup(0, len(keys))
+		return results, expired == 0
+	}
+
+	var wg sync.WaitGroup
+	size := (len(keys) + workers - 1) / workers
+	for from := 0; from < len(keys); from += size {
+		to := from + size
+		if to > len(keys) {
+			to = len(keys)
+		}
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			lookup(from, to)
+		}(from, to)
+	}
+	wg.Wait()
+	return results, expired == 0
+}
+
+// dedupeKeys removes every repeated key of the request but its first
+// occurrence (see DedupeGetKeys)
+func (r *Request) dedupeKeys() {
+	if len(r.keys) < 2 {
+		return
+	}
+	seen := make(map[string]bool, len(r.keys))
+	keys := make([]string, 0, len(r.keys))
+	clientKeys := make([]string, 0, len(r.keys))
+	for i, key := range r.keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		clientKeys = append(clientKeys, r.clientKeys[i])
+	}
+	if n := len(r.keys) - len(keys); n > 0 {
+		StatsGetKeysDeduped.Add(int64(n))
+		r.keys, r.clientKeys = keys, clientKeys
+	}
+}
+
+// appendValueLine appends the VALUE line of the item to 'dst' (with its cas
+// token if 'withCas')
+func appendValueLine(dst []byte, key string, item cache.Item, withCas bool) []byte {
+	dst = append(dst, "VALUE "...)
+	dst = append(dst, key...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(item.Flags), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(len(item.Value)), 10)
+	if withCas {
+		dst = append(dst, ' ')
+		dst = strconv.AppendUint(dst, item.Cas, 10)
+	}
+	return append(dst, endOfLine...)
+}
+
+// writeSingleGet replies to a get (or gets) of a single key, by far the most
+// common, like getItems and writeGetReply but without their slices of
+// results and VALUE lines. 'header' is the connection's buffer for the VALUE
+// line, returned to be reused by its next get. A single lookup can't run
+// past the deadline of a timeout modifier, so there is none to check.
+func writeSingleGet(writer *bufio.Writer, commands cache.Commands, key, clientKey string, withCas bool, header []byte) []byte {
+	item, err := commands.Get(key)
+	if err != nil {
+		writer.WriteString(replyEnd)
+		writer.Flush()
+		return header
+	}
+	header = appendValueLine(header[:0], clientKey, item, withCas)
+	writer.Write(header)
+	// a value larger than the buffer is written straight to the connection
+	if len(item.Value) > writer.Available() {
+		writer.Flush()
+	}
+	writer.Write(item.Value)
+	writer.WriteString(endOfLine)
+	writer.WriteString(replyEnd)
+	writer.Flush()
+	return header
+}
+
+// byte slices of the constant parts of a get reply, shared by every reply
+var (
+	endOfLineBytes = []byte(endOfLine)
+	replyEndBytes  = []byte(replyEnd)
+)
+
+// writeGetReply writes the VALUE line and data block of every key found
+// (with its cas token if 'withCas', for gets), followed by END.
+//
+// A reply that fits in the space left in the writer's buffer is copied
+// through it. A larger one (ie: a multi-get of many or large values) would
+// take one write per buffer-full, so it is sent instead as net.Buffers of the
+// VALUE lines and the cache's own values, after flushing the writer: a single
+// writev (per 1024 slices) on a TCP connection.
+func writeGetReply(writer *bufio.Writer, conn net.Conn, keys []string, results []getResult, withCas bool) {
+	// every VALUE line is appended to a single slice, 'ends[i]' is where the
+	// line of key 'i' ends
+	headers := make([]byte, 0, 64*len(results))
+	ends := make([]int, len(results))
+	size := len(replyEnd)
+	found := 0
+	for i, result := range results {
+		if result.found {
+			headers = appendValueLine(headers, keys[i], result.item, withCas)
+			size += len(result.item.Value) + len(endOfLine)
+			found++
+		}
+		ends[i] = len(headers)
+	}
+	size += len(headers)
+
+	if size <= writer.Available() {
+		start := 0
+		for i, result := range results {
+			if result.found {
+				writer.Write(headers[start:ends[i]])
+				writer.Write(result.item.Value)
+				writer.WriteString(endOfLine)
+			}
+			start = ends[i]
+		}
+		writer.WriteString(replyEnd)
+		writer.Flush()
+		return
+	}
+
+	if writer.Flush() != nil {
+		return
+	}
+	buffers := make(net.Buffers, 0, 3*found+1)
+	start := 0
+	for i, result := range results {
+		if result.found {
+			buffers = append(buffers, headers[start:ends[i]], result.item.Value, endOfLineBytes)
+		}
+		start = ends[i]
+	}
+	buffers = append(buffers, replyEndBytes)
+	buffers.WriteTo(unwrapConn(conn))
+}
@@ -0,0 +1,31 @@
+package server
+
+// `namespace <prefix>` (an extension, not part of memcached's protocol) sets
+// a prefix transparently prepended to every key the connection sends from
+// then on, so tenants sharing a cache can't read or overwrite each other's
+// keys without having to prefix keys themselves. `namespace` without a prefix
+// goes back to plain keys. Replies (ie: the VALUE lines of a multi-get, or the
+// k flag of meta commands) echo keys as the client sent them.
+//
+// The namespace is part of the key as stored: it counts towards the maximum
+// key length, and shows up in everything outside the connection (ie: stats,
+// /hotkeys, /watch). Deleting a tenant's keys is `POST /flush?prefix=<prefix>`
+// on the admin interface, which matches stored keys and ignores namespaces.
+
+const cmdNamespace = "namespace"
+
+// withNamespace prepends 'namespace' to every key of the request, keeping
+// the keys as sent in 'clientKeys' for the replies
+func (r *Request) withNamespace(namespace string) {
+	r.clientKeys = r.keys
+	if namespace == "" || len(r.keys) == 0 {
+		return
+	}
+	r.keys = make([]string, len(r.clientKeys))
+	for i, key := range r.clientKeys {
+		r.keys[i] = namespace + key
+	}
+	for i := range r.items {
+		r.items[i].Key = namespace + r.items[i].Key
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
+)
+
+// how long the fill percentage of the cache is reused before being read again
+const pressureInterval = time.Second
+
+// fillGauge is how full the cache is, returned by the `p` flag of meta
+// commands. Reading the size of the cache walks every bucket, so it is read
+// again at most once per pressureInterval rather than on every command.
+type fillGauge struct {
+	// percentage of the capacity in use (0-100)
+	percent int64
+	// unix time (in nanoseconds) the percentage was last read
+	readAt int64
+}
+
+// fill returns the percentage of the cache's capacity in use as of the last
+// pressureInterval, or false if the cache can't report its size.
+func (server *Server) fill() (string, bool) {
+	sizer, ok := server.Cache.(cache.Sizer)
+	if !ok {
+		return "", false
+	}
+	now := time.Now().UnixNano()
+	readAt := atomic.LoadInt64(&server.fillGauge.readAt)
+	// a single command reads it again, the others return the last value
+	if now-readAt >= int64(pressureInterval) && atomic.CompareAndSwapInt64(&server.fillGauge.readAt, readAt, now) {
+		atomic.StoreInt64(&server.fillGauge.percent, fillPercent(sizer.ByteSize(), sizer.Capacity()))
+	}
+	return strconv.FormatInt(atomic.LoadInt64(&server.fillGauge.percent), 10), true
+}
+
+// fillPercent returns 'size' as a percentage of 'capacity', capped to 100%
+// (the size briefly goes over capacity before evicting)
+func fillPercent(size, capacity uint64) int64 {
+	if capacity == 0 || size >= capacity {
+		return 100
+	}
+	return int64(size * 100 / capacity)
+}
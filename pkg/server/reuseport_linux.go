@@ -0,0 +1,4 @@
+package server
+
+// SO_REUSEPORT (missing from the frozen syscall package on linux)
+const soReusePort = 0xf
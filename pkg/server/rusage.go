@@ -0,0 +1,46 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// processStats returns the CPU time used by the process (as "seconds.micros",
+// like memcached), its maximum and current resident set size in bytes.
+// The current RSS is only available on Linux (0 elsewhere).
+func processStats() map[string]string {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return unsupportedProcessStats()
+	}
+	// ru_maxrss is in bytes on darwin, kilobytes everywhere else
+	maxRSS := uint64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		maxRSS *= 1024
+	}
+	return map[string]string{
+		"rusage_user":   fmt.Sprintf("%d.%06d", ru.Utime.Sec, ru.Utime.Usec),
+		"rusage_system": fmt.Sprintf("%d.%06d", ru.Stime.Sec, ru.Stime.Usec),
+		"rusage_maxrss": fmt.Sprint(maxRSS),
+		"rss":           fmt.Sprint(currentRSS()),
+	}
+}
+
+// currentRSS returns the resident set size from /proc (Linux only, 0 on failure)
+func currentRSS() uint64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	var size, resident uint64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &size, &resident); err != nil {
+		return 0
+	}
+	return resident * uint64(os.Getpagesize())
+}
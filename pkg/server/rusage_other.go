@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package server
+
+// processStats reports zero, getrusage is not available on this platform.
+func processStats() map[string]string {
+	return unsupportedProcessStats()
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -13,6 +16,22 @@ import (
 
 const (
 	maxKeyLength = 250
+	// maximum length of a command line (excluding the data block)
+	maxLineLength = 64 * 1024
+	// maximum length of a data block (matches memcached's largest item size)
+	maxValueLength = 1024 * 1024 * 1024
+	// default maximum number of keys in a single get or gets
+	defaultMaxKeysPerGet = 1024
+	// default size of each connection's read and write buffers (bufio's default)
+	defaultBufferSize = 4096
+	// default interval between two snapshots of the stats log
+	defaultStatsLogInterval = time.Minute
+)
+
+var (
+	ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+	errListenBacklogUnsupported = errors.New("setting the listen backlog is not supported on this platform")
 )
 
 // Server is the root structure of the memcached server.
@@ -21,40 +40,273 @@ const (
 // 'maxNumConnections' is the buffer size of the channel to hold incoming
 // connections. If the buffer gets full, then the server will block accepting
 // new connections.
+//
+// If 'SharedAdminPort' is set (before calling Start), the admin HTTP interface
+// is served on the memcache port instead of its own port. The protocol of each
+// new connection is detected from its first line.
+//
+// If 'DisableEasterEgg' is set, the `hireeric?` command is treated as any
+// other unsupported command.
+//
+// 'ListenAddresses' (ie: "10.0.0.1:11211", "[::1]:11211") overrides listening
+// on all interfaces of 'port'.
+//
+// If 'EnableStatsSizes' is set, `stats sizes` and the admin `/stats/sizes`
+// endpoint report a histogram of entry sizes. This walks the entire cache
+// on every request, so it is expensive and off by default.
+//
+// If 'IdempotentDelete' is set, a `delete` of a missing key replies DELETED
+// instead of NOT_FOUND.
+//
+// If 'DedupeGetKeys' is set, a key repeated within a single get or gets is
+// only looked up and returned once, at its first position. memcached returns
+// a VALUE line for every occurrence, which is the default.
+//
+// If 'ReadOnly' is set, the server is a read replica: every mutating command
+// (set, cas, delete, incr/decr, ma, md, ms and mcas) is rejected with
+// `SERVER_ERROR read-only replica` and only reads are served. The cache is
+// expected to be filled by an external mechanism (ie: an application
+// embedding the server and writing to 'Cache' directly).
+//
+// If 'ReusePort' is set, listeners are bound with SO_REUSEPORT so a new
+// instance can bind the same port while this one drains (Linux and BSDs only,
+// Start fails on other platforms).
+//
+// 'ListenBacklog' sets the length of the queue of connections each listener
+// holds before they are accepted (0 keeps the OS default), so a burst of new
+// connections isn't refused. The kernel caps it at its own limit (ie:
+// net.core.somaxconn on Linux), which must be raised too for a larger backlog
+// to take effect. It is only supported on Linux and BSDs, other platforms keep
+// the default.
+//
+// 'MaxConnectionsPerIP' limits the number of simultaneous connections from a
+// single client IP (0 means unlimited). Connections over the limit are sent
+// `SERVER_ERROR too many connections` and closed as soon as they are accepted.
+//
+// 'MaxKeysPerGet' limits the number of keys in a single `get` or `gets`
+// (defaults to 1024, 0 means unlimited). Larger requests are rejected with
+// CLIENT_ERROR.
+//
+// 'MaxConnLifetime' closes connections older than it (0 means unlimited),
+// forcing clients to reconnect (ie: so a load balancer can rebalance them).
+// A connection is only closed once the reply to a command has been sent, so
+// no request in flight is interrupted.
+//
+// 'IdleTimeout' closes connections that haven't sent anything for that long
+// (0 means never). Each connection's timeout is randomly moved by up to
+// 'IdleTimeoutJitter' (a fraction of 'IdleTimeout', defaults to 10%), so a
+// fleet of clients that connected together doesn't time out (and reconnect)
+// all at once.
+//
+// 'DataBlockTimeout' bounds how long the data block of a `set`, `cas` or `ms`
+// (or the items of an `mcas`) may take to arrive after its command line (0
+// means unlimited). Past it, the command is abandoned and the connection
+// closed, so a client sending command lines without their data can't hold a
+// connection's reader forever. A connection reads one request at a time, so
+// at most one command per connection is ever waiting for its data.
+//
+// 'SlowStart' ramps up the number of connection workers after Start: worker
+// i (of 'numWorkers') only starts handling connections after
+// i*SlowStart/numWorkers, so a cold cache doesn't let a flood of clients miss
+// all at once and overwhelm the backing store. Connections over the current
+// concurrency wait in the connection queue.
+//
+// 'ParallelGetThreshold' is the number of keys from which a `get` or `gets`
+// looks up its keys concurrently across 'ParallelGetWorkers' goroutines
+// (defaults to 4) instead of one after the other (0 disables).
+//
+// 'MaxHeap' is a ceiling on the Go heap in use (in bytes, 0 disables), as
+// opposed to the cache's capacity which only counts keys and values. The heap
+// is checked every second and, while it's over, entries are evicted to bring
+// it back under (see cache.Evicter). This is a safety valve against the
+// overhead of entries, connections and the runtime getting the process
+// killed for running out of memory.
+//
+// If 'EnableWatch' is set, the admin `/watch` endpoint streams the key of
+// every command (and eviction, if the cache supports cache.EvictNotifier) as
+// it happens. This exposes key names and adds work to every command while a
+// client watches, so it is intended for debugging only and off by default.
+//
+// If 'TrackClients' is set, the commands, keys looked up, items stored and
+// bytes stored of every client IP are counted and reported by the admin
+// `/clients` endpoint (ie: for quotas or billing of a shared deployment).
+// Past the first 1024 IPs, new clients are counted together as "other".
+//
+// 'IdleBufferRelease' gives the read and write buffers of a connection back
+// to pools shared by every connection once it has waited that long for its
+// next command (0 never does), taking them again from the pools as the next
+// command arrives. With many mostly idle connections, memory is then taken by
+// the buffers of the active ones only.
+//
+// 'ReadBufferSize' and 'WriteBufferSize' are the sizes of each connection's
+// read and write buffers (both default to 4KB). A larger write buffer
+// takes fewer syscalls to reply to gets of many large values, smaller buffers
+// save memory with many mostly idle connections. Lines and values larger than
+// the read buffer are still read whole. With 'SharedAdminPort', an HTTP
+// request line must fit in the read buffer to be detected.
+//
+// 'ShedLatency' sheds load under overload (0 disables): once the moving
+// average of the time commands take (from being dispatched to their reply
+// being flushed) goes over it, commands other than 'CriticalCommands'
+// (defaults to get, gets and mg) are rejected with `SERVER_ERROR overloaded`
+// for a second, letting the work in flight drain. As replies are included,
+// slow clients count as well.
+//
+// 'CommandAliases' maps nonstandard verbs to the standard command they stand
+// for (ie: "put" to "set"), for legacy clients that can't be changed. Only
+// the verb is remapped: the arguments are those of the standard command. An
+// alias can't be a standard command or map to another alias, which Start
+// rejects. Commands are logged, counted and audited as the standard command.
+//
+// If 'CommandLog' is set, every successful mutating command is appended to it
+// (see CommandLog). The log is owned by the caller, which closes it after
+// Stop returns.
+//
+// If 'AccessLog' is set, every mutating command dispatched to the cache is
+// appended to it with its client and result, an audit trail of who changed
+// what (see AccessLog). Like 'CommandLog', it is owned by the caller.
+//
+// 'ConnHistory' is the number of commands each connection remembers (0
+// disables): the command, first keys and value length of its last
+// 'ConnHistory' commands, never the values themselves. They are logged when
+// the connection sends an invalid command or reading from it fails, and
+// returned by `/conns/kill`, to reproduce what a single misbehaving client
+// did without logging every command of every client.
+//
+// If 'StatsLog' is set, a snapshot of the stats (like `stats`, with the time
+// it was taken) is written to it as a line of JSON every 'StatsLogInterval'
+// (defaults to a minute), a lightweight time series of hit rate, evictions
+// and connections for looking back at an incident. Snapshots are taken by
+// their own goroutine, away from connections. Like 'CommandLog', the writer
+// is owned by the caller.
+//
+// If 'Logger' is set, the server logs to it instead of the log package (ie:
+// log.New(ioutil.Discard, "", 0) silences a server embedded in a larger
+// binary). The log level (see SetVerbosity) still applies. The command log
+// and the cache log the odd error with the log package regardless.
 type Server struct {
-	listener          net.Listener
+	ListenAddresses  []string
+	SharedAdminPort  bool
+	DisableEasterEgg bool
+	EnableStatsSizes bool
+	EnableWatch      bool
+	TrackClients     bool
+	IdempotentDelete bool
+	DedupeGetKeys    bool
+	ReadOnly         bool
+	ReusePort        bool
+
+	ListenBacklog        int
+	MaxConnectionsPerIP  int
+	MaxKeysPerGet        int
+	ParallelGetThreshold int
+	ParallelGetWorkers   int
+	SlowStart            time.Duration
+	MaxConnLifetime      time.Duration
+	IdleTimeout          time.Duration
+	IdleTimeoutJitter    float64
+	IdleBufferRelease    time.Duration
+	DataBlockTimeout     time.Duration
+	MaxHeap              uint64
+	ShedLatency          time.Duration
+	CriticalCommands     []string
+	CommandAliases       map[string]string
+	ReadBufferSize       int
+	WriteBufferSize      int
+	ConnHistory          int
+
+	CommandLog       *CommandLog
+	AccessLog        *AccessLog
+	StatsLog         io.Writer
+	StatsLogInterval time.Duration
+	Logger           *log.Logger
+
+	listeners         []net.Listener
 	port              int
 	adminHttpPort     int
 	numWorkers        int
 	maxNumConnections int
 	Cache             cache.Cache
 	adminHttpServer   *http.Server
+	adminListener     *connListener
 	startTime         time.Time
+	ready             chan struct{}
 	quit              chan struct{}
+	stopOnce          sync.Once
 	wg                sync.WaitGroup
+
+	// sampled access counts of keys for /hotkeys
+	hotKeys *hotKeys
+
+	// live feed of commands for /watch
+	watch *watchHub
+
+	// moving average of command latency for ShedLatency
+	shed loadShedder
+
+	// validated CommandAliases, resolved by every connection
+	aliases commandAliases
+
+	// how full the cache is, for the p flag of meta commands
+	fillGauge fillGauge
+
+	// buffers released by idle connections (see IdleBufferRelease)
+	buffers bufferPools
+
+	// open client connections for /conns
+	conns *connRegistry
+
+	// operation counts of each client for /clients
+	clients *clientTable
+
+	// number of open connections per client IP (k: IP)
+	connsPerIP   map[string]int
+	connsPerIPMu sync.Mutex
 }
 
 // New returns a new Server.
 func New(port, adminHttpPort, numWorkers, maxNumConnections int, cache cache.Cache) *Server {
 	return &Server{
-		port:              port,
-		adminHttpPort:     adminHttpPort,
-		numWorkers:        numWorkers,
-		maxNumConnections: maxNumConnections,
-		Cache:             cache,
-		wg:                sync.WaitGroup{},
-		quit:              make(chan struct{}),
+		port:               port,
+		adminHttpPort:      adminHttpPort,
+		numWorkers:         numWorkers,
+		maxNumConnections:  maxNumConnections,
+		MaxKeysPerGet:      defaultMaxKeysPerGet,
+		IdleTimeoutJitter:  defaultIdleTimeoutJitter,
+		ParallelGetWorkers: defaultParallelGetWorkers,
+		ReadBufferSize:     defaultBufferSize,
+		WriteBufferSize:    defaultBufferSize,
+		StatsLogInterval:   defaultStatsLogInterval,
+		CriticalCommands:   []string{cmdGet, cmdGets, cmdMetaGet},
+		Cache:              cache,
+		wg:                 sync.WaitGroup{},
+		ready:              make(chan struct{}),
+		quit:               make(chan struct{}),
+		connsPerIP:         make(map[string]int),
+		hotKeys:            newHotKeys(hotKeysSampleRate, hotKeysCapacity, hotKeysWindow),
+		watch:              newWatchHub(),
+		conns:              newConnRegistry(),
+		clients:            newClientTable(),
 	}
 }
 
-func (server *Server) connectionWorker(conns chan net.Conn) {
+func (server *Server) connectionWorker(conns chan net.Conn, delay time.Duration) {
 	defer server.wg.Done()
 
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-server.quit:
+			return
+		}
+	}
+
 Loop:
 	for {
 		select {
 		case conn := <-conns:
 			server.handleConnection(conn)
+			server.releaseConnection(conn)
 		case <-server.quit:
 			break Loop
 		}
@@ -62,48 +314,224 @@ Loop:
 }
 
 // Start function starts listing for incoming TCP requests
-// and also starts up an admin HTTP server.
-func (s *Server) Start() {
+// and also starts up an admin HTTP server (unless 'adminHttpPort' is 0).
+//
+// The server listens on every address in 'ListenAddresses', or on all
+// interfaces of 'port' if none are provided. Each listener has its own
+// accept loop, all feeding the same connection workers.
+//
+// Start blocks until the server is stopped. Failing to listen on any
+// address, the admin HTTP port included, stops the server and is returned
+// before any connection is accepted.
+func (s *Server) Start() error {
 	s.startTime = time.Now().UTC()
-	s.adminHttpServerStart(s.adminHttpPort)
+	defer s.Stop()
 
-	address := fmt.Sprintf(":%d", s.port)
-	l, err := net.Listen("tcp", address)
+	aliases, err := newCommandAliases(s.CommandAliases)
 	if err != nil {
-		log.Fatal(err)
+		s.logf("Server: %s\n", err)
+		return err
 	}
-	s.listener = l
-	defer s.Stop()
+	s.aliases = aliases
+
+	addresses := s.ListenAddresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf(":%d", s.port)}
+	}
+	for _, address := range addresses {
+		l, err := s.listen(address)
+		if err != nil {
+			s.logf("Server: failed to listen on (%s): %s\n", address, err)
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	if s.SharedAdminPort {
+		s.adminListener = newConnListener(s.listeners[0].Addr())
+	}
+	if err := s.adminHttpServerStart(s.adminHttpPort); err != nil {
+		s.logf("Server: failed to listen on admin HTTP port (%d): %s\n", s.adminHttpPort, err)
+		return err
+	}
+	close(s.ready)
 
 	conns := make(chan net.Conn, s.maxNumConnections)
 
+	if notifier, ok := s.Cache.(cache.EvictNotifier); ok && s.EnableWatch {
+		notifier.SetEvictHook(func(key string) { s.watch.publish(eventEvict, key) })
+	}
+	if s.MaxHeap > 0 {
+		s.wg.Add(1)
+		go s.heapWatcher()
+	}
+	if s.StatsLog != nil && s.StatsLogInterval > 0 {
+		s.wg.Add(1)
+		go s.statsLogger()
+	}
+
 	// create workers to handle incoming connections
 	for i := 0; i < s.numWorkers; i++ {
 		s.wg.Add(1)
-		go s.connectionWorker(conns)
+		go s.connectionWorker(conns, s.slowStartDelay(i))
+	}
+
+	var acceptWg sync.WaitGroup
+	for _, l := range s.listeners {
+		acceptWg.Add(1)
+		go func(l net.Listener) {
+			defer acceptWg.Done()
+			s.acceptLoop(l, conns)
+		}(l)
 	}
+	acceptWg.Wait()
+	return nil
+}
+
+// Addr returns the address of the (first) listener, once Start has bound
+// it, so a server started on port 0 can be reached on the port the OS
+// picked. It returns nil if the server is stopped before listening.
+func (s *Server) Addr() net.Addr {
+	select {
+	case <-s.ready:
+	case <-s.quit:
+	}
+	select {
+	case <-s.ready:
+		return s.listeners[0].Addr()
+	default:
+		return nil
+	}
+}
 
+// slowStartDelay returns how long worker 'i' waits before handling
+// connections (see SlowStart).
+func (s *Server) slowStartDelay(i int) time.Duration {
+	if s.SlowStart <= 0 || s.numWorkers <= 0 {
+		return 0
+	}
+	return s.SlowStart * time.Duration(i) / time.Duration(s.numWorkers)
+}
+
+// listen binds a TCP listener to the address, applying any socket options.
+func (s *Server) listen(address string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if s.ReusePort {
+		lc.Control = reusePortControl
+	}
+	l, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil || s.ListenBacklog <= 0 {
+		return l, err
+	}
+	if err := setListenBacklog(l, s.ListenBacklog); err == errListenBacklogUnsupported {
+		s.logAt(verbosityQuiet, "Server: %s, using the default\n", err)
+	} else if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// acceptLoop waits for new connections on the listener and hands
+// them off to the connection workers until the listener is closed.
+func (s *Server) acceptLoop(l net.Listener, conns chan net.Conn) {
 	for {
 		// wait for a new connection
 		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-s.quit:
+				// listener was closed by Stop
+				return
+			default:
+			}
 			// log.Print("Server: accept error:", err)
 			continue
 		}
 		if conn == nil {
-			log.Println("Server: received a nil conn, ignoring")
+			s.logAt(verbosityConnections, "Server: received a nil conn, ignoring\n")
+			continue
+		}
+		if !s.acquireConnection(conn) {
+			s.logAt(verbosityConnections, "Server: too many connections from client (%s), closing\n", conn.RemoteAddr())
+			StatsConnectionsRejectedPerIP.Add(1)
+			rejectConnection(conn)
 			continue
 		}
-		conns <- conn
+		select {
+		case conns <- conn:
+		case <-s.quit:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// how long a rejected connection is given to take its error reply
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// rejectConnection tells the client why its connection is being closed
+// before closing it, so it can log a reason rather than a bare reset. The
+// write can't hold up the accept loop for more than rejectWriteTimeout.
+func rejectConnection(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn.Write([]byte(replyTooManyConns))
+	conn.Close()
+}
+
+// remoteIP returns the IP of the client for the connection
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// acquireConnection counts a new connection against its client IP.
+// Returns false if the client is already at 'MaxConnectionsPerIP'.
+func (s *Server) acquireConnection(conn net.Conn) bool {
+	if s.MaxConnectionsPerIP <= 0 {
+		return true
+	}
+	ip := remoteIP(conn)
+
+	s.connsPerIPMu.Lock()
+	defer s.connsPerIPMu.Unlock()
+
+	if s.connsPerIP[ip] >= s.MaxConnectionsPerIP {
+		return false
+	}
+	s.connsPerIP[ip]++
+	return true
+}
+
+// releaseConnection stops counting a closed connection against its client IP.
+func (s *Server) releaseConnection(conn net.Conn) {
+	if s.MaxConnectionsPerIP <= 0 {
+		return
+	}
+	ip := remoteIP(conn)
+
+	s.connsPerIPMu.Lock()
+	defer s.connsPerIPMu.Unlock()
+
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
 	}
 }
 
 // Stop cleanly shutdowns the Server (and its dependencies).
+// It is safe to call Stop more than once.
 func (s *Server) Stop() {
-	s.listener.Close()
-	// wait for workers to cleanly shutdown
-	close(s.quit)
-	// shutdown admin http server
-	s.adminHttpServerStop()
-	s.wg.Wait()
+	s.stopOnce.Do(func() {
+		// wait for workers to cleanly shutdown
+		close(s.quit)
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		// shutdown admin http server
+		s.adminHttpServerStop()
+		s.wg.Wait()
+	})
 }
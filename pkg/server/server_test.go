@@ -1,8 +1,25 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,10 +28,10 @@ import (
 )
 
 func TestBasicTextProtocol(t *testing.T) {
-	port := 22222
 	cache := cache.NewLRU(1024*1024, 16)
-	srv := New(port, 8000, 8, 1024, cache)
+	srv := New(0, 0, 8, 1024, cache)
 	go srv.Start()
+	port := serverPort(t, srv)
 	defer srv.Stop()
 
 	address := fmt.Sprintf(":%d", port)
@@ -89,9 +106,9 @@ func TestEviction(t *testing.T) {
 	capacity := uint64(numEntries*10 + 1)
 	cache := cache.NewLRU(capacity, 1)
 
-	port := 33333
-	srv := New(port, 8001, 8, 1024, cache)
+	srv := New(0, 0, 8, 1024, cache)
 	go srv.Start()
+	port := serverPort(t, srv)
 	defer srv.Stop()
 
 	address := fmt.Sprintf(":%d", port)
@@ -135,9 +152,9 @@ func TestEviction(t *testing.T) {
 
 func TestKeys(t *testing.T) {
 	cache := cache.NewLRU(1024*1024, 16)
-	port := 44444
-	srv := New(port, 8002, 8, 1024, cache)
+	srv := New(0, 0, 8, 1024, cache)
 	go srv.Start()
+	port := serverPort(t, srv)
 	defer srv.Stop()
 
 	address := fmt.Sprintf(":%d", port)
@@ -166,11 +183,75 @@ func TestKeys(t *testing.T) {
 	}
 }
 
+func TestLargeValue(t *testing.T) {
+	cache := cache.NewLRU(16*1024*1024, 1)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	address := fmt.Sprintf(":%d", port)
+	client := memcache.New(address)
+
+	waitForServerToStart()
+
+	// well above the old 64KB line limit of bufio.Scanner
+	key := "large"
+	value := bytes.Repeat([]byte("0123456789"), 200*1024)
+	if err := client.Set(&memcache.Item{Key: key, Value: value}); err != nil {
+		t.Errorf("Set of key (%s) got unexpected error: %s\n", key, err)
+	}
+
+	it, err := client.Get(key)
+	if err != nil {
+		t.Fatalf("Get of key (%s) got unexpected error: %s\n", key, err)
+	}
+	if !bytes.Equal(it.Value, value) {
+		t.Errorf("Get of key (%s) got value of len (%d) but expected len (%d)\n", key, len(it.Value), len(value))
+	}
+}
+
+func TestSharedAdminPort(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	srv.SharedAdminPort = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	address := fmt.Sprintf(":%d", port)
+	client := memcache.New(address)
+
+	waitForServerToStart()
+
+	// memcache protocol on the shared port
+	key := "GET"
+	if err := client.Set(&memcache.Item{Key: key, Value: []byte("/ HTTP/1.1")}); err != nil {
+		t.Errorf("Set of key (%s) got unexpected error: %s\n", key, err)
+	}
+	if _, err := client.Get(key); err != nil {
+		t.Errorf("Get of key (%s) got unexpected error: %s\n", key, err)
+	}
+
+	// admin HTTP on the shared port
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/stats", port))
+	if err != nil {
+		t.Fatalf("GET /stats got unexpected error: %s\n", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /stats expected status (%d) but received (%d)\n", http.StatusOK, resp.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); !bytes.Contains(body, []byte("uptime")) {
+		t.Errorf("GET /stats received unexpected body: %s\n", body)
+	}
+}
+
 func TestCAS(t *testing.T) {
 	cache := cache.NewLRU(1024*1024, 16)
-	port := 55555
-	srv := New(port, 8003, 8, 1024, cache)
+	srv := New(0, 0, 8, 1024, cache)
 	go srv.Start()
+	port := serverPort(t, srv)
 	defer srv.Stop()
 
 	address := fmt.Sprintf(":%d", port)
@@ -265,7 +346,2182 @@ func TestCAS(t *testing.T) {
 
 }
 
-// wait a little bit for the server to be able to receive connections
-func waitForServerToStart() {
+func TestEasterEgg(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "hireeric?\r\n", "totes\r\n")
+
+	// disabled is treated as any other unsupported command
+	srv2 := New(0, 0, 8, 1024, cache)
+	srv2.DisableEasterEgg = true
+	go srv2.Start()
+	port = serverPort(t, srv2)
+	defer srv2.Stop()
+
+	waitForServerToStart()
+
+	conn2 := dialServer(t, port)
+	defer conn2.Close()
+	textRequest(t, conn2, "hireeric?\r\n", replyError)
+}
+
+func TestKeyTooLongIsRejected(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+
+	// the request is rejected as a whole, not executed after the error
+	key := string(bytes.Repeat([]byte("a"), maxKeyLength+1))
+	textRequest(t, conn, "get k1 "+key+"\r\n", "CLIENT_ERROR key is too long (max is 250 bytes)\r\n")
+	textRequest(t, conn, "get k1\r\n", replyEnd)
+}
+
+func TestMultipleListeners(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	srv.ListenAddresses = []string{"127.0.0.1:0", "127.0.0.1:0"}
+	go srv.Start()
+	port1 := serverPort(t, srv)
+	port2 := srv.listeners[1].Addr().(*net.TCPAddr).Port
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	// a value set through one listener is visible through the other
+	conn1 := dialServer(t, port1)
+	defer conn1.Close()
+	conn2 := dialServer(t, port2)
+	defer conn2.Close()
+	textRequest(t, conn1, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn2, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+}
+
+func TestStatsSizes(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	srv.EnableStatsSizes = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k2 0 0 14\r\nwombatwombat!!\r\n", replyStored)
+	textRequest(t, conn, "stats sizes\r\n", "STAT 8 1\r\nSTAT 16 1\r\nEND\r\n")
+	textRequest(t, conn, "stats wombat\r\n", "CLIENT_ERROR unknown stats group (wombat)\r\n")
+}
+
+func TestIdempotentDelete(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	srv.IdempotentDelete = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "delete k1\r\n", replyDeleted)
+	textRequest(t, conn, "delete k1\r\n", replyDeleted)
+}
+
+func TestReusePort(t *testing.T) {
+	srv := New(0, 0, 0, 0, nil)
+	srv.ReusePort = true
+
+	l1, err := srv.listen("127.0.0.1:0")
+	if err == ErrReusePortUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("listen got unexpected error: %s\n", err)
+	}
+	defer l1.Close()
+
+	// a second instance can bind the same port
+	address := l1.Addr().String()
+	l2, err := srv.listen(address)
+	if err != nil {
+		t.Fatalf("second listen on (%s) got unexpected error: %s\n", address, err)
+	}
+	l2.Close()
+}
+
+func TestListenBacklog(t *testing.T) {
+	srv := New(0, 0, 0, 0, nil)
+	srv.ListenBacklog = 4096
+
+	l, err := srv.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen got unexpected error: %s\n", err)
+	}
+	defer l.Close()
+	address := l.Addr().String()
+
+	// the listener still accepts connections once its backlog is changed
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial (%s) got unexpected error: %s\n", address, err)
+	}
+	defer conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept on (%s) got unexpected error: %s\n", address, err)
+	}
+	accepted.Close()
+}
+
+func TestAdminHttpBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen got unexpected error: %s\n", err)
+	}
+	defer taken.Close()
+
+	var logs bytes.Buffer
+	srv := New(0, taken.Addr().(*net.TCPAddr).Port, 8, 1024, cache.NewLRU(1024, 1))
+	srv.Logger = log.New(&logs, "", 0)
+	if err := srv.Start(); err == nil {
+		t.Fatalf("Start with the admin port in use expected an error\n")
+	}
+	if addr := srv.Addr(); addr != nil {
+		t.Errorf("Addr of a server that failed to start expected (nil) but received (%s)\n", addr)
+	}
+	if !strings.Contains(logs.String(), "failed to listen on admin HTTP port") {
+		t.Errorf("expected the bind failure to be logged but got (%s)\n", logs.String())
+	}
+
+	// port 0 doesn't start the admin interface at all
+	disabled := New(0, 0, 8, 1024, cache.NewLRU(1024, 1))
+	go disabled.Start()
+	serverPort(t, disabled)
+	defer disabled.Stop()
+
+	waitForServerToStart()
+
+	if disabled.adminHttpServer != nil {
+		t.Errorf("expected no admin HTTP server on port (0)\n")
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "incr counter 1\r\n", replyNotFound)
+	textRequest(t, conn, "set counter 0 0 2\r\n10\r\n", replyStored)
+	textRequest(t, conn, "incr counter 5\r\n", "15\r\n")
+	textRequest(t, conn, "decr counter 20\r\n", "0\r\n")
+	textRequest(t, conn, "incr counter wombat\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n")
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "incr k1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "ma counter\r\n", replyMetaNotFound)
+	textRequest(t, conn, "set counter 0 0 2\r\n10\r\n", replyStored)
+	textRequest(t, conn, "ma counter\r\n", "HD\r\n")
+	textRequest(t, conn, "ma counter D4 v\r\n", "VA 2\r\n15\r\n")
+	textRequest(t, conn, "ma counter MD D5 k Oabc\r\n", "HD kcounter Oabc\r\n")
+
+	// cas token must match for the update to be applied
+	_, _, cas, _ := cache.Get("counter")
+	textRequest(t, conn, fmt.Sprintf("ma counter C%d v\r\n", cas+1), replyMetaExists)
+	textRequest(t, conn, fmt.Sprintf("ma counter C%d v c\r\n", cas), fmt.Sprintf("VA 2 c%d\r\n11\r\n", cas+1))
+
+	textRequest(t, conn, "ma counter MX\r\n", "CLIENT_ERROR invalid mode for ma\r\n")
+	textRequest(t, conn, "ma counter z\r\n", "CLIENT_ERROR invalid flag\r\n")
+}
+
+func TestMetaGet(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	cache.SetStaleGrace(time.Minute)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "mg k1 v\r\n", replyMetaMiss)
+	textRequest(t, conn, "set k1 13 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "mg k1\r\n", "HD\r\n")
+	textRequest(t, conn, "mg k1 s v f k Oabc\r\n", "VA 6 s6 f13 kk1 Oabc\r\nwombat\r\n")
+
+	// expired but within the grace period, only the first client wins
+	textRequest(t, conn, "set k2 0 -1 3\r\nzoo\r\n", replyStored)
+	textRequest(t, conn, "mg k2 v\r\n", "VA 3 W X\r\nzoo\r\n")
+	textRequest(t, conn, "mg k2 v\r\n", "VA 3 X Z\r\nzoo\r\n")
+	textRequest(t, conn, "get k2\r\n", replyEnd)
+
+	// refreshed by the winner
+	textRequest(t, conn, "set k2 0 0 3\r\nzoo\r\n", replyStored)
+	textRequest(t, conn, "mg k2 v\r\n", "VA 3\r\nzoo\r\n")
+}
+
+func TestMetaSet(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "ms k1 6 F13 T0\r\nwombat\r\n", "HD\r\n")
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 13 6\r\nwombat\r\nEND\r\n")
+
+	// the returned cas token can be used directly without a gets
+	_, _, cas, _ := cache.Get("k1")
+	textRequest(t, conn, "ms k1 3 c k\r\nzoo\r\n", fmt.Sprintf("HD c%d kk1\r\n", cas+1))
+	textRequest(t, conn, fmt.Sprintf("cas k1 0 0 6 %d\r\nwombat\r\n", cas+1), replyStored)
+
+	// the stored size lets the client check the whole value was received
+	textRequest(t, conn, "ms k1 7 s k\r\nwombats\r\n", "HD s7 kk1\r\n")
+
+	// served as stale for its own grace, there's no default
+	textRequest(t, conn, "ms k2 3 T-1 X60\r\nzoo\r\n", "HD\r\n")
+	textRequest(t, conn, "mg k2 v\r\n", "VA 3 W X\r\nzoo\r\n")
+	textRequest(t, conn, "get k2\r\n", replyEnd)
+	textRequest(t, conn, "ms k2 3 T-1\r\nzoo\r\n", "HD\r\n")
+	textRequest(t, conn, "mg k2 v\r\n", replyMetaMiss)
+	textRequest(t, conn, "ms k2 3 X-1\r\nzoo\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+
+	textRequest(t, conn, "ms k1 3 z\r\nzoo\r\n", "CLIENT_ERROR invalid flag\r\n")
+	textRequest(t, conn, "ms k1 3 Fwombat\r\nzoo\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	srv.MaxConnectionsPerIP = 1
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn1 := dialServer(t, port)
+	textRequest(t, conn1, "get k1\r\n", replyEnd)
+
+	// second connection from the same IP is told why and closed right away
+	before := StatsConnectionsRejectedPerIP.Value()
+	conn2 := dialServer(t, port)
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := ioutil.ReadAll(conn2)
+	if err != nil || string(reply) != replyTooManyConns {
+		t.Errorf("Read on connection over the limit expected (%q) then EOF but received (%q) err (%v)\n", replyTooManyConns, reply, err)
+	}
+	if after := StatsConnectionsRejectedPerIP.Value(); after != before+1 {
+		t.Errorf("expected connections_rejected_per_ip to be (%d) but received (%d)\n", before+1, after)
+	}
+
+	// closing the first connection frees up its slot
+	conn1.Close()
 	time.Sleep(50 * time.Millisecond)
+	conn3 := dialServer(t, port)
+	defer conn3.Close()
+	textRequest(t, conn3, "get k1\r\n", replyEnd)
+}
+
+func TestAccessLog(t *testing.T) {
+	var logs lockedBuffer
+	access := NewAccessLog(&logs)
+
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.AccessLog = access
+	go srv.Start()
+	port := serverPort(t, srv)
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "incr k1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	textRequest(t, conn, "delete k9\r\n", replyNotFound)
+	textRequest(t, conn, "set k\"2\\ 0 0 3\r\nzoo\r\n", replyStored)
+	textRequest(t, conn, "ms k3 3 c\r\nzoo\r\n", "HD c3\r\n")
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	srv.Stop()
+	access.Close()
+
+	expected := []string{
+		addr + ` - - [] "set k1" "STORED" 6`,
+		addr + ` - - [] "incr k1" "CLIENT_ERROR cannot increment or decrement non-numeric value" -`,
+		addr + ` - - [] "delete k9" "NOT_FOUND" -`,
+		addr + ` - - [] "set k\x222\x5C" "STORED" 3`,
+		addr + ` - - [] "ms k3" "HD c3" 3`,
+	}
+	lines := strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected (%d) access log lines but got (%d): %q\n", len(expected), len(lines), lines)
+	}
+	for i, line := range lines {
+		// the time is checked on its own
+		start, end := strings.IndexByte(line, '['), strings.IndexByte(line, ']')
+		if start < 0 || end < start {
+			t.Fatalf("access log line (%s) has no time\n", line)
+		}
+		if _, err := time.Parse(accessLogTimeLayout, line[start+1:end]); err != nil {
+			t.Errorf("access log line (%s) has an invalid time: %s\n", line, err)
+		}
+		if line = line[:start+1] + line[end:]; line != expected[i] {
+			t.Errorf("access log line expected (%s) but got (%s)\n", expected[i], line)
+		}
+	}
+}
+
+func TestCommandLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.log")
+	commands, err := NewCommandLog(path)
+	if err != nil {
+		t.Fatalf("NewCommandLog for (%s) got unexpected error: %s\n", path, err)
+	}
+
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.CommandLog = commands
+	go srv.Start()
+	port := serverPort(t, srv)
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k2 3 3600 1\r\n5\r\n", replyStored)
+	textRequest(t, conn, "set k3 0 0 1\r\nx\r\n", replyStored)
+	textRequest(t, conn, "incr k2 10\r\n", "15\r\n")
+	textRequest(t, conn, "delete k3\r\n", replyDeleted)
+	textRequest(t, conn, "ms k4 6 F7 Gproduct:42,user:7\r\nwombat\r\n", "HD\r\n")
+	textRequest(t, conn, "ms k5 6 Guser:7\r\nwombat\r\n", "HD\r\n")
+	textRequest(t, conn, "ms k6 3 T-1 X60\r\nzoo\r\n", "HD\r\n")
+	conn.Close()
+	srv.Stop()
+	commands.Close()
+
+	// replay against a fresh server
+	replayed := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go replayed.Start()
+	port = serverPort(t, replayed)
+	defer replayed.Stop()
+
+	waitForServerToStart()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open of (%s) got unexpected error: %s\n", path, err)
+	}
+	defer file.Close()
+	failed, err := Replay(file, fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Replay got unexpected error: %s\n", err)
+	}
+	if failed != 0 {
+		t.Errorf("Replay expected no failed commands but (%d) failed\n", failed)
+	}
+
+	conn = dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "get k1 k2 k3\r\n", "VALUE k1 0 6\r\nwombat\r\nVALUE k2 3 2\r\n15\r\nEND\r\n")
+	textRequest(t, conn, "get k4 k5\r\n", "VALUE k4 7 6\r\nwombat\r\nVALUE k5 0 6\r\nwombat\r\nEND\r\n")
+
+	// the replayed entries are still tagged
+	replayed.Cache.(cache.Tagger).InvalidateTag("product:42")
+	textRequest(t, conn, "get k4 k5\r\n", "VALUE k5 0 6\r\nwombat\r\nEND\r\n")
+
+	// and still served as stale for their own grace
+	textRequest(t, conn, "mg k6 v\r\n", "VA 3 W X\r\nzoo\r\n")
+}
+
+func TestHotKeys(t *testing.T) {
+	h := newHotKeys(1, 3, time.Hour)
+	for i := 0; i < 5; i++ {
+		h.record("k1")
+	}
+	for i := 0; i < 3; i++ {
+		h.record("k2")
+	}
+	h.record("k3")
+
+	top := h.top(2)
+	expected := []hotKey{{Key: "k1", Count: 5}, {Key: "k2", Count: 3}}
+	if len(top) != len(expected) || top[0] != expected[0] || top[1] != expected[1] {
+		t.Errorf("top expected (%v) but received (%v)\n", expected, top)
+	}
+
+	// tracking a 4th key halves every count, forgetting k3 and k4
+	h.record("k4")
+	top = h.top(10)
+	expected = []hotKey{{Key: "k1", Count: 2}, {Key: "k2", Count: 1}}
+	if len(top) != len(expected) || top[0] != expected[0] || top[1] != expected[1] {
+		t.Errorf("top after decay expected (%v) but received (%v)\n", expected, top)
+	}
+}
+
+func TestMaxKeysPerGet(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.MaxKeysPerGet = 2
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "get k1 k2\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "get k1 k2 k3\r\n", "CLIENT_ERROR too many keys\r\n")
+	textRequest(t, conn, "gets k1 k2 k3\r\n", "CLIENT_ERROR too many keys\r\n")
+}
+
+func TestSlowStart(t *testing.T) {
+	srv := New(0, 0, 4, 0, nil)
+	if delay := srv.slowStartDelay(3); delay != 0 {
+		t.Errorf("slowStartDelay without SlowStart expected (0) but received (%s)\n", delay)
+	}
+
+	srv.SlowStart = 4 * time.Second
+	for i, expected := range []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second} {
+		if delay := srv.slowStartDelay(i); delay != expected {
+			t.Errorf("slowStartDelay for worker (%d) expected (%s) but received (%s)\n", i, expected, delay)
+		}
+	}
+}
+
+func TestClientErrorStats(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+
+	total, keyTooLong, badDataChunk := StatsErrNumClientErrors.Value(), StatsErrNumKeyTooLong.Value(), StatsErrNumBadDataChunk.Value()
+	textRequest(t, conn, "get "+strings.Repeat("k", maxKeyLength+1)+"\r\n", "CLIENT_ERROR key is too long (max is 250 bytes)\r\n")
+	textRequest(t, conn, "set k1 0 0 2\r\nwombat\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	if delta := StatsErrNumClientErrors.Value() - total; delta != 2 {
+		t.Errorf("err_num_client_errors expected to grow by (2) but grew by (%d)\n", delta)
+	}
+	if delta := StatsErrNumKeyTooLong.Value() - keyTooLong; delta != 1 {
+		t.Errorf("err_num_key_too_long expected to grow by (1) but grew by (%d)\n", delta)
+	}
+	if delta := StatsErrNumBadDataChunk.Value() - badDataChunk; delta != 1 {
+		t.Errorf("err_num_bad_data_chunk expected to grow by (1) but grew by (%d)\n", delta)
+	}
+}
+
+func TestDataBlockErrorStats(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, lru)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+
+	stats := []*expvar.Int{StatsErrNumBadCommand, StatsErrNumLineTooLong, StatsErrNumBadDataChunk, StatsErrNumDataLength, StatsErrNumDataTerminator, StatsErrNumDataItem, StatsErrNumDataTruncated}
+	before := make([]int64, len(stats))
+	for i, stat := range stats {
+		before[i] = stat.Value()
+	}
+	checkDeltas := func(expected ...int64) {
+		t.Helper()
+		for i, stat := range stats {
+			if delta := stat.Value() - before[i]; delta != expected[i] {
+				t.Errorf("expected stat (%d) to grow by (%d) but grew by (%d)\n", i, expected[i], delta)
+			}
+		}
+	}
+
+	textRequest(t, conn, "set k1 0 0 x\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	textRequest(t, conn, "ms k1 -1\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	textRequest(t, conn, "set k1 0 0 2\r\nwombat\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	textRequest(t, conn, "set k1 zoo 0 6\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+	textRequest(t, conn, strings.Repeat("k", 2*maxLineLength)+"\r\n", "CLIENT_ERROR line is too long\r\n")
+	// last, as it closes the connection
+	textRequest(t, conn, "mcas 1\r\nk1 0 0 x 1\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	// bad command, line too long, bad data chunk, length, terminator, item, truncated
+	checkDeltas(2, 1, 4, 2, 1, 1, 0)
+
+	// a connection closed in the middle of a data block
+	truncated := dialServer(t, port)
+	truncated.Write([]byte("set k1 0 0 10\r\nabc"))
+	truncated.Close()
+	for i := 0; i < 100 && StatsErrNumDataTruncated.Value() == before[6]; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkDeltas(2, 1, 4, 2, 1, 1, 1)
+
+	// or closed right after the value, before (or within) its terminator
+	for i, request := range []string{"set k2 0 0 6\r\nwombat", "ms k2 6\r\nwombat\r"} {
+		truncated := dialServer(t, port)
+		truncated.Write([]byte(request))
+		truncated.Close()
+		for j := 0; j < 100 && StatsErrNumDataTruncated.Value() == before[6]+1+int64(i); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	checkDeltas(2, 1, 4, 2, 1, 1, 3)
+	if _, _, _, err := lru.Get("k2"); err != cache.ErrCacheMiss {
+		t.Errorf("expected a value without its terminator not to be stored but got (%v)\n", err)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.MaxConnLifetime = 50 * time.Millisecond
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	time.Sleep(100 * time.Millisecond)
+
+	// the command past the lifetime is still replied to before closing
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after max lifetime expected (%s) but received (%v)\n", io.EOF, err)
+	}
+}
+
+func TestMultiCas(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	gets := func(key string) uint64 {
+		conn.Write([]byte("gets " + key + "\r\n"))
+		line, _ := reader.ReadString('\n')
+		var cas uint64
+		fmt.Sscanf(line, "VALUE "+key+" %d %d %d", new(int), new(int), &cas)
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		return cas
+	}
+	request := func(request, expected string) {
+		conn.Write([]byte(request))
+		if reply, _ := reader.ReadString('\n'); reply != expected {
+			t.Errorf("Request (%q) expected reply (%q) but received (%q)\n", request, expected, reply)
+		}
+	}
+
+	request("set k1 0 0 6\r\nwombat\r\n", replyStored)
+	request("set k2 0 0 6\r\nwombat\r\n", replyStored)
+	cas1, cas2 := gets("k1"), gets("k2")
+
+	request(fmt.Sprintf("mcas 2\r\nk1 0 0 3 %d\r\nzoo\r\nk3 0 0 3 %d\r\nzoo\r\n", cas1, cas2), replyNotFound)
+	request(fmt.Sprintf("mcas 2\r\nk1 0 0 3 %d\r\nzoo\r\nk2 0 0 3 %d\r\nzoo\r\n", cas1, cas1), replyExists)
+	request(fmt.Sprintf("mcas 2\r\nk1 0 0 3 %d\r\nzoo\r\nk2 0 0 3 %d\r\nzoo\r\n", cas1, cas2), replyStored)
+	request("get k1\r\n", "VALUE k1 0 3\r\n")
+	request("", "zoo\r\n")
+	request("", replyEnd)
+
+	// the rest of a malformed mcas can't be found reliably, so the
+	// connection is closed
+	request("mcas 1\r\nk1 0 0 3\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed but received err: %v\n", err)
+	}
+}
+
+func TestMultiCasMalformedItem(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k9 0 0 6\r\nwombat\r\n", replyStored)
+
+	// the value of the second item looks like a command, which must never run
+	conn.Write([]byte("mcas 2\r\nk1 0 0 x 1\r\nk2 0 0 9 5\r\ndelete k9\r\n"))
+	reader := bufio.NewReader(conn)
+	if reply, _ := reader.ReadString('\n'); reply != "CLIENT_ERROR bad data chunk\r\n" {
+		t.Errorf("expected (CLIENT_ERROR bad data chunk) but received (%q)\n", reply)
+	}
+	if reply, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed but received (%q) with err: %v\n", reply, err)
+	}
+
+	if value, _, _, err := srv.Cache.Get("k9"); err != nil || string(value) != "wombat" {
+		t.Errorf("GET for key (k9) expected (wombat) but received (%s) with err: %v\n", value, err)
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	adminPort := 8025
+	srv := New(0, adminPort, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+	defer SetVerbosity(verbosityConnections)
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "verbosity 0\r\n", replyOK)
+	if level := Verbosity(); level != 0 {
+		t.Errorf("verbosity expected (0) but received (%d)\n", level)
+	}
+	textRequest(t, conn, "verbosity loud\r\n", "CLIENT_ERROR invalid verbosity level\r\n")
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/verbosity?level=2", adminPort), "", nil)
+	if err != nil {
+		t.Fatalf("POST /verbosity got unexpected error: %s\n", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != `{"verbosity":2}` {
+		t.Errorf("POST /verbosity expected ({\"verbosity\":2}) but received (%s)\n", body)
+	}
+	if level := Verbosity(); level != 2 {
+		t.Errorf("verbosity expected (2) but received (%d)\n", level)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to write from the server's goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	var logs lockedBuffer
+	srv.Logger = log.New(&logs, "test: ", 0)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	textRequest(t, conn, "get k1\r\n", replyEnd)
+	conn.Close()
+	srv.flushHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/flush?prefix=k", nil))
+
+	for i := 0; i < 20 && !strings.Contains(logs.String(), "closed the connection"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, expected := range []string{
+		"test: handleConnection: client (" + conn.LocalAddr().String() + ") closed the connection after (",
+		") and (1) commands\n",
+		"test: flushHandler: deleted (0) entries with prefix (k)\n",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected the logs to contain (%s) but got (%s)\n", expected, logs.String())
+		}
+	}
+}
+
+func TestFlagsRoundTrip(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	for _, flags := range []uint32{0, 1, 1<<31 - 1, 1 << 31, 1<<32 - 1} {
+		textRequest(t, conn, fmt.Sprintf("set k1 %d 0 6\r\nwombat\r\n", flags), replyStored)
+		textRequest(t, conn, "get k1\r\n", fmt.Sprintf("VALUE k1 %d 6\r\nwombat\r\nEND\r\n", flags))
+		textRequest(t, conn, fmt.Sprintf("ms k2 6 F%d\r\nwombat\r\n", flags), "HD\r\n")
+		textRequest(t, conn, "mg k2 f\r\n", fmt.Sprintf("HD f%d\r\n", flags))
+	}
+
+	// flags past 32 bits are rejected rather than truncated
+	textRequest(t, conn, "ms k2 6 F4294967296\r\nwombat\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+	textRequest(t, conn, "set k1 4294967296 0 6\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+	textRequest(t, conn, "get k1\r\n", fmt.Sprintf("VALUE k1 %d 6\r\nwombat\r\nEND\r\n", uint32(1<<32-1)))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Minute, 0.1); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter of (1m) by (0.1) expected between (54s) and (66s) but received (%s)\n", d)
+		}
+	}
+
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.IdleTimeout = 100 * time.Millisecond
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		// keeps being extended while the client is active
+		time.Sleep(50 * time.Millisecond)
+		textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read from idle connection expected (%s) but received (%v)\n", io.EOF, err)
+	}
+}
+
+func TestIdleBufferRelease(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.IdleBufferRelease = 20 * time.Millisecond
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	before := StatsIdleBuffersReleased.Value()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	time.Sleep(60 * time.Millisecond)
+	if released := StatsIdleBuffersReleased.Value() - before; released != 1 {
+		t.Fatalf("expected the buffers of an idle connection to be released once but got (%d)\n", released)
+	}
+
+	// the first byte of the next command isn't lost, nor pipelined commands
+	textRequest(t, conn, "get k1\r\nget k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\nVALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	// nor released in the middle of a command
+	conn.Write([]byte("get"))
+	time.Sleep(60 * time.Millisecond)
+	textRequest(t, conn, " k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	if released := StatsIdleBuffersReleased.Value() - before; released != 1 {
+		t.Errorf("expected no release in the middle of a command but got (%d) releases\n", released)
+	}
+}
+
+func TestConnectionReadErrors(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.IdleTimeout = 50 * time.Millisecond
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	waitForClose := func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Read expected (%s) but received (%v)\n", io.EOF, err)
+		}
+	}
+
+	// closing in the middle of a data block is still the client closing
+	before := StatsConnectionReadErrors.Value()
+	conn := dialServer(t, port)
+	defer conn.Close()
+	conn.Write([]byte("set k1 0 0 6\r\nwom"))
+	conn.(*net.TCPConn).CloseWrite()
+	waitForClose(conn)
+	if errors := StatsConnectionReadErrors.Value() - before; errors != 0 {
+		t.Errorf("expected no read error for a client closing but got (%d)\n", errors)
+	}
+
+	// timing out isn't
+	idle := dialServer(t, port)
+	defer idle.Close()
+	waitForClose(idle)
+	if errors := StatsConnectionReadErrors.Value() - before; errors != 1 {
+		t.Errorf("expected a read error for an idle connection but got (%d)\n", errors)
+	}
+}
+
+func TestDataBlockTimeout(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.DataBlockTimeout = 50 * time.Millisecond
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	// no timeout waiting for the next command line
+	conn := dialServer(t, port)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+
+	// nor for a data block arriving in time, if slowly
+	conn.Write([]byte("set k2 0 0 6\r\nwom"))
+	time.Sleep(20 * time.Millisecond)
+	textRequest(t, conn, "bat\r\n", replyStored)
+
+	before := StatsErrNumDataTimeout.Value()
+	stalled := dialServer(t, port)
+	defer stalled.Close()
+	stalled.Write([]byte("set k3 0 0 6\r\nwom"))
+	stalled.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read with a stalled data block expected (%s) but received (%v)\n", io.EOF, err)
+	}
+	if timeouts := StatsErrNumDataTimeout.Value() - before; timeouts != 1 {
+		t.Errorf("expected a data block timeout but got (%d)\n", timeouts)
+	}
+	textRequest(t, conn, "get k3\r\n", "END\r\n")
+}
+
+func TestProcessStats(t *testing.T) {
+	stats := processStats()
+	for _, name := range []string{"rusage_user", "rusage_system", "rusage_maxrss", "rss"} {
+		if _, err := strconv.ParseFloat(stats[name], 64); err != nil {
+			t.Errorf("stat (%s) expected a number but received (%s)\n", name, stats[name])
+		}
+	}
+	if runtime.GOOS == "linux" && (stats["rss"] == "0" || stats["rusage_maxrss"] == "0") {
+		t.Errorf("expected a non-zero rss and maxrss but received (%s) and (%s)\n", stats["rss"], stats["rusage_maxrss"])
+	}
+}
+
+func TestParallelGet(t *testing.T) {
+	srv := New(0, 0, 0, 0, cache.NewLRU(1024*1024, 16))
+	srv.ParallelGetThreshold = 2
+	srv.ParallelGetWorkers = 3
+	commands := cache.NewCommands(srv.Cache)
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+		if i%3 != 0 {
+			commands.Set(keys[i], []byte(keys[i]), 0, 0)
+		}
+	}
+	for i, result := range srv.getItems(commands, keys) {
+		if result.found != (i%3 != 0) || (result.found && string(result.item.Value) != keys[i]) {
+			t.Errorf("getItems for key (%s) received unexpected result (%+v)\n", keys[i], result)
+		}
+	}
+}
+
+func TestOutOfMemory(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024, 1))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	value := strings.Repeat("x", 1024)
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k1 0 0 1024\r\n"+value+"\r\n", replyOutOfMemory)
+	textRequest(t, conn, "ms k1 1024\r\n"+value+"\r\n", replyOutOfMemory)
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+}
+
+func TestMetaPressure(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(100, 1))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "ms k1 8 p k\r\nwombats!\r\n", "HD p10 kk1\r\n")
+	// reused until it is read again
+	textRequest(t, conn, "ms k2 38 p\r\n"+strings.Repeat("z", 38)+"\r\n", "HD p10\r\n")
+	atomic.StoreInt64(&srv.fillGauge.readAt, 0)
+	textRequest(t, conn, "mg k1 p v\r\n", "VA 8 p50\r\nwombats!\r\n")
+	textRequest(t, conn, "mg k3 p\r\n", replyMetaMiss)
+
+	if percent := fillPercent(120, 100); percent != 100 {
+		t.Errorf("fillPercent over capacity expected (100) but received (%d)\n", percent)
+	}
+}
+
+func TestMetaDelete(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 13 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k2 0 0 3\r\nzoo\r\n", replyStored)
+	textRequest(t, conn, "md k1 f v Oxyz\r\n", "VA 6 f13 Oxyz\r\nwombat\r\n")
+	textRequest(t, conn, "md k1 v\r\n", "NF\r\n")
+	textRequest(t, conn, "md k2 k\r\n", "HD kk2\r\n")
+	textRequest(t, conn, "get k1 k2\r\n", replyEnd)
+	textRequest(t, conn, "md k2 z\r\n", "CLIENT_ERROR invalid flag\r\n")
+}
+
+func TestStatsSettings(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	lru.EnableRandomEviction()
+	srv := New(0, 0, 8, 1024, lru)
+	srv.IdleTimeout = time.Minute
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("stats settings\r\n")); err != nil {
+		t.Fatalf("Write of stats settings got unexpected error: %s\n", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	settings := make(map[string]string)
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read of stats settings got unexpected error: %s\n", err)
+		}
+		if line == replyEnd {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("stats settings got unexpected line (%q)\n", line)
+		}
+		settings[fields[1]] = fields[2]
+	}
+
+	expected := map[string]string{
+		"capacity":            "1048576",
+		"num_buckets":         "16",
+		"num_workers":         "8",
+		"max_num_connections": "1024",
+		"max_key_length":      "250",
+		"max_keys_per_get":    "1024",
+		"idle_timeout":        "1m0s",
+		"eviction_policy":     "random",
+	}
+	for name, value := range expected {
+		if settings[name] != value {
+			t.Errorf("setting (%s) expected (%s) but received (%s)\n", name, value, settings[name])
+		}
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	// an empty value is stored (and distinct from a miss)
+	textRequest(t, conn, "set k1 5 0 0\r\n\r\n", replyStored)
+	textRequest(t, conn, "get k1 k2\r\n", "VALUE k1 5 0\r\n\r\nEND\r\n")
+	textRequest(t, conn, "mg k1 s f v\r\n", "VA 0 s0 f5\r\n\r\n")
+	textRequest(t, conn, "mg k2 v\r\n", "EN\r\n")
+	textRequest(t, conn, "incr k1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+
+	// a value can be emptied and filled again
+	textRequest(t, conn, "ms k2 0\r\n\r\n", "HD\r\n")
+	textRequest(t, conn, "get k2\r\n", "VALUE k2 0 0\r\n\r\nEND\r\n")
+	textRequest(t, conn, "set k2 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k2 0 0 0\r\n\r\n", replyStored)
+	textRequest(t, conn, "get k2\r\n", "VALUE k2 0 0\r\n\r\nEND\r\n")
+
+	// the empty data block still has to be terminated by \r\n
+	textRequest(t, conn, "set k3 0 0 0\r\nx\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	textRequest(t, conn, "get k3\r\n", replyEnd)
+}
+
+func TestReadOnly(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	lru.Add("k1", []byte("5"), 0, 0)
+	srv := New(0, 0, 8, 1024, lru)
+	srv.ReadOnly = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	requests := []string{
+		"set k1 0 0 6\r\nwombat\r\n",
+		"cas k1 0 0 6 1\r\nwombat\r\n",
+		"delete k1\r\n",
+		"incr k1 1\r\n",
+		"decr k1 1\r\n",
+		"ma k1\r\n",
+		"md k1\r\n",
+		"ms k1 6\r\nwombat\r\n",
+		"mcas 1\r\nk1 0 0 6 1\r\nwombat\r\n",
+	}
+	for _, request := range requests {
+		textRequest(t, conn, request, replyReadOnly)
+	}
+
+	// reads are still served, and the value is untouched
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 1\r\n5\r\nEND\r\n")
+	textRequest(t, conn, "mg k1 v\r\n", "VA 1\r\n5\r\n")
+}
+
+func TestMetaGetAccessTracking(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	lru.EnableAccessTracking()
+	srv := New(0, 0, 8, 1024, lru)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	// h, l and a describe the item before this access
+	textRequest(t, conn, "mg k1 h a\r\n", "HD h0 a0\r\n")
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "mg k1 h a\r\n", "HD h1 a2\r\n")
+	if _, err := conn.Write([]byte("mg k1 l\r\n")); err != nil {
+		t.Fatalf("Write of mg got unexpected error: %s\n", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || (line != "HD l0\r\n" && line != "HD l1\r\n") {
+		t.Errorf("mg k1 l expected a last access under a second ago but received (%q) err (%v)\n", line, err)
+	}
+
+	// storing the item again resets its access statistics
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "mg k1 a h\r\n", "HD a0 h0\r\n")
+}
+
+func TestMaxHeap(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	for i := 0; i < 100; i++ {
+		lru.Add(strconv.Itoa(i), []byte("wombat"), 0, 0)
+	}
+	srv := New(0, 0, 8, 1024, lru)
+
+	// under the limit nothing is evicted
+	srv.MaxHeap = 1 << 40
+	srv.checkHeap(lru)
+	if _, _, _, err := lru.Get("0"); err != nil {
+		t.Errorf("GET for key (0) received unexpected err: %s\n", err)
+	}
+
+	// the heap in use is always over a single byte, so everything goes
+	srv.MaxHeap = 1
+	srv.checkHeap(lru)
+	for i := 0; i < 100; i++ {
+		if _, _, _, err := lru.Get(strconv.Itoa(i)); err != cache.ErrCacheMiss {
+			t.Errorf("GET for key (%d) expected (%s) but received (%v)\n", i, cache.ErrCacheMiss, err)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// room for a single entry per bucket
+	srv := New(0, 8035, 8, 1024, cache.NewLRU(10, 1))
+	srv.EnableWatch = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	resp, err := http.Get("http://localhost:8035/watch?seconds=5")
+	if err != nil {
+		t.Fatalf("GET /watch received unexpected err: %s\n", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("GET /watch expected content type (text/event-stream) but received (%s)\n", ct)
+	}
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k2 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "get k2\r\n", "VALUE k2 0 6\r\nwombat\r\nEND\r\n")
+
+	expected := []string{
+		"event: set", "data: k1", "",
+		"event: set", "data: k2", "",
+		"event: evict", "data: k1", "",
+		"event: get", "data: k2", "",
+	}
+	reader := bufio.NewReader(resp.Body)
+	for _, line := range expected {
+		received, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("GET /watch received unexpected err: %s\n", err)
+		}
+		if strings.TrimSuffix(received, "\n") != line {
+			t.Errorf("GET /watch expected line (%q) but received (%q)\n", line, received)
+		}
+	}
+
+	// watching is opt-in
+	recorder := httptest.NewRecorder()
+	New(0, 0, 8, 1024, cache.NewLRU(10, 1)).watchHandler(recorder, httptest.NewRequest("GET", "/watch", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /watch expected status (%d) but received (%d)\n", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestBucketFlushHandler(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 1)
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	lru.Add("k2", []byte("wombat"), 0, 0)
+	srv := New(0, 0, 8, 1024, lru)
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/buckets/0/flush", http.StatusMethodNotAllowed, ""},
+		{"POST", "/buckets/x/flush", http.StatusBadRequest, ""},
+		{"POST", "/buckets/1/flush", http.StatusNotFound, ""},
+		{"POST", "/buckets/0", http.StatusNotFound, ""},
+		{"POST", "/buckets/0/flush", 200, `{"deleted":2}`},
+		{"POST", "/buckets/0/flush", 200, `{"deleted":0}`},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		srv.bucketFlushHandler(recorder, httptest.NewRequest(test.method, test.path, nil))
+		if recorder.Code != test.code {
+			t.Errorf("%s %s expected status (%d) but received (%d)\n", test.method, test.path, test.code, recorder.Code)
+		}
+		if test.body != "" && recorder.Body.String() != test.body {
+			t.Errorf("%s %s expected (%s) but received (%s)\n", test.method, test.path, test.body, recorder.Body.String())
+		}
+	}
+}
+
+func TestVerifyHandler(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 1)
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	srv := New(0, 0, 8, 1024, lru)
+
+	recorder := httptest.NewRecorder()
+	srv.verifyHandler(recorder, httptest.NewRequest("GET", "/verify", nil))
+	if recorder.Code != 200 || recorder.Body.String() != `{"discrepancies":[]}` {
+		t.Errorf("expected no discrepancy but received (%d) (%s)\n", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCommandAliases(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.CommandAliases = map[string]string{"put": "set", "fetch": "get"}
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "put k1 0 0 6\r\nwombat\r\n", "STORED\r\n")
+	textRequest(t, conn, "fetch k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "fetch@1000 k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "fetch\r\n", "CLIENT_ERROR Insufficient args\r\n")
+	textRequest(t, conn, "store k1 0 0 6\r\n", "ERROR\r\n")
+
+	if settings := srv.getSettings(); settings["command_aliases"] != "fetch=get,put=set" {
+		t.Errorf("expected command_aliases (fetch=get,put=set) but received (%s)\n", settings["command_aliases"])
+	}
+}
+
+func TestCommandAliasesInvalid(t *testing.T) {
+	tests := []map[string]string{
+		{"get": "set"},
+		{"put": "store"},
+		{"put": "set", "store": "put"},
+		{"": "set"},
+		{"p ut": "set"},
+		{"put@1": "set"},
+	}
+	for _, aliases := range tests {
+		var logs bytes.Buffer
+		srv := New(0, 0, 8, 1024, cache.NewLRU(1024, 1))
+		srv.CommandAliases = aliases
+		srv.Logger = log.New(&logs, "", 0)
+		if err := srv.Start(); err == nil {
+			t.Errorf("Start with aliases (%v) expected an error\n", aliases)
+		}
+		if !strings.Contains(logs.String(), "alias") {
+			t.Errorf("expected the invalid aliases (%v) to be logged but got (%s)\n", aliases, logs.String())
+		}
+	}
+}
+
+func TestMetaSetTags(t *testing.T) {
+	cache := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "ms k1 6 Gproduct:42\r\nwombat\r\n", "HD\r\n")
+	textRequest(t, conn, "ms k2 6 Guser:7,product:42\r\nwombat\r\n", "HD\r\n")
+	textRequest(t, conn, "ms k3 6 Guser:7\r\nwombat\r\n", "HD\r\n")
+	textRequest(t, conn, "ms k4 6 G\r\nwombat\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+	textRequest(t, conn, "ms k4 6 Gproduct:42,\r\nwombat\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/tags/invalidate?tag=product:42", http.StatusMethodNotAllowed, ""},
+		{"POST", "/tags/invalidate", http.StatusBadRequest, ""},
+		{"POST", "/tags/invalidate?tag=product:42", 200, `{"invalidated":"product:42"}`},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		srv.tagInvalidateHandler(recorder, httptest.NewRequest(test.method, test.path, nil))
+		if recorder.Code != test.code {
+			t.Errorf("%s %s expected status (%d) but received (%d)\n", test.method, test.path, test.code, recorder.Code)
+		}
+		if test.body != "" && recorder.Body.String() != test.body {
+			t.Errorf("%s %s expected (%s) but received (%s)\n", test.method, test.path, test.body, recorder.Body.String())
+		}
+	}
+
+	textRequest(t, conn, "get k1 k2 k3\r\n", "VALUE k3 0 6\r\nwombat\r\nEND\r\n")
+}
+
+func TestNamespace(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, lru)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	tenant := dialServer(t, port)
+	defer tenant.Close()
+	other := dialServer(t, port)
+	defer other.Close()
+
+	textRequest(t, tenant, "namespace a:\r\n", replyOK)
+	textRequest(t, tenant, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, tenant, "ms k2 3 k\r\nzoo\r\n", "HD kk2\r\n")
+	// keys are echoed as sent
+	textRequest(t, tenant, "get k1 k2 k3\r\n", "VALUE k1 0 6\r\nwombat\r\nVALUE k2 0 3\r\nzoo\r\nEND\r\n")
+	textRequest(t, tenant, "mg k1 k v\r\n", "VA 6 kk1\r\nwombat\r\n")
+	_, _, cas, _ := lru.Get("a:k1")
+	textRequest(t, tenant, fmt.Sprintf("mcas 1\r\nk1 0 0 3 %d\r\nemu\r\n", cas), replyStored)
+	textRequest(t, tenant, "incr k1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+
+	// stored under the namespace, invisible to other connections
+	textRequest(t, other, "get k1\r\n", replyEnd)
+	textRequest(t, other, "get a:k1\r\n", "VALUE a:k1 0 3\r\nemu\r\nEND\r\n")
+
+	// the namespace counts towards the key length
+	textRequest(t, tenant, "namespace "+strings.Repeat("n", maxKeyLength+1)+"\r\n", "CLIENT_ERROR "+ErrKeyTooLong.Error()+"\r\n")
+	textRequest(t, tenant, "namespace "+strings.Repeat("n", maxKeyLength)+"\r\n", replyOK)
+	textRequest(t, tenant, "get k1\r\n", "CLIENT_ERROR "+ErrKeyTooLong.Error()+"\r\n")
+	textRequest(t, tenant, "namespace a: b:\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+
+	// back to plain keys
+	textRequest(t, tenant, "namespace\r\n", replyOK)
+	textRequest(t, tenant, "get a:k1\r\n", "VALUE a:k1 0 3\r\nemu\r\nEND\r\n")
+}
+
+func TestDedupeGetKeys(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	lru.Add("k2", []byte("zoo"), 0, 0)
+	srv := New(0, 0, 8, 1024, lru)
+	srv.DedupeGetKeys = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	deduped := StatsGetKeysDeduped.Value()
+	// a repeated key is returned once, in the order first requested
+	textRequest(t, conn, "get k1 k2 k1 k3 k1\r\n", "VALUE k1 0 6\r\nwombat\r\nVALUE k2 0 3\r\nzoo\r\nEND\r\n")
+	textRequest(t, conn, "gets k2 k2\r\n", "VALUE k2 0 3 2\r\nzoo\r\nEND\r\n")
+	if got := StatsGetKeysDeduped.Value() - deduped; got != 3 {
+		t.Errorf("expected 3 keys deduped, got %d", got)
+	}
+
+	// repeated keys are compared as stored, after the namespace
+	textRequest(t, conn, "namespace a:\r\n", replyOK)
+	textRequest(t, conn, "set k1 0 0 3\r\nemu\r\n", replyStored)
+	textRequest(t, conn, "get k1 k1\r\n", "VALUE k1 0 3\r\nemu\r\nEND\r\n")
+}
+
+func TestGetDeadline(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	lru.Add("k1", []byte("wombat"), 0, 0)
+	srv := New(0, 0, 8, 1024, lru)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	// a generous budget returns the values as usual
+	textRequest(t, conn, "get@10000 k1 k2\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "gets@10000 k1\r\n", "VALUE k1 0 6 1\r\nwombat\r\nEND\r\n")
+	// only get and gets take a budget
+	textRequest(t, conn, "delete@10 k1\r\n", "CLIENT_ERROR bad command modifier\r\n")
+	textRequest(t, conn, "get@0 k1\r\n", "CLIENT_ERROR bad command modifier\r\n")
+
+	// a spent budget abandons the keys left
+	keys := []string{"k1", "k2", "k3"}
+	commands := cache.NewCommands(lru)
+	if _, ok := srv.getItemsWithin(commands, keys, time.Nanosecond); ok {
+		t.Errorf("expected the keys to be abandoned past the deadline\n")
+	}
+	results, ok := srv.getItemsWithin(commands, keys, time.Minute)
+	if !ok || !results[0].found || results[1].found {
+		t.Errorf("expected every key to be looked up within the deadline but got (%+v) (%v)\n", results, ok)
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	// smaller than the lines and values, which are still read and written whole
+	srv.ReadBufferSize = 16
+	srv.WriteBufferSize = 16
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	key := strings.Repeat("k", 100)
+	value := strings.Repeat("v", 1000)
+	textRequest(t, conn, fmt.Sprintf("set %s 0 0 %d\r\n%s\r\n", key, len(value), value), replyStored)
+	textRequest(t, conn, fmt.Sprintf("get %s %s\r\n", key, key), strings.Repeat(fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\n", key, len(value), value), 2)+replyEnd)
+
+	settings := srv.getSettings()
+	if settings["read_buffer_size"] != "16" || settings["write_buffer_size"] != "16" {
+		t.Errorf("expected buffer sizes of 16 in settings but got (%s) and (%s)\n", settings["read_buffer_size"], settings["write_buffer_size"])
+	}
+}
+
+func TestLargeMultiGet(t *testing.T) {
+	lru := cache.NewLRU(1024*1024, 16)
+	srv := New(0, 0, 8, 1024, lru)
+	// reaching the TCP connection wrapped for the idle timeout
+	srv.IdleTimeout = time.Minute
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	// a reply much larger than the write buffer, with misses in between
+	value := strings.Repeat("v", 100)
+	var request, expected, expectedCas strings.Builder
+	request.WriteString("get")
+	for i := 0; i < 200; i++ {
+		key := "k" + strconv.Itoa(i)
+		request.WriteString(" " + key)
+		if i%10 == 0 {
+			continue
+		}
+		cas, _ := lru.Add(key, []byte(value), uint32(i), 0)
+		fmt.Fprintf(&expected, "VALUE %s %d %d\r\n%s\r\n", key, i, len(value), value)
+		fmt.Fprintf(&expectedCas, "VALUE %s %d %d %d\r\n%s\r\n", key, i, len(value), cas, value)
+	}
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, request.String()+"\r\n", expected.String()+replyEnd)
+	textRequest(t, conn, "gets"+strings.TrimPrefix(request.String(), "get")+"\r\n", expectedCas.String()+replyEnd)
+	// still in sync with the buffered replies
+	textRequest(t, conn, "get k1\r\n", fmt.Sprintf("VALUE k1 1 %d\r\n%s\r\n%s", len(value), value, replyEnd))
+}
+
+func TestQuitMidPipeline(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	// commands after quit are not executed, but every reply before it is sent
+	pipeline := "set k1 0 0 6\r\nwombat\r\nget k1\r\nquit\r\nset k1 0 0 3\r\nzoo\r\nget k1\r\n"
+	if _, err := conn.Write([]byte(pipeline)); err != nil {
+		t.Fatalf("Write of pipeline got unexpected error: %s\n", err)
+	}
+	// the server's side is closed (FIN) without waiting for the client to close
+	conn.SetReadDeadline(time.Now().Add(quitLinger / 2))
+	reply, err := ioutil.ReadAll(conn)
+	expected := replyStored + "VALUE k1 0 6\r\nwombat\r\n" + replyEnd
+	if err != nil || string(reply) != expected {
+		t.Errorf("expected replies (%q) then EOF but received (%q) err (%v)\n", expected, reply, err)
+	}
+
+	conn2 := dialServer(t, port)
+	defer conn2.Close()
+	textRequest(t, conn2, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+}
+
+func TestStatsLog(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	reader, writer := io.Pipe()
+	srv.StatsLog = writer
+	srv.StatsLogInterval = 20 * time.Millisecond
+	go srv.Start()
+	defer srv.Stop()
+	// unblocks a snapshot being written while stopping
+	defer reader.Close()
+
+	waitForServerToStart()
+
+	lines := bufio.NewReader(reader)
+	var last time.Time
+	for i := 0; i < 2; i++ {
+		line, err := lines.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("failed to read stats snapshot: %s\n", err)
+		}
+		var stats map[string]string
+		if err := json.Unmarshal(line, &stats); err != nil {
+			t.Fatalf("failed to decode stats snapshot (%q): %s\n", line, err)
+		}
+		at, err := time.Parse(time.RFC3339, stats["time"])
+		if err != nil {
+			t.Errorf("expected a snapshot time but got (%q): %s\n", stats["time"], err)
+		}
+		if at.Before(last) {
+			t.Errorf("expected snapshot times to increase but got (%s) after (%s)\n", at, last)
+		}
+		last = at
+		if _, ok := stats["num_get"]; !ok {
+			t.Errorf("expected num_get in the stats snapshot (%q)\n", line)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	var shed loadShedder
+	for i := 0; i < 100; i++ {
+		shed.record(time.Millisecond, time.Second)
+	}
+	if shed.shedding() {
+		t.Errorf("expected no shedding with an average latency of (%s)\n", shed.average())
+	}
+	for i := 0; i < 100 && !shed.shedding(); i++ {
+		shed.record(10*time.Second, time.Second)
+	}
+	if !shed.shedding() {
+		t.Errorf("expected shedding with an average latency of (%s)\n", shed.average())
+	}
+
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	// every command is slower than this, shedding after the first one
+	srv.ShedLatency = time.Nanosecond
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	before := StatsErrNumOverloaded.Value()
+	textRequest(t, conn, "set k1 0 0 3\r\nzoo\r\n", replyOverloaded)
+	textRequest(t, conn, "delete k1\r\n", replyOverloaded)
+	// critical commands are still served
+	textRequest(t, conn, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	if delta := StatsErrNumOverloaded.Value() - before; delta != 2 {
+		t.Errorf("err_num_overloaded expected to grow by (2) but grew by (%d)\n", delta)
+	}
+}
+
+func TestKillConnection(t *testing.T) {
+	adminPort := 8036
+	srv := New(0, adminPort, 8, 1024, cache.NewLRU(1024*1024, 16))
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	bad := dialServer(t, port)
+	defer bad.Close()
+	good := dialServer(t, port)
+	defer good.Close()
+	// wait for both connections to be handled
+	textRequest(t, bad, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, good, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+
+	admin := fmt.Sprintf("http://localhost:%d", adminPort)
+	resp, err := http.Get(admin + "/conns")
+	if err != nil {
+		t.Fatalf("GET /conns got unexpected error: %s\n", err)
+	}
+	var conns []connSummary
+	err = json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode /conns: %s\n", err)
+	}
+	listed := make(map[string]bool)
+	for _, conn := range conns {
+		listed[conn.Addr] = true
+	}
+	if len(conns) != 2 || !listed[bad.LocalAddr().String()] || !listed[good.LocalAddr().String()] {
+		t.Fatalf("expected /conns to list (%s) and (%s) but got %+v\n", bad.LocalAddr(), good.LocalAddr(), conns)
+	}
+
+	kill := func(addr string) bool {
+		resp, err := http.Post(admin+"/conns/kill?addr="+url.QueryEscape(addr), "", nil)
+		if err != nil {
+			t.Fatalf("POST /conns/kill got unexpected error: %s\n", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]bool
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode /conns/kill: %s\n", err)
+		}
+		return result["found"]
+	}
+	if !kill(bad.LocalAddr().String()) {
+		t.Fatalf("expected to find connection (%s)\n", bad.LocalAddr())
+	}
+	bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the killed connection to be closed but got: %v\n", err)
+	}
+	if kill("127.0.0.1:1") {
+		t.Errorf("expected no connection for an unknown address\n")
+	}
+
+	// other clients are unaffected
+	textRequest(t, good, "get k1\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+}
+
+func TestConnHistory(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.ConnHistory = 3
+	var logs lockedBuffer
+	srv.Logger = log.New(&logs, "", 0)
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k0 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "get k1 k2 k3 k4 k5 k6\r\n", "VALUE k1 0 6\r\nwombat\r\nEND\r\n")
+	textRequest(t, conn, "set k2 zoo 0 6\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+
+	// only the last commands are kept, without their values
+	dump := logs.String()
+	for _, expected := range []string{
+		"last (3) commands of client (" + conn.LocalAddr().String() + "), invalid command:",
+		" set k1 (6 bytes)\n",
+		" get k1 k2 k3 k4 (+2 keys)\n",
+		" error: bad token in command line format\n",
+	} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("expected the logs to contain (%s) but got (%s)\n", expected, dump)
+		}
+	}
+	if strings.Contains(dump, "k0") || strings.Contains(dump, "wombat") {
+		t.Errorf("expected the logs not to contain the first command nor any value but got (%s)\n", dump)
+	}
+
+	// killing the connection returns the commands since the last dump
+	textRequest(t, conn, "delete k1\r\n", replyDeleted)
+	recorder := httptest.NewRecorder()
+	srv.connsKillHandler(recorder, httptest.NewRequest("POST", "/conns/kill?addr="+url.QueryEscape(conn.LocalAddr().String()), nil))
+	var result connKillResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode /conns/kill: %s\n", err)
+	}
+	if !result.Found || len(result.History) != 1 || !strings.HasSuffix(result.History[0], " delete k1") {
+		t.Errorf("expected /conns/kill to return the delete but got %+v\n", result)
+	}
+}
+
+func TestTrackClients(t *testing.T) {
+	srv := New(0, 0, 8, 1024, cache.NewLRU(1024*1024, 16))
+	srv.TrackClients = true
+	go srv.Start()
+	port := serverPort(t, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	conn := dialServer(t, port)
+	defer conn.Close()
+	textRequest(t, conn, "set k1 0 0 6\r\nwombat\r\n", replyStored)
+	textRequest(t, conn, "ms k2 3\r\nzoo\r\n", "HD\r\n")
+	textRequest(t, conn, "get k1 k2 k3\r\n", "VALUE k1 0 6\r\nwombat\r\nVALUE k2 0 3\r\nzoo\r\nEND\r\n")
+	textRequest(t, conn, "delete k2\r\n", replyDeleted)
+	// rejected commands aren't counted
+	textRequest(t, conn, "set k1 zoo 0 6\r\n", "CLIENT_ERROR bad token in command line format\r\n")
+
+	recorder := httptest.NewRecorder()
+	srv.clientsHandler(recorder, httptest.NewRequest("GET", "/clients", nil))
+	var clients []clientSummary
+	if err := json.Unmarshal(recorder.Body.Bytes(), &clients); err != nil {
+		t.Fatalf("failed to decode /clients: %s\n", err)
+	}
+	expected := clientSummary{Client: "127.0.0.1", Commands: 4, Gets: 3, Sets: 2, Bytes: 9}
+	if len(clients) != 1 || clients[0] != expected {
+		t.Errorf("expected /clients to return %+v but got %+v\n", expected, clients)
+	}
+
+	// clients past the limit are counted together
+	table := newClientTable()
+	for i := 0; i < maxTrackedClients; i++ {
+		table.counts(strconv.Itoa(i))
+	}
+	if table.counts("10.0.0.1") != table.counts("10.0.0.2") || table.counts("0") == table.counts("10.0.0.1") {
+		t.Errorf("expected clients past the limit to share their counts\n")
+	}
+	if n := len(table.list()); n != maxTrackedClients+1 {
+		t.Errorf("expected (%d) clients listed but got (%d)\n", maxTrackedClients+1, n)
+	}
+
+	// tracking is opt-in
+	recorder = httptest.NewRecorder()
+	New(0, 0, 8, 1024, cache.NewLRU(1024, 1)).clientsHandler(recorder, httptest.NewRequest("GET", "/clients", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /clients expected status (%d) but received (%d)\n", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	seeds := []string{
+		"get k1",
+		"get k1 k2 k3",
+		"get k1 ",
+		"get",
+		"gets k1 k2",
+		"get@50 k1 k2",
+		"set k1 0 0 5",
+		"set k1 0 0 5 noreply",
+		"set k1 0 0 -1",
+		"set k1 0 0 5abc",
+		"set k1 0 0",
+		"cas k1 0 0 5 10",
+		"cas k1 0 0 5",
+		"delete k1",
+		"delete ",
+		"incr k1 1",
+		"decr k1 -1",
+		"ma k1 D5",
+		"md k1 q",
+		"mg k1 v f",
+		"ms k1 5 T0",
+		"ms k1 -5",
+		"mcas 2",
+		"verbosity 1",
+		"stats sizes",
+		"",
+		" ",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		r, err := parseRequest(line, nil)
+		if err != nil {
+			return
+		}
+		if r.cmd == "" {
+			t.Errorf("parseRequest (%q) returned a request without a command\n", line)
+		}
+		switch r.cmd {
+		case cmdCas, cmdDelete, cmdDecr, cmdGet, cmdGets, cmdIncr, cmdSet,
+			cmdMetaArithmetic, cmdMetaDelete, cmdMetaGet, cmdMetaSet:
+			if len(r.keys) == 0 {
+				t.Errorf("parseRequest (%q) returned a %s without keys\n", line, r.cmd)
+			}
+		}
+		for _, key := range r.keys {
+			if key == "" {
+				t.Errorf("parseRequest (%q) returned an empty key\n", line)
+			}
+		}
+		if r.n < 0 {
+			t.Errorf("parseRequest (%q) returned a negative length (%d)\n", line, r.n)
+		}
+	})
+}
+
+func TestParseRequestRejectsMalformed(t *testing.T) {
+	lines := []string{
+		"get",
+		"set k1 0 0",
+		"set k1 0 0 -1",
+		"set k1 0 0 5abc",
+		"set k1 0x 0 5",
+		"cas k1 0 0 5",
+		"cas k1 0 0 5 1x",
+		"ms k1 -5",
+		" \t ",
+	}
+	for _, line := range lines {
+		if _, err := parseRequest(line, nil); err == nil {
+			t.Errorf("parseRequest (%q) expected an error\n", line)
+		}
+	}
+
+	r, err := parseRequest("set k1 7 60 5 noreply", nil)
+	if err != nil {
+		t.Fatalf("parseRequest failed: %s\n", err)
+	}
+	if r.keys[0] != "k1" || r.flags != 7 || r.expTime != 60 || r.n != 5 {
+		t.Errorf("parseRequest returned unexpected request (%+v)\n", r)
+	}
+}
+
+func TestParseRequestWhitespace(t *testing.T) {
+	tests := []struct {
+		line string
+		cmd  string
+		keys []string
+	}{
+		{"get k1 ", cmdGet, []string{"k1"}},
+		{"get  k1   k2", cmdGet, []string{"k1", "k2"}},
+		{"gets\tk1\t k2", cmdGets, []string{"k1", "k2"}},
+		{" delete k1", cmdDelete, []string{"k1"}},
+		{"incr\tk1\t5", cmdIncr, []string{"k1"}},
+		{"set  k1 0\t0  5 ", cmdSet, []string{"k1"}},
+		{"cas k1  0 0 5\t10", cmdCas, []string{"k1"}},
+		{"mg  k1  v\tf", cmdMetaGet, []string{"k1"}},
+	}
+	for _, test := range tests {
+		r, err := parseRequest(test.line, nil)
+		if err != nil {
+			t.Errorf("parseRequest (%q) failed: %s\n", test.line, err)
+			continue
+		}
+		if r.cmd != test.cmd || strings.Join(r.keys, ",") != strings.Join(test.keys, ",") {
+			t.Errorf("parseRequest (%q) expected cmd (%s) and keys (%v) got (%s) and (%v)\n", test.line, test.cmd, test.keys, r.cmd, r.keys)
+		}
+	}
+
+	r, err := parseRequest("mg\tk1  v  f", nil)
+	if err != nil || strings.Join(r.args, ",") != "v,f" {
+		t.Errorf("parseRequest expected meta flags (v,f) got (%v) (%v)\n", r.args, err)
+	}
+}
+
+// serverPort returns the port the started server is listening on
+func serverPort(tb testing.TB, srv *Server) int {
+	addr := srv.Addr()
+	if addr == nil {
+		tb.Fatalf("Server stopped before listening\n")
+	}
+	return addr.(*net.TCPAddr).Port
+}
+
+// dialServer opens a raw connection to the server on 'port'
+func dialServer(t *testing.T, port int) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Dial to port (%d) got unexpected error: %s\n", port, err)
+	}
+	return conn
+}
+
+// textRequest writes a raw text protocol request and verifies the reply
+func textRequest(t *testing.T, conn net.Conn, request, expected string) {
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Write of request (%q) got unexpected error: %s\n", request, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read of reply to request (%q) got unexpected error: %s\n", request, err)
+	}
+	if string(reply) != expected {
+		t.Errorf("Request (%q) expected reply (%q) but received (%q)\n", request, expected, reply)
+	}
+}
+
+// repeatReader returns the same payload 'count' times before returning io.EOF.
+type repeatReader struct {
+	payload []byte
+	offset  int
+	count   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.count == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.payload[r.offset:])
+	r.offset += n
+	if r.offset == len(r.payload) {
+		r.offset = 0
+		r.count--
+	}
+	return n, nil
+}
+
+func BenchmarkConnReaderSet1MB(b *testing.B) {
+	value := bytes.Repeat([]byte("a"), 1024*1024)
+	payload := []byte(fmt.Sprintf("set k1 0 0 %d%s%s%s", len(value), endOfLine, value, endOfLine))
+
+	requests := make(chan Request)
+	go connReader(bufio.NewReader(&repeatReader{payload: payload, count: b.N}), requests, nil, nil, nil)
+
+	b.SetBytes(int64(len(value)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := <-requests
+		if request.err != nil {
+			b.Fatalf("unexpected error: %s\n", request.err)
+		}
+		if len(request.dataBlock) != len(value) {
+			b.Fatalf("expected data block of len (%d) but received (%d)\n", len(value), len(request.dataBlock))
+		}
+	}
+	<-requests
+}
+
+func BenchmarkGet1MB(b *testing.B) {
+	cache := cache.NewLRU(16*1024*1024, 1)
+	srv := New(0, 0, 8, 1024, cache)
+	go srv.Start()
+	port := serverPort(b, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	value := bytes.Repeat([]byte("a"), 1024*1024)
+	cache.Add("k1", value, 0, 0)
+	expected := len(fmt.Sprintf("VALUE k1 0 %d%s%s%s", len(value), endOfLine, endOfLine, replyEnd)) + len(value)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		b.Fatalf("Dial got unexpected error: %s\n", err)
+	}
+	defer conn.Close()
+	reply := make([]byte, expected)
+	request := []byte("get k1\r\n")
+
+	b.SetBytes(int64(len(value)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(request)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			b.Fatalf("Read of reply got unexpected error: %s\n", err)
+		}
+	}
+}
+
+// writeSyscalls returns the number of write system calls made by the process
+// so far (from /proc/self/io), or false if it isn't available.
+func writeSyscalls() (int64, bool) {
+	data, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw: ") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(line, "syscw: "), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+func BenchmarkMultiGet200Reply(b *testing.B) {
+	lru := cache.NewLRU(64*1024*1024, 16)
+	srv := New(0, 0, 8, 1024, lru)
+	go srv.Start()
+	port := serverPort(b, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	request := "get"
+	expected := len(replyEnd)
+	for i := 0; i < 200; i++ {
+		key := "key:" + strconv.Itoa(i)
+		lru.Add(key, value, 0, 0)
+		request += " " + key
+		expected += len(fmt.Sprintf("VALUE %s 0 %d\r\n", key, len(value))) + len(value) + len(endOfLine)
+	}
+	request += "\r\n"
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		b.Fatalf("Dial got unexpected error: %s\n", err)
+	}
+	defer conn.Close()
+	reply := make([]byte, expected)
+
+	before, ok := writeSyscalls()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write([]byte(request))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			b.Fatalf("Read of reply got unexpected error: %s\n", err)
+		}
+	}
+	b.StopTimer()
+	if after, _ := writeSyscalls(); ok {
+		// includes the client's write of each request
+		b.ReportMetric(float64(after-before)/float64(b.N), "writes/op")
+	}
+}
+
+func BenchmarkServerGetSet(b *testing.B) {
+	cache := cache.NewLRU(64*1024*1024, 16)
+	srv := New(0, 0, 64, 1024, cache)
+	go srv.Start()
+	port := serverPort(b, srv)
+	defer srv.Stop()
+
+	waitForServerToStart()
+
+	value := []byte("0123456789012345678901234567890123456789")
+	for i := 0; i < 1000; i++ {
+		cache.Add("key:"+strconv.Itoa(i), value, 0, 0)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			b.Fatalf("Dial got unexpected error: %s\n", err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		i := 0
+		for pb.Next() {
+			key := "key:" + strconv.Itoa(i%1000)
+			if i%10 == 0 {
+				fmt.Fprintf(conn, "set %s 0 0 %d\r\n%s\r\n", key, len(value), value)
+				readLine(reader)
+			} else {
+				fmt.Fprintf(conn, "get %s\r\n", key)
+				// VALUE line, data block, END
+				for j := 0; j < 3; j++ {
+					readLine(reader)
+				}
+			}
+			i++
+		}
+	})
+}
+
+// wait a little bit for the server to be able to receive connections
+func waitForServerToStart() {
+	time.Sleep(50 * time.Millisecond)
+}
+
+func BenchmarkMultiGet500(b *testing.B) {
+	srv := New(0, 0, 0, 0, cache.NewLRU(64*1024*1024, 256))
+	commands := cache.NewCommands(srv.Cache)
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+		commands.Set(keys[i], []byte("wombat"), 0, 0)
+	}
+
+	for _, threshold := range []int{0, 100} {
+		name := "serial"
+		if threshold > 0 {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			srv.ParallelGetThreshold = threshold
+			for i := 0; i < b.N; i++ {
+				srv.getItems(commands, keys)
+			}
+		})
+	}
+}
+
+// BenchmarkSingleGet compares a single key get through the general multi-get
+// path with its fast path (see writeSingleGet), from parsing the command line
+// to the reply.
+func BenchmarkSingleGet(b *testing.B) {
+	srv := New(0, 0, 0, 0, cache.NewLRU(1024*1024, 16))
+	commands := cache.NewCommands(srv.Cache)
+	commands.Set("key:1", []byte("0123456789012345678901234567890123456789"), 0, 0)
+	writer := bufio.NewWriter(ioutil.Discard)
+
+	b.Run("general", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			request, _ := parseRequest("get key:1", nil)
+			request.withNamespace("")
+			writeGetReply(writer, nil, request.clientKeys, srv.getItems(commands, request.keys), false)
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		header := make([]byte, 0, 64)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			request, _ := parseRequest("get key:1", nil)
+			request.withNamespace("")
+			header = writeSingleGet(writer, commands, request.keys[0], request.clientKeys[0], false, header)
+		}
+	})
+}
+
+// BenchmarkIdleConnections reports the heap taken by each of b.N idle
+// connections (client side included), with their buffers held and released
+// (see IdleBufferRelease). Run with a fixed number of connections, ie:
+// -benchtime 5000x.
+func BenchmarkIdleConnections(b *testing.B) {
+	for _, release := range []time.Duration{0, 10 * time.Millisecond} {
+		name := "held"
+		if release > 0 {
+			name = "released"
+		}
+		b.Run(name, func(b *testing.B) {
+			srv := New(0, 0, b.N+1, b.N+1, cache.NewLRU(1024*1024, 16))
+			srv.IdleBufferRelease = release
+			go srv.Start()
+			port := serverPort(b, srv)
+			defer srv.Stop()
+
+			var before runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			conns := make([]net.Conn, b.N)
+			reply := make([]byte, len(replyEnd))
+			for i := range conns {
+				conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+				if err != nil {
+					b.Fatalf("Dial got unexpected error: %s\n", err)
+				}
+				defer conn.Close()
+				conn.Write([]byte("get k1\r\n"))
+				if _, err := io.ReadFull(conn, reply); err != nil {
+					b.Fatalf("Read of reply got unexpected error: %s\n", err)
+				}
+				conns[i] = conn
+			}
+			// every connection is now idle
+			time.Sleep(10*release + 100*time.Millisecond)
+
+			var after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/float64(b.N), "heap-B/conn")
+			b.ReportMetric(0, "ns/op")
+		})
+	}
 }
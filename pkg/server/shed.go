@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// weight of each new latency in the moving average (1/shedSmoothing)
+	shedSmoothing = 16
+	// how long non-critical commands are rejected once triggered
+	shedCooldown = time.Second
+)
+
+// loadShedder keeps a moving average of the time commands take, and rejects
+// non-critical commands for a while once it's over 'ShedLatency' (see
+// ShedLatency).
+//
+// Rejected commands aren't part of the average, so rather than waiting for
+// the average to come down (which might never happen if every command is
+// rejected), shedding stops after shedCooldown. Commands then flow again,
+// and shedding starts over if they are still slow.
+type loadShedder struct {
+	// exponential moving average of command latency (in nanoseconds)
+	avgNanos int64
+	// unix time (in nanoseconds) until which non-critical commands are rejected
+	shedUntil int64
+}
+
+// record adds the latency of a command to the moving average, starting to
+// shed load if the average is now over 'threshold'. Returns the new average
+// if this started shedding, 0 otherwise.
+func (l *loadShedder) record(latency, threshold time.Duration) time.Duration {
+	for {
+		old := atomic.LoadInt64(&l.avgNanos)
+		avg := old + (int64(latency)-old)/shedSmoothing
+		if atomic.CompareAndSwapInt64(&l.avgNanos, old, avg) {
+			if avg > int64(threshold) && !l.shedding() {
+				atomic.StoreInt64(&l.shedUntil, time.Now().Add(shedCooldown).UnixNano())
+				StatsLoadShedTriggered.Add(1)
+				return time.Duration(avg)
+			}
+			return 0
+		}
+	}
+}
+
+// shedding reports whether non-critical commands are being rejected
+func (l *loadShedder) shedding() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&l.shedUntil)
+}
+
+// average returns the moving average of command latency
+func (l *loadShedder) average() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.avgNanos))
+}
+
+// critical reports whether the command is never shed (see CriticalCommands)
+func (s *Server) critical(cmd string) bool {
+	for _, critical := range s.CriticalCommands {
+		if cmd == critical {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"regexp"
+	"sync"
+)
+
+// When the admin HTTP interface shares the memcache port, the first line
+// of each new connection is inspected to decide which protocol it speaks.
+// Only a full HTTP request-line (ie: "GET /stats HTTP/1.1") is treated as
+// HTTP. Memcache commands are lower case and never end in an HTTP version,
+// so a memcache "get" is never mistaken for an HTTP GET.
+
+var httpRequestLine = regexp.MustCompile(`^(GET|HEAD|POST|PUT|DELETE|OPTIONS|PATCH) /\S* HTTP/1\.[01]\r?\n$`)
+
+var errListenerClosed = errors.New("listener closed")
+
+// isHTTPRequest peeks at the first line of the connection (without
+// consuming it) and returns true if it is an HTTP request-line.
+func isHTTPRequest(reader *bufio.Reader) bool {
+	for n := 1; n <= reader.Size(); n++ {
+		b, err := reader.Peek(n)
+		if err != nil {
+			return false
+		}
+		if b[n-1] == '\n' {
+			return httpRequestLine.Match(b)
+		}
+	}
+	return false
+}
+
+// sniffedConn is a net.Conn whose reads first drain the bytes already
+// buffered while sniffing the protocol.
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connListener is a net.Listener fed with connections handed off
+// from the memcache listener.
+type connListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		addr:  addr,
+		done:  make(chan struct{}),
+	}
+}
+
+// handoff passes the connection to the listener's consumer.
+// Returns false if the listener has been closed.
+func (l *connListener) handoff(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -1,18 +1,69 @@
 package server
 
 import (
+	"bufio"
 	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/sfjuggernaut/go-memcached/pkg/cache"
 )
 
 var (
 	StatsNumCas    = expvar.NewInt("num_cas")
+	StatsNumDecr   = expvar.NewInt("num_decr")
 	StatsNumDelete = expvar.NewInt("num_delete")
 	StatsNumGet    = expvar.NewInt("num_get")
 	StatsNumGets   = expvar.NewInt("num_gets")
+	StatsNumIncr   = expvar.NewInt("num_incr")
 	StatsNumSet    = expvar.NewInt("num_set")
 
+	// repeated keys of a get or gets not looked up again (see DedupeGetKeys)
+	StatsGetKeysDeduped = expvar.NewInt("get_keys_deduped")
+
 	StatsErrNumUnsupportedCmds = expvar.NewInt("err_num_unsupported_cmds")
+	StatsErrNumReadOnly        = expvar.NewInt("err_num_read_only")
+	StatsErrNumTimeouts        = expvar.NewInt("err_num_timeouts")
+	StatsErrNumOverloaded      = expvar.NewInt("err_num_overloaded")
+
+	// every CLIENT_ERROR reply, some broken down by reason
+	StatsErrNumClientErrors = expvar.NewInt("err_num_client_errors")
+	StatsErrNumBadCommand   = expvar.NewInt("err_num_bad_command")
+	StatsErrNumLineTooLong  = expvar.NewInt("err_num_line_too_long")
+	StatsErrNumKeyTooLong   = expvar.NewInt("err_num_key_too_long")
+	StatsErrNumBadDataChunk = expvar.NewInt("err_num_bad_data_chunk")
+
+	// data block framing errors by cause (all also in err_num_bad_data_chunk),
+	// and connections closed in the middle of a data block or abandoned for
+	// it not arriving in time (see DataBlockTimeout)
+	StatsErrNumDataLength     = expvar.NewInt("err_num_data_length")
+	StatsErrNumDataTerminator = expvar.NewInt("err_num_data_terminator")
+	StatsErrNumDataItem       = expvar.NewInt("err_num_data_item")
+	StatsErrNumDataTruncated  = expvar.NewInt("err_num_data_truncated")
+	StatsErrNumDataTimeout    = expvar.NewInt("err_num_data_timeout")
+
+	StatsConnectionsRejectedPerIP = expvar.NewInt("connections_rejected_per_ip")
+	StatsConnectionsRecycled      = expvar.NewInt("connections_recycled")
+	StatsConnectionsKilled        = expvar.NewInt("connections_killed")
+
+	// connections closed because reading failed, rather than by the client
+	StatsConnectionReadErrors = expvar.NewInt("connection_read_errors")
+
+	// times the buffers of an idle connection were released (see IdleBufferRelease)
+	StatsIdleBuffersReleased = expvar.NewInt("idle_buffers_released")
+
+	StatsCommandLogDropped = expvar.NewInt("command_log_dropped")
+	StatsAccessLogDropped  = expvar.NewInt("access_log_dropped")
+
+	// times load shedding started (see ShedLatency)
+	StatsLoadShedTriggered = expvar.NewInt("load_shed_triggered")
+
+	// evictions triggered by the heap growing past MaxHeap
+	StatsHeapLimitEvictions    = expvar.NewInt("heap_limit_evictions")
+	StatsHeapLimitEvictedBytes = expvar.NewInt("heap_limit_evicted_bytes")
 )
 
 // uptime returns time.Duration since server started
@@ -30,6 +81,157 @@ func (s *Server) getStats() map[string]string {
 
 	stats["start_time"] = s.startTime.String()
 	stats["uptime"] = s.uptime().String()
+	stats["curr_connections"] = strconv.Itoa(s.conns.len())
+	if ager, ok := s.Cache.(cache.Ager); ok {
+		stats["oldest_item_age_seconds"] = strconv.FormatInt(ager.OldestItemAge(), 10)
+	}
+	if reporter, ok := s.Cache.(cache.MemoryReporter); ok {
+		memory := reporter.MemoryBreakdown()
+		stats["key_bytes"] = strconv.FormatUint(memory.Keys, 10)
+		stats["value_bytes"] = strconv.FormatUint(memory.Values, 10)
+		stats["tag_bytes"] = strconv.FormatUint(memory.Tags, 10)
+		stats["overhead_bytes"] = strconv.FormatUint(memory.Overhead, 10)
+	}
+	if s.ShedLatency > 0 {
+		stats["command_latency_avg_ns"] = strconv.FormatInt(int64(s.shed.average()), 10)
+		stats["load_shedding"] = strconv.FormatBool(s.shed.shedding())
+	}
+	for name, value := range processStats() {
+		stats[name] = value
+	}
 
 	return stats
 }
+
+// getSettings returns the effective configuration of the server and its
+// cache (if the cache reports its settings, see cache.SettingsReporter).
+func (s *Server) getSettings() map[string]string {
+	addresses := s.ListenAddresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf(":%d", s.port)}
+	}
+	settings := map[string]string{
+		"port":                   strconv.Itoa(s.port),
+		"admin_http_port":        strconv.Itoa(s.adminHttpPort),
+		"num_workers":            strconv.Itoa(s.numWorkers),
+		"max_num_connections":    strconv.Itoa(s.maxNumConnections),
+		"listen_backlog":         strconv.Itoa(s.ListenBacklog),
+		"max_connections_per_ip": strconv.Itoa(s.MaxConnectionsPerIP),
+		"max_key_length":         strconv.Itoa(maxKeyLength),
+		"max_line_length":        strconv.Itoa(maxLineLength),
+		"max_value_length":       strconv.Itoa(maxValueLength),
+		"max_keys_per_get":       strconv.Itoa(s.MaxKeysPerGet),
+		"parallel_get_threshold": strconv.Itoa(s.ParallelGetThreshold),
+		"parallel_get_workers":   strconv.Itoa(s.ParallelGetWorkers),
+		"slow_start":             s.SlowStart.String(),
+		"max_conn_lifetime":      s.MaxConnLifetime.String(),
+		"idle_timeout":           s.IdleTimeout.String(),
+		"idle_timeout_jitter":    strconv.FormatFloat(s.IdleTimeoutJitter, 'f', -1, 64),
+		"data_block_timeout":     s.DataBlockTimeout.String(),
+		"idle_buffer_release":    s.IdleBufferRelease.String(),
+		"max_heap":               strconv.FormatUint(s.MaxHeap, 10),
+		"shed_latency":           s.ShedLatency.String(),
+		"critical_commands":      strings.Join(s.CriticalCommands, ","),
+		"command_aliases":        s.aliases.String(),
+		"read_buffer_size":       strconv.Itoa(s.ReadBufferSize),
+		"write_buffer_size":      strconv.Itoa(s.WriteBufferSize),
+		"conn_history":           strconv.Itoa(s.ConnHistory),
+		"listen_addresses":       strings.Join(addresses, ","),
+		"shared_admin_port":      strconv.FormatBool(s.SharedAdminPort),
+		"reuse_port":             strconv.FormatBool(s.ReusePort),
+		"idempotent_delete":      strconv.FormatBool(s.IdempotentDelete),
+		"dedupe_get_keys":        strconv.FormatBool(s.DedupeGetKeys),
+		"read_only":              strconv.FormatBool(s.ReadOnly),
+		"stats_sizes":            strconv.FormatBool(s.EnableStatsSizes),
+		"watch":                  strconv.FormatBool(s.EnableWatch),
+		"track_clients":          strconv.FormatBool(s.TrackClients),
+		"command_log":            strconv.FormatBool(s.CommandLog != nil),
+		"access_log":             strconv.FormatBool(s.AccessLog != nil),
+		"stats_log":              strconv.FormatBool(s.StatsLog != nil),
+		"stats_log_interval":     s.StatsLogInterval.String(),
+		"verbosity":              strconv.Itoa(Verbosity()),
+	}
+	if reporter, ok := s.Cache.(cache.SettingsReporter); ok {
+		for name, value := range reporter.Settings() {
+			settings[name] = value
+		}
+	}
+	return settings
+}
+
+// unsupportedProcessStats reports zero for every process stat.
+func unsupportedProcessStats() map[string]string {
+	return map[string]string{
+		"rusage_user":   "0.000000",
+		"rusage_system": "0.000000",
+		"rusage_maxrss": "0",
+		"rss":           "0",
+	}
+}
+
+// getSizeStats returns a histogram of entry sizes (in power of two ranges)
+// or nil if the size histogram is disabled or unsupported by the cache.
+//
+// This walks the entire cache, so it is only enabled via 'EnableStatsSizes'.
+func (s *Server) getSizeStats() map[uint64]uint64 {
+	if !s.EnableStatsSizes {
+		return nil
+	}
+	histogrammer, ok := s.Cache.(cache.SizeHistogrammer)
+	if !ok {
+		return nil
+	}
+	return histogrammer.SizeHistogram()
+}
+
+// writeStats replies to the `stats` text command with each stat on
+// its own "STAT <name> <value>" line.
+func (s *Server) writeStats(writer *bufio.Writer, args []string) {
+	if len(args) == 0 {
+		stats := s.getStats()
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writer.WriteString(fmt.Sprintf("STAT %s %s%s", name, stats[name], endOfLine))
+		}
+		writer.WriteString(replyEnd)
+		writer.Flush()
+		return
+	}
+
+	switch args[0] {
+	case "settings":
+		settings := s.getSettings()
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writer.WriteString(fmt.Sprintf("STAT %s %s%s", name, settings[name], endOfLine))
+		}
+	case "sizes":
+		sizes := s.getSizeStats()
+		if sizes == nil {
+			writer.WriteString(fmt.Sprintf("STAT sizes_status disabled%s", endOfLine))
+			break
+		}
+		ranges := make([]uint64, 0, len(sizes))
+		for size := range sizes {
+			ranges = append(ranges, size)
+		}
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i] < ranges[j] })
+		for _, size := range ranges {
+			writer.WriteString(fmt.Sprintf("STAT %d %d%s", size, sizes[size], endOfLine))
+		}
+	default:
+		writeClientError(writer, StatsErrNumBadCommand, fmt.Errorf("unknown stats group (%s)", args[0]))
+		writer.Flush()
+		return
+	}
+	writer.WriteString(replyEnd)
+	writer.Flush()
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// statsLogger appends a snapshot of the stats to 'StatsLog' every
+// 'StatsLogInterval', until the server is stopped (see StatsLog).
+func (s *Server) statsLogger() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.StatsLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.logStats(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// logStats writes the stats (as returned by `stats`) and the time of the
+// snapshot as a single line of JSON. Failed writes are logged and the next
+// snapshot is attempted regardless.
+func (s *Server) logStats(now time.Time) {
+	stats := s.getStats()
+	stats["time"] = now.UTC().Format(time.RFC3339)
+	line, err := json.Marshal(stats)
+	if err != nil {
+		s.logf("Server: failed to encode stats snapshot: %s\n", err)
+		return
+	}
+	if _, err := s.StatsLog.Write(append(line, '\n')); err != nil {
+		s.logf("Server: failed to write stats snapshot: %s\n", err)
+	}
+}
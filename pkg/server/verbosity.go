@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Log levels set with the `verbosity` command or the admin `/verbosity`
+// endpoint. Errors and admin actions are always logged.
+const (
+	// only errors and admin actions
+	verbosityQuiet = 0
+	// connection events (ie: a client closing its connection), the default
+	verbosityConnections = 1
+	// every command received
+	verbosityCommands = 2
+)
+
+// current log level, shared by every server of the process (as is the log package)
+var verbosity int32 = verbosityConnections
+
+// Verbosity returns the current log level.
+func Verbosity() int {
+	return int(atomic.LoadInt32(&verbosity))
+}
+
+// SetVerbosity changes the log level.
+func SetVerbosity(level int) {
+	atomic.StoreInt32(&verbosity, int32(level))
+}
+
+// logAt logs the message only if the log level is at least 'level'.
+func (s *Server) logAt(level int, format string, v ...interface{}) {
+	if Verbosity() >= level {
+		s.logf(format, v...)
+	}
+}
+
+// logf logs the message with the server's 'Logger', or the log package if
+// it has none.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maximum number of clients watching at once
+	maxWatchers = 2
+	// maximum number of events sent to a watcher per second, others are dropped
+	watchEventsPerSecond = 100
+	// number of events buffered for a watcher before new events are dropped
+	watchQueueSize = 256
+	// default and maximum duration of a watch
+	defaultWatchDuration = 30 * time.Second
+	maxWatchDuration     = 5 * time.Minute
+)
+
+// eventEvict is the operation of the events of entries evicted by the cache
+const eventEvict = "evict"
+
+// watchEvent is a single cache event: the command (or eviction) of a key
+type watchEvent struct {
+	op  string
+	key string
+}
+
+// watcher is a single client of /watch
+type watcher struct {
+	// number of events dropped because 'events' was full
+	// (first in the struct as it's accessed atomically)
+	dropped int64
+	events  chan watchEvent
+}
+
+// watchHub fans out cache events to the clients of /watch (see EnableWatch).
+//
+// Publishing is a single atomic load while nobody is watching. Otherwise
+// each watcher has a bounded queue, and events that don't fit are dropped
+// rather than slowing down the connection (or cache lock) publishing them.
+type watchHub struct {
+	// number of watchers, read without the lock by publish
+	numWatchers int32
+
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+// publish sends the event to every watcher with room in its queue
+func (h *watchHub) publish(op, key string) {
+	if atomic.LoadInt32(&h.numWatchers) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		select {
+		case w.events <- watchEvent{op: op, key: key}:
+		default:
+			atomic.AddInt64(&w.dropped, 1)
+		}
+	}
+}
+
+// subscribe adds a watcher, returning nil if there are already maxWatchers
+func (h *watchHub) subscribe() *watcher {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.watchers) >= maxWatchers {
+		return nil
+	}
+	w := &watcher{events: make(chan watchEvent, watchQueueSize)}
+	h.watchers[w] = struct{}{}
+	atomic.StoreInt32(&h.numWatchers, int32(len(h.watchers)))
+	return w
+}
+
+// unsubscribe removes a watcher added by subscribe
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.watchers, w)
+	atomic.StoreInt32(&h.numWatchers, int32(len(h.watchers)))
+}
+
+// watchHandler streams cache events as server-sent events (one per command
+// and key, plus evictions) until the client disconnects or `seconds` (default
+// 30, at most 300) have passed (ie: GET /watch?seconds=60).
+//
+// Each event is an `event: <op>` line (ie: set, get, delete, evict) followed
+// by a `data: <key>` line. At most 100 events are sent per second, and the
+// number of events dropped over that (or because the client is slow) is sent
+// as a `: dropped <n>` comment once a second.
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.EnableWatch {
+		http.Error(w, "watch is disabled", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is unsupported", http.StatusInternalServerError)
+		return
+	}
+	duration := defaultWatchDuration
+	if param := r.URL.Query().Get("seconds"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxWatchDuration {
+			http.Error(w, fmt.Sprintf("invalid number of seconds (%s)", param), http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	watcher := s.watch.subscribe()
+	if watcher == nil {
+		http.Error(w, "too many watchers", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.watch.unsubscribe(watcher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	timeout := time.NewTimer(duration)
+	defer timeout.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	sent := 0
+	dropped := 0
+	for {
+		select {
+		case event := <-watcher.events:
+			if sent >= watchEventsPerSecond {
+				dropped++
+				continue
+			}
+			sent++
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.op, event.key)
+			flusher.Flush()
+		case <-ticker.C:
+			if dropped += int(atomic.SwapInt64(&watcher.dropped, 0)); dropped > 0 {
+				fmt.Fprintf(w, ": dropped %d\n\n", dropped)
+				flusher.Flush()
+			}
+			sent, dropped = 0, 0
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.quit:
+			return
+		}
+	}
+}